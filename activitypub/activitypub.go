@@ -0,0 +1,194 @@
+// Package activitypub holds the ActivityStreams types, HTTP Signatures and
+// client requests beeline needs to federate with other servers
+package activitypub
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+)
+
+const (
+	ContentType = "application/activity+json"
+	// PublicCollection addresses an object to everyone
+	PublicCollection = "https://www.w3.org/ns/activitystreams#Public"
+
+	contextActivityStreams = "https://www.w3.org/ns/activitystreams"
+	contextSecurity        = "https://w3id.org/security/v1"
+)
+
+// Context is the @context of actors, the security vocabulary is needed for
+// their publicKey
+var Context = []string{contextActivityStreams, contextSecurity}
+
+type Actor struct {
+	Context           interface{} `json:"@context,omitempty"`
+	ID                string      `json:"id"`
+	Type              string      `json:"type"`
+	PreferredUsername string      `json:"preferredUsername"`
+	Name              string      `json:"name,omitempty"`
+	URL               string      `json:"url,omitempty"`
+	Inbox             string      `json:"inbox"`
+	Outbox            string      `json:"outbox,omitempty"`
+	Followers         string      `json:"followers,omitempty"`
+	Endpoints         *Endpoints  `json:"endpoints,omitempty"`
+	PublicKey         PublicKey   `json:"publicKey"`
+}
+
+type Endpoints struct {
+	SharedInbox string `json:"sharedInbox,omitempty"`
+}
+
+type PublicKey struct {
+	ID           string `json:"id"`
+	Owner        string `json:"owner"`
+	PublicKeyPem string `json:"publicKeyPem"`
+}
+
+type Note struct {
+	Context      interface{} `json:"@context,omitempty"`
+	ID           string      `json:"id"`
+	Type         string      `json:"type"`
+	AttributedTo string      `json:"attributedTo"`
+	Content      string      `json:"content"`
+	Published    string      `json:"published,omitempty"`
+	Updated      string      `json:"updated,omitempty"`
+	// URL is usually a string but some servers send link objects
+	URL       interface{} `json:"url,omitempty"`
+	InReplyTo string      `json:"inReplyTo,omitempty"`
+	To        []string    `json:"to,omitempty"`
+	Cc        []string    `json:"cc,omitempty"`
+}
+
+// Link is the html page of the note, falling back to its id
+func (n *Note) Link() string {
+	if u, ok := n.URL.(string); ok && u != "" {
+		return u
+	}
+	return n.ID
+}
+
+// Activity wraps an Object which may be an embedded object or only its id
+type Activity struct {
+	Context   interface{}     `json:"@context,omitempty"`
+	ID        string          `json:"id"`
+	Type      string          `json:"type"`
+	Actor     string          `json:"actor"`
+	Object    json.RawMessage `json:"object"`
+	Published string          `json:"published,omitempty"`
+	To        []string        `json:"to,omitempty"`
+	Cc        []string        `json:"cc,omitempty"`
+}
+
+// NewActivity builds an activity of typ by actor about object
+func NewActivity(id, typ, actor string, object interface{}) (*Activity, error) {
+	raw, err := json.Marshal(object)
+	if err != nil {
+		return nil, err
+	}
+	return &Activity{
+		Context: contextActivityStreams,
+		ID:      id,
+		Type:    typ,
+		Actor:   actor,
+		Object:  raw,
+	}, nil
+}
+
+// ObjectID is the id of the activity's object whether it was embedded or not
+func (a *Activity) ObjectID() string {
+	var id string
+	if json.Unmarshal(a.Object, &id) == nil {
+		return id
+	}
+	var obj struct {
+		ID string `json:"id"`
+	}
+	json.Unmarshal(a.Object, &obj)
+	return obj.ID
+}
+
+// ObjectType is the type of an embedded object, empty if only its id was sent
+func (a *Activity) ObjectType() string {
+	var obj struct {
+		Type string `json:"type"`
+	}
+	json.Unmarshal(a.Object, &obj)
+	return obj.Type
+}
+
+// DecodeObject unmarshals the embedded object into v
+func (a *Activity) DecodeObject(v interface{}) error {
+	if err := json.Unmarshal(a.Object, v); err != nil {
+		return fmt.Errorf("activity %s object: %w", a.ID, err)
+	}
+	return nil
+}
+
+type OrderedCollection struct {
+	Context      interface{}   `json:"@context,omitempty"`
+	ID           string        `json:"id"`
+	Type         string        `json:"type"`
+	TotalItems   int64         `json:"totalItems"`
+	OrderedItems []interface{} `json:"orderedItems,omitempty"`
+}
+
+// NewOrderedCollection lists items, which may be left out for collections
+// only shared by size
+func NewOrderedCollection(id string, total int64, items []interface{}) *OrderedCollection {
+	return &OrderedCollection{
+		Context:      contextActivityStreams,
+		ID:           id,
+		Type:         "OrderedCollection",
+		TotalItems:   total,
+		OrderedItems: items,
+	}
+}
+
+// WebFinger is the JSON Resource Descriptor served for acct: lookups
+type WebFinger struct {
+	Subject string          `json:"subject"`
+	Aliases []string        `json:"aliases,omitempty"`
+	Links   []WebFingerLink `json:"links"`
+}
+
+type WebFingerLink struct {
+	Rel  string `json:"rel"`
+	Type string `json:"type,omitempty"`
+	Href string `json:"href,omitempty"`
+}
+
+var handleRe = regexp.MustCompile(`^@?([A-Za-z0-9_.-]+)@([A-Za-z0-9.-]+(:[0-9]+)?)$`)
+
+// ParseHandle splits user@host, the leading @ is optional
+func ParseHandle(handle string) (user, host string, ok bool) {
+	m := handleRe.FindStringSubmatch(strings.TrimSpace(handle))
+	if m == nil {
+		return "", "", false
+	}
+	return m[1], strings.ToLower(m[2]), true
+}
+
+// IsHandle is true for remote user@host handles, local usernames never
+// contain an @
+func IsHandle(s string) bool {
+	_, _, ok := ParseHandle(s)
+	return ok
+}
+
+var (
+	breakRe     = regexp.MustCompile(`(?i)<br\s*/?>`)
+	paragraphRe = regexp.MustCompile(`(?i)</p>\s*<p[^>]*>`)
+	tagRe       = regexp.MustCompile(`<[^>]*>`)
+)
+
+// HTMLToText turns the html content of a remote Note into plain text, it is
+// escaped again when rendered so nothing from the remote server is trusted
+func HTMLToText(content string) string {
+	text := breakRe.ReplaceAllString(content, "\n")
+	text = paragraphRe.ReplaceAllString(text, "\n\n")
+	text = tagRe.ReplaceAllString(text, "")
+	return strings.TrimSpace(html.UnescapeString(text))
+}
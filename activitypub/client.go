@@ -0,0 +1,143 @@
+package activitypub
+
+import (
+	"beeline/outbound"
+	"bytes"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// maxResponseSize limits how much of a remote document is read
+const maxResponseSize = 1 << 20
+
+var client = newClient()
+
+func newClient() *http.Client {
+	c := outbound.NewClient(10 * time.Second)
+	c.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 5 {
+			return fmt.Errorf("too many redirects")
+		}
+		return checkURL(req.URL.String())
+	}
+	return c
+}
+
+// Scheme is https, except for loopback hosts when private addresses are
+// allowed, which lets two local instances federate during development
+func Scheme(host string) string {
+	if !outbound.PrivateAddressesAllowed() {
+		return "https"
+	}
+	h := host
+	if hh, _, err := net.SplitHostPort(host); err == nil {
+		h = hh
+	}
+	if h == "localhost" {
+		return "http"
+	}
+	if ip := net.ParseIP(h); ip != nil && ip.IsLoopback() {
+		return "http"
+	}
+	return "https"
+}
+
+// checkURL only allows fetching and delivering to urls with the scheme
+// Scheme picks for their host
+func checkURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if u.Host == "" || u.Scheme != Scheme(u.Host) {
+		return fmt.Errorf("refusing to contact %s", rawURL)
+	}
+	return nil
+}
+
+// Lookup finds the actor id of a user@host handle with WebFinger
+func Lookup(handle string) (string, error) {
+	user, host, ok := ParseHandle(handle)
+	if !ok {
+		return "", fmt.Errorf("invalid handle %s", handle)
+	}
+	resource := "acct:" + user + "@" + host
+	u := Scheme(host) + "://" + host + "/.well-known/webfinger?resource=" + url.QueryEscape(resource)
+	var wf WebFinger
+	if err := get(u, "application/jrd+json, application/json", &wf); err != nil {
+		return "", err
+	}
+	for _, l := range wf.Links {
+		if l.Rel == "self" && (l.Type == ContentType || l.Type == `application/ld+json; profile="https://www.w3.org/ns/activitystreams"`) {
+			return l.Href, nil
+		}
+	}
+	return "", fmt.Errorf("%s has no ActivityPub actor", handle)
+}
+
+// FetchActor loads the actor document at id
+func FetchActor(id string) (*Actor, error) {
+	var a Actor
+	if err := get(id, ContentType, &a); err != nil {
+		return nil, err
+	}
+	if a.ID != id || a.Inbox == "" || a.PublicKey.PublicKeyPem == "" {
+		return nil, fmt.Errorf("actor %s is incomplete", id)
+	}
+	return &a, nil
+}
+
+// Deliver POSTs a signed activity to an inbox
+func Deliver(inbox string, activity *Activity, keyID string, key *rsa.PrivateKey) error {
+	if err := checkURL(inbox); err != nil {
+		return err
+	}
+	body, err := json.Marshal(activity)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, inbox, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", ContentType)
+	if err := Sign(req, keyID, key, body); err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxResponseSize))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("delivering to %s: %s", inbox, resp.Status)
+	}
+	return nil
+}
+
+func get(rawURL, accept string, v interface{}) error {
+	if err := checkURL(rawURL); err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", accept)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching %s: %s", rawURL, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(v)
+}
@@ -0,0 +1,95 @@
+package activitypub
+
+import (
+	"beeline/outbound"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// serveActor answers every request with the actor made by actor from the
+// server's own url
+func serveActor(t *testing.T, actor func(base string) Actor) *httptest.Server {
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", ContentType)
+		json.NewEncoder(w).Encode(actor(srv.URL))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestFetchActor(t *testing.T) {
+	outbound.AllowPrivateAddresses(true)
+	t.Cleanup(func() { outbound.AllowPrivateAddresses(false) })
+	_, publicPEM, err := GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey() error: %v", err)
+	}
+	tests := []struct {
+		name  string
+		actor func(base string) Actor
+		valid bool
+	}{
+		{
+			name: "complete",
+			actor: func(base string) Actor {
+				return Actor{ID: base + "/users/alice", Inbox: base + "/inbox", PublicKey: PublicKey{PublicKeyPem: publicPEM}}
+			},
+			valid: true,
+		},
+		{
+			name: "id of another server",
+			actor: func(base string) Actor {
+				return Actor{ID: "https://victim.example/users/alice", Inbox: base + "/inbox", PublicKey: PublicKey{PublicKeyPem: publicPEM}}
+			},
+		},
+		{
+			name: "id of another actor",
+			actor: func(base string) Actor {
+				return Actor{ID: base + "/users/bob", Inbox: base + "/inbox", PublicKey: PublicKey{PublicKeyPem: publicPEM}}
+			},
+		},
+		{
+			name: "without inbox",
+			actor: func(base string) Actor {
+				return Actor{ID: base + "/users/alice", PublicKey: PublicKey{PublicKeyPem: publicPEM}}
+			},
+		},
+		{
+			name: "without key",
+			actor: func(base string) Actor {
+				return Actor{ID: base + "/users/alice", Inbox: base + "/inbox"}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := serveActor(t, tt.actor)
+			a, err := FetchActor(srv.URL + "/users/alice")
+			if (err == nil) != tt.valid {
+				t.Errorf("FetchActor() = %+v, %v, want valid %v", a, err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestFetchActorRefusesPrivateAddresses(t *testing.T) {
+	requests := 0
+	srv := serveActor(t, func(base string) Actor {
+		requests++
+		return Actor{ID: base + "/users/alice"}
+	})
+	// loopback urls are only http while private addresses are allowed, so
+	// ask for https and let the dialer refuse it
+	_, err := FetchActor(strings.Replace(srv.URL, "http:", "https:", 1) + "/users/alice")
+	if !errors.Is(err, outbound.ErrPrivateAddress) {
+		t.Errorf("FetchActor() of a loopback actor error = %v, want %v", err, outbound.ErrPrivateAddress)
+	}
+	if requests != 0 {
+		t.Errorf("the loopback server got %d requests", requests)
+	}
+}
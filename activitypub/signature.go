@@ -0,0 +1,194 @@
+package activitypub
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// MaxClockSkew is how far the Date of a signed request may be from now
+const MaxClockSkew = 12 * time.Hour
+
+// GenerateKey creates the RSA key pair an actor signs its requests with, both
+// returned PEM encoded
+func GenerateKey() (privatePEM, publicPEM string, err error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return "", "", err
+	}
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return "", "", err
+	}
+	privatePEM = string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}))
+	publicPEM = string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub}))
+	return privatePEM, publicPEM, nil
+}
+
+func ParsePrivateKey(privatePEM string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(privatePEM))
+	if block == nil {
+		return nil, fmt.Errorf("private key is not PEM encoded")
+	}
+	return x509.ParsePKCS1PrivateKey(block.Bytes)
+}
+
+// ParsePublicKey reads PKIX and PKCS #1 RSA public keys
+func ParsePublicKey(publicPEM string) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(publicPEM))
+	if block == nil {
+		return nil, fmt.Errorf("public key is not PEM encoded")
+	}
+	if block.Type == "RSA PUBLIC KEY" {
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("public key is not an RSA key")
+	}
+	return rsaKey, nil
+}
+
+// Digest is the value of the Digest header for body
+func Digest(body []byte) string {
+	sum := sha256.Sum256(body)
+	return "SHA-256=" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// Sign adds an rsa-sha256 HTTP Signature over the request target, host,
+// date and, when there is a body, its digest
+func Sign(req *http.Request, keyID string, key *rsa.PrivateKey, body []byte) error {
+	req.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("Host", req.URL.Host)
+	headers := []string{"(request-target)", "host", "date"}
+	if body != nil {
+		req.Header.Set("Digest", Digest(body))
+		headers = append(headers, "digest")
+	}
+	target := strings.ToLower(req.Method) + " " + req.URL.RequestURI()
+	signed := signingString(headers, target, func(name string) string {
+		if name == "host" {
+			return req.URL.Host
+		}
+		return req.Header.Get(name)
+	})
+	hash := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Signature", fmt.Sprintf(`keyId="%s",algorithm="rsa-sha256",headers="%s",signature="%s"`,
+		keyID, strings.Join(headers, " "), base64.StdEncoding.EncodeToString(sig)))
+	return nil
+}
+
+// Signature is a parsed Signature header
+type Signature struct {
+	KeyID     string
+	Algorithm string
+	Headers   []string
+	Signature []byte
+}
+
+func ParseSignature(header string) (*Signature, error) {
+	if header == "" {
+		return nil, fmt.Errorf("request is not signed")
+	}
+	s := &Signature{Headers: []string{"date"}}
+	for _, part := range strings.Split(header, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			continue
+		}
+		v = strings.Trim(v, `"`)
+		switch k {
+		case "keyId":
+			s.KeyID = v
+		case "algorithm":
+			s.Algorithm = v
+		case "headers":
+			s.Headers = strings.Fields(strings.ToLower(v))
+		case "signature":
+			sig, err := base64.StdEncoding.DecodeString(v)
+			if err != nil {
+				return nil, fmt.Errorf("signature is not base64: %w", err)
+			}
+			s.Signature = sig
+		}
+	}
+	if s.KeyID == "" || s.Signature == nil {
+		return nil, fmt.Errorf("signature is missing keyId or signature")
+	}
+	return s, nil
+}
+
+// Verify checks the signature of a request with method and target (path and
+// query), header looks up the request's headers. POSTs must sign their
+// digest, which the caller compares to the body with CheckDigest.
+func (s *Signature) Verify(key *rsa.PublicKey, method, target string, header func(string) string) error {
+	if s.Algorithm != "" && s.Algorithm != "rsa-sha256" && s.Algorithm != "hs2019" {
+		return fmt.Errorf("unsupported signature algorithm %s", s.Algorithm)
+	}
+	required := []string{"(request-target)", "host", "date"}
+	if strings.EqualFold(method, http.MethodPost) {
+		required = append(required, "digest")
+	}
+	for _, r := range required {
+		if !contains(s.Headers, r) {
+			return fmt.Errorf("signature does not cover %s", r)
+		}
+	}
+	date, err := http.ParseTime(header("date"))
+	if err != nil {
+		return fmt.Errorf("invalid date header: %w", err)
+	}
+	if d := time.Since(date); d > MaxClockSkew || d < -MaxClockSkew {
+		return fmt.Errorf("date %s is too far from now", header("date"))
+	}
+	signed := signingString(s.Headers, strings.ToLower(method)+" "+target, header)
+	hash := sha256.Sum256([]byte(signed))
+	return rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], s.Signature)
+}
+
+// CheckDigest makes sure a signed Digest header matches the body
+func CheckDigest(header string, body []byte) error {
+	for _, d := range strings.Split(header, ",") {
+		if strings.TrimSpace(d) == Digest(body) {
+			return nil
+		}
+	}
+	return fmt.Errorf("digest does not match the body")
+}
+
+func signingString(headers []string, target string, header func(string) string) string {
+	lines := make([]string, 0, len(headers))
+	for _, h := range headers {
+		if h == "(request-target)" {
+			lines = append(lines, h+": "+target)
+			continue
+		}
+		lines = append(lines, h+": "+header(h))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,253 @@
+package activitypub
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testKey, otherKey = mustKey(), mustKey()
+
+func mustKey() *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// signOver signs req like Sign does, but over the given headers and with the
+// given date so tests can leave headers out or sign stale requests
+func signOver(t *testing.T, req *http.Request, key *rsa.PrivateKey, headers []string, date time.Time, body []byte) {
+	t.Helper()
+	req.Header.Set("Date", date.UTC().Format(http.TimeFormat))
+	req.Header.Set("Host", req.URL.Host)
+	if body != nil {
+		req.Header.Set("Digest", Digest(body))
+	}
+	signed := signingString(headers, strings.ToLower(req.Method)+" "+req.URL.RequestURI(), req.Header.Get)
+	hash := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	if err != nil {
+		t.Fatalf("SignPKCS1v15: %v", err)
+	}
+	req.Header.Set("Signature", fmt.Sprintf(`keyId="https://remote.example/users/alice#main-key",algorithm="rsa-sha256",headers="%s",signature="%s"`,
+		strings.Join(headers, " "), base64.StdEncoding.EncodeToString(sig)))
+}
+
+// verifyRequest checks req the way the inbox does
+func verifyRequest(req *http.Request, body []byte, key *rsa.PublicKey) error {
+	sig, err := ParseSignature(req.Header.Get("Signature"))
+	if err != nil {
+		return err
+	}
+	if req.Method == http.MethodPost {
+		if err := CheckDigest(req.Header.Get("Digest"), body); err != nil {
+			return err
+		}
+	}
+	return sig.Verify(key, req.Method, req.URL.RequestURI(), req.Header.Get)
+}
+
+func TestSignVerifyRoundTrip(t *testing.T) {
+	body := []byte(`{"type":"Follow"}`)
+	req, _ := http.NewRequest(http.MethodPost, "https://beeline.example/user/alice/inbox?x=1", nil)
+	if err := Sign(req, "https://remote.example/users/alice#main-key", testKey, body); err != nil {
+		t.Fatalf("Sign() error: %v", err)
+	}
+	sig, err := ParseSignature(req.Header.Get("Signature"))
+	if err != nil {
+		t.Fatalf("ParseSignature() error: %v", err)
+	}
+	if sig.KeyID != "https://remote.example/users/alice#main-key" || sig.Algorithm != "rsa-sha256" {
+		t.Errorf("ParseSignature() = %+v", sig)
+	}
+	if got, want := strings.Join(sig.Headers, " "), "(request-target) host date digest"; got != want {
+		t.Errorf("signed headers = %q, want %q", got, want)
+	}
+	if err := verifyRequest(req, body, &testKey.PublicKey); err != nil {
+		t.Errorf("verifying a signed request: %v", err)
+	}
+
+	get, _ := http.NewRequest(http.MethodGet, "https://remote.example/users/alice", nil)
+	if err := Sign(get, "https://beeline.example/user/alice#main-key", testKey, nil); err != nil {
+		t.Fatalf("Sign() error: %v", err)
+	}
+	if get.Header.Get("Digest") != "" {
+		t.Errorf("Sign() added a digest to a request without a body")
+	}
+	if err := verifyRequest(get, nil, &testKey.PublicKey); err != nil {
+		t.Errorf("verifying a signed GET: %v", err)
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	all := []string{"(request-target)", "host", "date", "digest"}
+	tests := []struct {
+		name    string
+		method  string
+		headers []string
+		age     time.Duration
+		// tamper changes the request or its body after signing
+		tamper  func(req *http.Request, body *[]byte)
+		key     *rsa.PrivateKey
+		wantErr string
+	}{
+		{
+			name: "valid",
+		},
+		{
+			name: "date within the allowed skew",
+			age:  MaxClockSkew - time.Hour,
+		},
+		{
+			name:    "get without digest",
+			method:  http.MethodGet,
+			headers: []string{"(request-target)", "host", "date"},
+		},
+		{
+			name:    "post without digest",
+			headers: []string{"(request-target)", "host", "date"},
+			wantErr: "does not cover digest",
+		},
+		{
+			name:    "without host",
+			headers: []string{"(request-target)", "date", "digest"},
+			wantErr: "does not cover host",
+		},
+		{
+			name:    "without request target",
+			headers: []string{"host", "date", "digest"},
+			wantErr: "does not cover (request-target)",
+		},
+		{
+			name:    "without a headers parameter only date is signed",
+			tamper:  func(req *http.Request, _ *[]byte) { dropParam(req, "headers") },
+			wantErr: "does not cover (request-target)",
+		},
+		{
+			name:    "stale date",
+			age:     MaxClockSkew + time.Hour,
+			wantErr: "too far from now",
+		},
+		{
+			name:    "date in the future",
+			age:     -MaxClockSkew - time.Hour,
+			wantErr: "too far from now",
+		},
+		{
+			name: "tampered body",
+			tamper: func(_ *http.Request, body *[]byte) {
+				*body = []byte(`{"type":"Delete"}`)
+			},
+			wantErr: "digest does not match",
+		},
+		{
+			name: "tampered body and digest",
+			tamper: func(req *http.Request, body *[]byte) {
+				*body = []byte(`{"type":"Delete"}`)
+				req.Header.Set("Digest", Digest(*body))
+			},
+			wantErr: "verification error",
+		},
+		{
+			name:    "other target",
+			tamper:  func(req *http.Request, _ *[]byte) { req.URL.Path = "/user/bob/inbox" },
+			wantErr: "verification error",
+		},
+		{
+			name:    "other host",
+			tamper:  func(req *http.Request, _ *[]byte) { req.Header.Set("Host", "other.example") },
+			wantErr: "verification error",
+		},
+		{
+			name:    "other key",
+			key:     otherKey,
+			wantErr: "verification error",
+		},
+		{
+			name: "unsupported algorithm",
+			tamper: func(req *http.Request, _ *[]byte) {
+				req.Header.Set("Signature", strings.Replace(req.Header.Get("Signature"), "rsa-sha256", "rsa-sha1", 1))
+			},
+			wantErr: "unsupported signature algorithm",
+		},
+		{
+			name:    "unsigned",
+			tamper:  func(req *http.Request, _ *[]byte) { req.Header.Del("Signature") },
+			wantErr: "not signed",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method, headers, key := tt.method, tt.headers, tt.key
+			if method == "" {
+				method = http.MethodPost
+			}
+			if headers == nil {
+				headers = all
+			}
+			if key == nil {
+				key = testKey
+			}
+			var body []byte
+			if method == http.MethodPost {
+				body = []byte(`{"type":"Follow"}`)
+			}
+			req, _ := http.NewRequest(method, "https://beeline.example/user/alice/inbox", nil)
+			signOver(t, req, key, headers, time.Now().Add(-tt.age), body)
+			if tt.tamper != nil {
+				tt.tamper(req, &body)
+			}
+			err := verifyRequest(req, body, &testKey.PublicKey)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("verify error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("verify error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// dropParam removes a parameter from the request's Signature header
+func dropParam(req *http.Request, name string) {
+	var kept []string
+	for _, part := range strings.Split(req.Header.Get("Signature"), ",") {
+		if !strings.HasPrefix(part, name+"=") {
+			kept = append(kept, part)
+		}
+	}
+	req.Header.Set("Signature", strings.Join(kept, ","))
+}
+
+func TestCheckDigest(t *testing.T) {
+	body := []byte("hello")
+	tests := []struct {
+		name   string
+		header string
+		valid  bool
+	}{
+		{name: "matching", header: Digest(body), valid: true},
+		{name: "one of several", header: "SHA-512=abc, " + Digest(body), valid: true},
+		{name: "other body", header: Digest([]byte("hello!"))},
+		{name: "missing", header: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := CheckDigest(tt.header, body); (err == nil) != tt.valid {
+				t.Errorf("CheckDigest(%q) error = %v, want valid %v", tt.header, err, tt.valid)
+			}
+		})
+	}
+}
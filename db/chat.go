@@ -0,0 +1,111 @@
+package db
+
+import (
+	"beeline/models"
+	"log"
+	"time"
+)
+
+// GetChatRoom returns the room with the given name, creating it with the
+// default retention policy if it does not exist yet
+func (d *DB) GetChatRoom(name string) *models.ChatRoom {
+	cr := models.NewChatRoom(name)
+	tx := d.db.Where("name = ?", name).FirstOrCreate(cr)
+	if tx.Error != nil {
+		log.Printf("DB::GetChatRoom error: %s", tx.Error.Error())
+	}
+	return cr
+}
+
+// FindChatRoom returns the room only if it has been joined before, unlike
+// GetChatRoom it never creates one
+func (d *DB) FindChatRoom(name string) (*models.ChatRoom, bool) {
+	var cr models.ChatRoom
+	tx := d.db.Where("name = ?", name).Limit(1).Find(&cr)
+	if tx.Error != nil {
+		log.Printf("DB::FindChatRoom error: %s", tx.Error.Error())
+	}
+	return &cr, tx.RowsAffected == 1
+}
+
+// GetChatRooms returns every room that has been joined, by name
+func (d *DB) GetChatRooms() []models.ChatRoom {
+	var rooms []models.ChatRoom
+	tx := d.db.Order("name").Find(&rooms)
+	if tx.Error != nil {
+		log.Printf("DB::GetChatRooms error: %s", tx.Error.Error())
+	}
+	return rooms
+}
+
+func (d *DB) UpdateChatRoomRetention(cr *models.ChatRoom) {
+	tx := d.db.Model(&models.ChatRoom{}).Where("name = ?", cr.Name).Updates(map[string]interface{}{
+		"max_age":      cr.MaxAge,
+		"max_messages": cr.MaxMessages,
+		"max_bytes":    cr.MaxBytes,
+	})
+	if tx.Error != nil {
+		log.Printf("DB::UpdateChatRoomRetention error: %s", tx.Error.Error())
+		return
+	}
+	d.PruneChatMessages(cr.Name)
+}
+
+func (d *DB) NewChatMessage(cm *models.ChatMessage) {
+	tx := d.db.Create(cm)
+	if tx.Error != nil {
+		log.Printf("DB::NewChatMessage error: %s", tx.Error.Error())
+		return
+	}
+	d.PruneChatMessages(cm.Room)
+}
+
+// GetRecentChatMessages returns the last n messages of a room, oldest first
+func (d *DB) GetRecentChatMessages(room string, n int) []models.ChatMessage {
+	var messages []models.ChatMessage
+	tx := d.db.Where("room = ?", room).Order("id desc").Limit(n).Find(&messages)
+	if tx.Error != nil {
+		log.Printf("DB::GetRecentChatMessages error: %s", tx.Error.Error())
+	}
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages
+}
+
+// PruneChatMessages applies the retention policy of the room, anything outside
+// of it is removed permanently. Rooms that were never joined have no policy
+// and are left alone.
+func (d *DB) PruneChatMessages(room string) {
+	cr, ok := d.FindChatRoom(room)
+	if !ok {
+		return
+	}
+	if cr.MaxAge > 0 {
+		tx := d.db.Unscoped().Where("room = ? AND timestamp < ?", room, time.Now().Add(-cr.MaxAge)).Delete(&models.ChatMessage{})
+		if tx.Error != nil {
+			log.Printf("DB::PruneChatMessages max age error: %s", tx.Error.Error())
+		}
+	}
+	if cr.MaxMessages > 0 {
+		// Everything from the message MaxMessages places below the newest one
+		tx := d.db.Exec(`DELETE FROM chat_messages WHERE room = ? AND id <= (
+			SELECT id FROM chat_messages WHERE room = ? ORDER BY id DESC LIMIT 1 OFFSET ?)`,
+			room, room, cr.MaxMessages)
+		if tx.Error != nil {
+			log.Printf("DB::PruneChatMessages max messages error: %s", tx.Error.Error())
+		}
+	}
+	if cr.MaxBytes > 0 {
+		// The running total counts bytes from the newest message back
+		tx := d.db.Exec(`DELETE FROM chat_messages WHERE id IN (
+			SELECT id FROM (
+				SELECT id, SUM(length(CAST(message AS BLOB))) OVER (ORDER BY id DESC) AS total
+				FROM chat_messages WHERE room = ?
+			) WHERE total > ?)`,
+			room, cr.MaxBytes)
+		if tx.Error != nil {
+			log.Printf("DB::PruneChatMessages max bytes error: %s", tx.Error.Error())
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package db
+
+import (
+	"beeline/models"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestDB opens a fresh database in the test's temporary directory
+func newTestDB(t *testing.T) *DB {
+	t.Helper()
+	d, err := NewAndMigrate(filepath.Join(t.TempDir(), "beeline.db"))
+	if err != nil {
+		t.Fatalf("NewAndMigrate: %v", err)
+	}
+	return d
+}
+
+func chatMessages(d *DB, room string) []string {
+	var messages []string
+	for _, cm := range d.GetRecentChatMessages(room, 1000) {
+		messages = append(messages, cm.Message)
+	}
+	return messages
+}
+
+func TestPruneChatMessages(t *testing.T) {
+	tests := []struct {
+		name     string
+		room     models.ChatRoom
+		messages []string
+		want     []string
+	}{
+		{
+			name:     "no limits",
+			room:     models.ChatRoom{},
+			messages: []string{"aaa", "bbb", "ccc"},
+			want:     []string{"aaa", "bbb", "ccc"},
+		},
+		{
+			name:     "max messages",
+			room:     models.ChatRoom{MaxMessages: 2},
+			messages: []string{"aaa", "bbb", "ccc", "ddd"},
+			want:     []string{"ccc", "ddd"},
+		},
+		{
+			name:     "max messages not reached",
+			room:     models.ChatRoom{MaxMessages: 5},
+			messages: []string{"aaa", "bbb"},
+			want:     []string{"aaa", "bbb"},
+		},
+		{
+			name:     "max bytes",
+			room:     models.ChatRoom{MaxBytes: 7},
+			messages: []string{"aaa", "bbb", "ccc", "ddd"},
+			want:     []string{"ccc", "ddd"},
+		},
+		{
+			name:     "max bytes counts bytes not characters",
+			room:     models.ChatRoom{MaxBytes: 8},
+			messages: []string{"aaa", "ééé", "bbb"},
+			want:     []string{"bbb"},
+		},
+		{
+			name:     "both limits",
+			room:     models.ChatRoom{MaxMessages: 3, MaxBytes: 100},
+			messages: []string{"aaa", "bbb", "ccc", "ddd"},
+			want:     []string{"bbb", "ccc", "ddd"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newTestDB(t)
+			cr := tt.room
+			cr.Name = "room"
+			d.GetChatRoom(cr.Name)
+			d.UpdateChatRoomRetention(&cr)
+			for _, m := range tt.messages {
+				d.NewChatMessage(&models.ChatMessage{Room: cr.Name, Username: "alice", Message: m, Timestamp: time.Now()})
+			}
+			// Messages in other rooms are never pruned with this one
+			d.db.Create(&models.ChatMessage{Room: "other", Username: "alice", Message: "other", Timestamp: time.Now()})
+			d.PruneChatMessages(cr.Name)
+			if got := chatMessages(d, cr.Name); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("messages = %v, want %v", got, tt.want)
+			}
+			if got := chatMessages(d, "other"); len(got) != 1 {
+				t.Errorf("messages of the other room = %v", got)
+			}
+		})
+	}
+}
+
+func TestPruneChatMessagesMaxAge(t *testing.T) {
+	d := newTestDB(t)
+	cr := &models.ChatRoom{Name: "room", MaxAge: time.Hour}
+	d.GetChatRoom(cr.Name)
+	d.UpdateChatRoomRetention(cr)
+	d.db.Create(&models.ChatMessage{Room: cr.Name, Message: "old", Timestamp: time.Now().Add(-2 * time.Hour)})
+	d.NewChatMessage(&models.ChatMessage{Room: cr.Name, Message: "new", Timestamp: time.Now()})
+	if got := chatMessages(d, cr.Name); strings.Join(got, ",") != "new" {
+		t.Errorf("messages = %v, want [new]", got)
+	}
+}
+
+func TestPruneChatMessagesNeverCreatesRooms(t *testing.T) {
+	d := newTestDB(t)
+	d.NewChatMessage(&models.ChatMessage{Room: "unknown", Message: "hello", Timestamp: time.Now()})
+	d.PruneChatMessages("unknown")
+	if _, ok := d.FindChatRoom("unknown"); ok {
+		t.Errorf("pruning created the room")
+	}
+	if rooms := d.GetChatRooms(); len(rooms) != 0 {
+		t.Errorf("rooms = %v, want none", rooms)
+	}
+}
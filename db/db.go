@@ -7,10 +7,12 @@ import (
 
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type DB struct {
-	db *gorm.DB
+	db      *gorm.DB
+	hasFTS5 bool
 }
 
 func NewAndMigrate(dbName string) (*DB, error) {
@@ -26,11 +28,47 @@ func NewAndMigrate(dbName string) (*DB, error) {
 	if err != nil {
 		return nil, err
 	}
+	err = db.AutoMigrate(&models.PostRevision{})
+	if err != nil {
+		return nil, err
+	}
+	err = db.AutoMigrate(&models.PostTag{})
+	if err != nil {
+		return nil, err
+	}
+	err = db.AutoMigrate(&models.RemoteActor{})
+	if err != nil {
+		return nil, err
+	}
+	err = dedupeFollowings(db)
+	if err != nil {
+		return nil, err
+	}
 	err = db.AutoMigrate(&models.Following{})
 	if err != nil {
 		return nil, err
 	}
-	err = db.AutoMigrate(&models.Auth{})
+	err = db.AutoMigrate(&models.Session{})
+	if err != nil {
+		return nil, err
+	}
+	err = db.AutoMigrate(&models.RecoveryCode{})
+	if err != nil {
+		return nil, err
+	}
+	err = db.AutoMigrate(&models.LoginChallenge{})
+	if err != nil {
+		return nil, err
+	}
+	err = db.AutoMigrate(&models.Invite{})
+	if err != nil {
+		return nil, err
+	}
+	err = db.AutoMigrate(&models.Setting{})
+	if err != nil {
+		return nil, err
+	}
+	err = db.AutoMigrate(&models.ModerationLog{})
 	if err != nil {
 		return nil, err
 	}
@@ -38,7 +76,37 @@ func NewAndMigrate(dbName string) (*DB, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &DB{db}, nil
+	err = db.AutoMigrate(&models.ChatMessage{})
+	if err != nil {
+		return nil, err
+	}
+	err = db.AutoMigrate(&models.ChatRoom{})
+	if err != nil {
+		return nil, err
+	}
+	err = db.AutoMigrate(&models.Notification{})
+	if err != nil {
+		return nil, err
+	}
+	err = db.AutoMigrate(&models.Webmention{})
+	if err != nil {
+		return nil, err
+	}
+	err = db.AutoMigrate(&models.WebmentionDelivery{})
+	if err != nil {
+		return nil, err
+	}
+	err = db.AutoMigrate(&models.AccessToken{})
+	if err != nil {
+		return nil, err
+	}
+	err = db.AutoMigrate(&models.Reaction{})
+	if err != nil {
+		return nil, err
+	}
+	d := &DB{db: db}
+	d.setupSearch()
+	return d, nil
 }
 
 func (d *DB) CreateAdmin() {
@@ -95,6 +163,28 @@ func (d *DB) CreateUser(username, password string, isAdmin bool) {
 	})
 }
 
+// CreateUserWithTempPassword creates a user that has to change their password
+// the first time they login
+func (d *DB) CreateUserWithTempPassword(username, tempPassword string) {
+	pwHash := generatePasswordHash(tempPassword)
+	d.db.Create(&models.User{
+		Username:           username,
+		Password:           pwHash,
+		MustChangePassword: true,
+	})
+}
+
+// CreateInvitedUser creates a user that signed up using invite
+func (d *DB) CreateInvitedUser(username, password string, invite *models.Invite) {
+	pwHash := generatePasswordHash(password)
+	d.db.Create(&models.User{
+		Username:  username,
+		Password:  pwHash,
+		InvitedBy: invite.CreatedBy,
+		InviteID:  invite.ID,
+	})
+}
+
 func (d *DB) TotalUserCount() int {
 	var count int64
 	d.db.Table("users").Count(&count)
@@ -134,6 +224,24 @@ func (d *DB) UpdateUserPassword(userId uint64, password string) {
 	}
 }
 
+func (d *DB) UpdateUserMustChangePassword(userId uint64, mustChangePassword bool) {
+	tx := d.db.Model(&models.User{}).Where("id = ?", userId).Update("must_change_password", mustChangePassword)
+	if tx.Error != nil {
+		log.Printf("DB::UpdateUserMustChangePassword error: %s", tx.Error.Error())
+	}
+}
+
+func (d *DB) UpdateUserPreferences(userId uint64, timezone, dateFormat string, feedsPrivate bool) {
+	tx := d.db.Model(&models.User{}).Where("id = ?", userId).Updates(map[string]interface{}{
+		"timezone":      timezone,
+		"date_format":   dateFormat,
+		"feeds_private": feedsPrivate,
+	})
+	if tx.Error != nil {
+		log.Printf("DB::UpdateUserPreferences error: %s", tx.Error.Error())
+	}
+}
+
 func (d *DB) UpdateUserAdmin(userId uint64, isAdmin bool) {
 	tx := d.db.Model(&models.User{}).Where("id = ?", userId).Update("admin", isAdmin)
 	if tx.Error != nil {
@@ -148,8 +256,7 @@ func (d *DB) UpdateUserFailedLoginAttempts(userId uint64, failedLoginAttempts in
 	}
 }
 
-func (d *DB) GetPosts(user *models.User) []models.Post {
-	var posts []models.Post
+func (d *DB) GetPosts(user *models.User, page models.Page) ([]models.Post, models.PageInfo) {
 	usersToGetFrom := []string{user.Username}
 	var followings []models.Following
 	result := d.db.Find(&followings, "follower = ?", user.Username)
@@ -159,36 +266,54 @@ func (d *DB) GetPosts(user *models.User) []models.Post {
 		}
 	}
 
-	result = d.db.Order("id desc").Find(&posts, "username in (?)", usersToGetFrom)
-	if result.Error != nil {
-		log.Printf("DB::GetPosts error: %s", result.Error.Error())
+	posts, info, err := paginate(d.db.Model(&models.Post{}).Where("username in (?)", usersToGetFrom), page, postID)
+	if err != nil {
+		log.Printf("DB::GetPosts error: %s", err.Error())
 	}
-	return posts
+	d.loadReplyCounts(posts)
+	d.loadParents(posts)
+	d.loadReactions(posts, user)
+	return groupReplies(posts), info
 }
 
-func (d *DB) GetSingleUsersPosts(user *models.User) []models.Post {
-	var posts []models.Post
-	result := d.db.Order("id desc").Find(&posts, "username = ?", user.Username)
-	if result.Error != nil {
-		log.Printf("DB::GetSingleUsersPosts error: %s", result.Error.Error())
+func (d *DB) GetSingleUsersPosts(user, viewer *models.User, page models.Page) ([]models.Post, models.PageInfo) {
+	posts, info, err := paginate(d.db.Model(&models.Post{}).Where("username = ?", user.Username), page, postID)
+	if err != nil {
+		log.Printf("DB::GetSingleUsersPosts error: %s", err.Error())
 	}
-	return posts
+	d.loadReplyCounts(posts)
+	d.loadParents(posts)
+	d.loadReactions(posts, viewer)
+	return posts, info
 }
 
-func (d *DB) GetAllPosts() []models.Post {
-	var posts []models.Post
-	tx := d.db.Order("id desc").Find(&posts)
-	if tx.Error != nil {
-		log.Printf("DB::GetAllPosts error: %s", tx.Error)
+// GetAllPosts returns everyone's posts, viewer is nil for logged out visitors
+// who don't see the posts of users with private feeds
+func (d *DB) GetAllPosts(viewer *models.User, page models.Page) ([]models.Post, models.PageInfo) {
+	tx := d.db.Model(&models.Post{})
+	if viewer == nil {
+		tx = tx.Where("username NOT IN (?)", d.privateFeedUsers())
+	}
+	posts, info, err := paginate(tx, page, postID)
+	if err != nil {
+		log.Printf("DB::GetAllPosts error: %s", err)
 	}
-	return posts
+	d.loadReplyCounts(posts)
+	d.loadParents(posts)
+	if viewer == nil {
+		d.hidePrivateParents(posts)
+	}
+	d.loadReactions(posts, viewer)
+	return posts, info
 }
 
 func (d *DB) NewPost(p *models.Post) {
 	tx := d.db.Create(p)
 	if tx.Error != nil {
 		log.Printf("DB::NewPost error: %s", tx.Error.Error())
+		return
 	}
+	d.savePostTags(p)
 }
 
 func (d *DB) NewPaste(p *models.Paste) {
@@ -198,76 +323,123 @@ func (d *DB) NewPaste(p *models.Paste) {
 	}
 }
 
-func (d *DB) GetAuthId(un string) (string, bool) {
-	var a models.Auth
-	result := d.db.First(&a, "username = ?", un)
+func (d *DB) IsUserFollowing(userToFollow, currentUser string) bool {
+	if userToFollow == currentUser {
+		return true
+	}
+	var count int64
+	result := d.db.Model(&models.Following{}).Where("username = ? AND follower = ?", userToFollow, currentUser).Count(&count)
 	if result.Error != nil {
-		return "", false
+		log.Printf("DB::IsUserFollowing error: %s", result.Error.Error())
 	}
-	return a.AuthId, true
+	return count == 1
 }
 
-func (d *DB) SetAuthId(un, authId string) {
-	_, ok := d.GetAuthId(un)
-	if !ok {
-		a := &models.Auth{
-			Username: un,
-			AuthId:   authId,
-		}
-		d.db.Create(a)
-	} else {
-		var a models.Auth
-		d.db.First(&a, "username = ?", un)
-		a.AuthId = authId
-		d.db.Save(&a)
+// FollowUser is a no-op when currentUser already follows userToFollow, the
+// unique index on the pair makes that safe without checking first. It returns
+// whether a new follow was created.
+func (d *DB) FollowUser(userToFollow, currentUser string) bool {
+	if userToFollow == currentUser {
+		return false
+	}
+	f := models.Following{
+		Username: userToFollow,
+		Follower: currentUser,
+	}
+	result := d.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&f)
+	if result.Error != nil {
+		log.Printf("DB::FollowUser error: %s", result.Error.Error())
 	}
+	return result.RowsAffected == 1
 }
 
-func (d *DB) DeleteAuthId(un string) {
-	var a models.Auth
-	tx := d.db.Where("username = ?", un).Delete(&a)
-	if tx.Error != nil {
-		log.Printf("DB::DeleteAuthId error: %s", tx.Error.Error())
+// UnfollowUser hard deletes the follow so the pair can be followed again
+func (d *DB) UnfollowUser(userToUnfollow, currentUser string) {
+	result := d.db.Unscoped().Where("username = ? AND follower = ?", userToUnfollow, currentUser).Delete(&models.Following{})
+	if result.Error != nil {
+		log.Printf("DB::UnfollowUser error: %s", result.Error.Error())
 	}
 }
 
-func (d *DB) DeleteAllAuthIds() {
-	d.db.Session(&gorm.Session{AllowGlobalUpdate: true}).Delete(&models.Auth{})
+// GetFollowers returns who follows username, most recent first
+func (d *DB) GetFollowers(username string, page models.Page) ([]models.Following, models.PageInfo) {
+	followers, info, err := paginate(d.db.Model(&models.Following{}).Where("username = ?", username), page, followingID)
+	if err != nil {
+		log.Printf("DB::GetFollowers error: %s", err.Error())
+	}
+	return followers, info
 }
 
-func (d *DB) IsUserFollowing(userToFollow, currentUser string) bool {
-	if userToFollow == currentUser {
-		return true
+// GetFollowing returns who username follows, most recent first
+func (d *DB) GetFollowing(username string, page models.Page) ([]models.Following, models.PageInfo) {
+	following, info, err := paginate(d.db.Model(&models.Following{}).Where("follower = ?", username), page, followingID)
+	if err != nil {
+		log.Printf("DB::GetFollowing error: %s", err.Error())
 	}
-	var f models.Following
-	result := d.db.First(&f, "username = ? AND follower = ?", userToFollow, currentUser)
-	if result.Error != nil {
-		log.Printf("DB::IsUserFollowing error: %s", result.Error.Error())
+	return following, info
+}
+
+func (d *DB) FollowerCount(username string) int64 {
+	var count int64
+	tx := d.db.Model(&models.Following{}).Where("username = ?", username).Count(&count)
+	if tx.Error != nil {
+		log.Printf("DB::FollowerCount error: %s", tx.Error.Error())
 	}
-	return result.RowsAffected == 1
+	return count
 }
 
-func (d *DB) FollowUser(userToFollow, currentUser string) {
-	if d.IsUserFollowing(userToFollow, currentUser) {
-		return
+func (d *DB) FollowingCount(username string) int64 {
+	var count int64
+	tx := d.db.Model(&models.Following{}).Where("follower = ?", username).Count(&count)
+	if tx.Error != nil {
+		log.Printf("DB::FollowingCount error: %s", tx.Error.Error())
 	}
-	f := models.Following{
-		Username: userToFollow,
-		Follower: currentUser,
+	return count
+}
+
+// FollowersAmong returns which of usernames follow username
+func (d *DB) FollowersAmong(username string, usernames []string) map[string]bool {
+	followers := make(map[string]bool)
+	if len(usernames) == 0 {
+		return followers
+	}
+	var names []string
+	tx := d.db.Model(&models.Following{}).Where("username = ? AND follower IN ?", username, usernames).Pluck("follower", &names)
+	if tx.Error != nil {
+		log.Printf("DB::FollowersAmong error: %s", tx.Error.Error())
 	}
-	result := d.db.Create(&f)
-	if result.Error != nil {
-		log.Printf("DB::FollowUser error: %s", result.Error.Error())
+	for _, n := range names {
+		followers[n] = true
+	}
+	return followers
+}
+
+// dedupeFollowings removes duplicate follows left by older versions so the
+// unique index on the pair can be created
+func dedupeFollowings(db *gorm.DB) error {
+	if !db.Migrator().HasTable(&models.Following{}) {
+		return nil
 	}
+	return db.Exec("DELETE FROM followings WHERE id NOT IN (SELECT MIN(id) FROM followings GROUP BY username, follower)").Error
 }
 
-func (d *DB) GetAllPastes(user *models.User) []models.Paste {
-	var pastes []models.Paste
-	tx := d.db.Where("username = ?", user.Username).Order("id desc").Find(&pastes)
+func (d *DB) GetAllPastes(user *models.User, page models.Page) ([]models.Paste, models.PageInfo) {
+	pastes, info, err := paginate(d.db.Model(&models.Paste{}).Where("username = ?", user.Username), page, pasteID)
+	if err != nil {
+		log.Printf("DB::GetAllPastes error: %s", err)
+	}
+	return pastes, info
+}
+
+// GetAnyPaste returns the paste no matter who owns it, only for admins
+func (d *DB) GetAnyPaste(id uint64) (models.Paste, bool) {
+	var paste models.Paste
+	tx := d.db.Where("id = ?", id).First(&paste)
 	if tx.Error != nil {
-		log.Printf("DB::GetAllPastes error: %s", tx.Error)
+		log.Printf("DB::GetAnyPaste error: ID: %d, %s", id, tx.Error.Error())
+		return paste, false
 	}
-	return pastes
+	return paste, true
 }
 
 func (d *DB) GetPaste(user *models.User, id uint64) (models.Paste, bool) {
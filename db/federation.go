@@ -0,0 +1,107 @@
+package db
+
+import (
+	"beeline/activitypub"
+	"beeline/models"
+	"log"
+
+	"gorm.io/gorm/clause"
+)
+
+// UserKeys returns the user's ActivityPub key pair, creating it on first use
+func (d *DB) UserKeys(user *models.User) (privatePEM, publicPEM string, ok bool) {
+	if user.PrivateKeyPEM != "" {
+		return user.PrivateKeyPEM, user.PublicKeyPEM, true
+	}
+	privatePEM, publicPEM, err := activitypub.GenerateKey()
+	if err != nil {
+		log.Printf("DB::UserKeys error: %s", err.Error())
+		return "", "", false
+	}
+	// Only store the new keys if no other request beat us to it
+	tx := d.db.Model(&models.User{}).Where("id = ? AND private_key_pem = ''", user.ID).Updates(map[string]interface{}{
+		"private_key_pem": privatePEM,
+		"public_key_pem":  publicPEM,
+	})
+	if tx.Error != nil {
+		log.Printf("DB::UserKeys error: %s", tx.Error.Error())
+		return "", "", false
+	}
+	if tx.RowsAffected == 0 {
+		stored := d.GetUser(uint64(user.ID))
+		privatePEM, publicPEM = stored.PrivateKeyPEM, stored.PublicKeyPEM
+	}
+	user.PrivateKeyPEM, user.PublicKeyPEM = privatePEM, publicPEM
+	return privatePEM, publicPEM, privatePEM != ""
+}
+
+// SaveRemoteActor inserts or refreshes what we know about a remote actor
+func (d *DB) SaveRemoteActor(ra *models.RemoteActor) bool {
+	tx := d.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "actor_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"handle", "url", "inbox", "shared_inbox", "public_key_id", "public_key_pem", "updated_at"}),
+	}).Create(ra)
+	if tx.Error != nil {
+		log.Printf("DB::SaveRemoteActor error: %s", tx.Error.Error())
+		return false
+	}
+	return true
+}
+
+func (d *DB) GetRemoteActor(actorID string) (*models.RemoteActor, bool) {
+	var ra models.RemoteActor
+	tx := d.db.Where("actor_id = ?", actorID).Limit(1).Find(&ra)
+	if tx.Error != nil {
+		log.Printf("DB::GetRemoteActor error: %s", tx.Error.Error())
+	}
+	return &ra, tx.RowsAffected == 1
+}
+
+func (d *DB) FindRemoteActor(handle string) (*models.RemoteActor, bool) {
+	var ra models.RemoteActor
+	tx := d.db.Where("handle = ?", handle).Limit(1).Find(&ra)
+	if tx.Error != nil {
+		log.Printf("DB::FindRemoteActor error: %s", tx.Error.Error())
+	}
+	return &ra, tx.RowsAffected == 1
+}
+
+// RemoteFollowerInboxes lists the inboxes to deliver username's posts to,
+// each shared inbox only once
+func (d *DB) RemoteFollowerInboxes(username string) []string {
+	var actors []models.RemoteActor
+	tx := d.db.Where("handle IN (?)", d.db.Model(&models.Following{}).Select("follower").Where("username = ?", username)).Find(&actors)
+	if tx.Error != nil {
+		log.Printf("DB::RemoteFollowerInboxes error: %s", tx.Error.Error())
+	}
+	seen := map[string]bool{}
+	inboxes := []string{}
+	for _, a := range actors {
+		inbox := a.DeliveryInbox()
+		if !seen[inbox] {
+			seen[inbox] = true
+			inboxes = append(inboxes, inbox)
+		}
+	}
+	return inboxes
+}
+
+// HasLocalFollowers is true when anyone here follows the remote handle, we
+// only keep posts somebody asked for
+func (d *DB) HasLocalFollowers(handle string) bool {
+	var count int64
+	tx := d.db.Model(&models.Following{}).Where("username = ?", handle).Count(&count)
+	if tx.Error != nil {
+		log.Printf("DB::HasLocalFollowers error: %s", tx.Error.Error())
+	}
+	return count > 0
+}
+
+func (d *DB) FindRemotePost(remoteID string) (models.Post, bool) {
+	var post models.Post
+	tx := d.db.Where("remote_id = ?", remoteID).Limit(1).Find(&post)
+	if tx.Error != nil {
+		log.Printf("DB::FindRemotePost error: %s", tx.Error.Error())
+	}
+	return post, tx.RowsAffected == 1
+}
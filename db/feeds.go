@@ -0,0 +1,89 @@
+package db
+
+import (
+	"beeline/models"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// GetPublicPosts returns the newest local posts of everyone who has not made
+// their feeds private
+func (d *DB) GetPublicPosts() []models.Post {
+	var posts []models.Post
+	tx := d.db.Where("username NOT IN (?) AND remote_id = ''", d.privateFeedUsers()).Order("id desc").Limit(models.PageSize).Find(&posts)
+	if tx.Error != nil {
+		log.Printf("DB::GetPublicPosts error: %s", tx.Error.Error())
+	}
+	return posts
+}
+
+// PostCount is how many posts username has
+func (d *DB) PostCount(username string) int64 {
+	var count int64
+	tx := d.db.Model(&models.Post{}).Where("username = ?", username).Count(&count)
+	if tx.Error != nil {
+		log.Printf("DB::PostCount error: %s", tx.Error.Error())
+	}
+	return count
+}
+
+// LastPostChange is when username last created, edited or deleted a post
+func (d *DB) LastPostChange(username string) time.Time {
+	return d.lastPostChange(d.db.Where("username = ?", username))
+}
+
+// LastPublicPostChange is LastPostChange for everyone in the public feed
+func (d *DB) LastPublicPostChange() time.Time {
+	return d.lastPostChange(d.db.Where("username NOT IN (?) AND remote_id = ''", d.privateFeedUsers()))
+}
+
+func (d *DB) privateFeedUsers() *gorm.DB {
+	return d.db.Model(&models.User{}).Select("username").Where("feeds_private = ?", true)
+}
+
+// privateFeedUsernames returns the set of users with private feeds
+func (d *DB) privateFeedUsernames() (map[string]bool, error) {
+	var private []string
+	if err := d.privateFeedUsers().Find(&private).Error; err != nil {
+		return nil, err
+	}
+	hidden := make(map[string]bool, len(private))
+	for _, un := range private {
+		hidden[un] = true
+	}
+	return hidden, nil
+}
+
+// hidePrivateParents drops the quoted parents written by users with private
+// feeds, for pages logged out visitors can see
+func (d *DB) hidePrivateParents(posts []models.Post) {
+	hidden, err := d.privateFeedUsernames()
+	if err != nil {
+		log.Printf("DB::hidePrivateParents error: %s", err.Error())
+		return
+	}
+	for i := range posts {
+		if posts[i].Parent != nil && hidden[posts[i].Parent.Username] {
+			posts[i].Parent = nil
+		}
+	}
+}
+
+func (d *DB) lastPostChange(tx *gorm.DB) time.Time {
+	var last time.Time
+	var updated, deleted models.Post
+	q := tx.Session(&gorm.Session{}).Unscoped().Model(&models.Post{})
+	if err := q.Order("updated_at desc").Limit(1).Find(&updated).Error; err != nil {
+		log.Printf("DB::lastPostChange error: %s", err.Error())
+	}
+	last = updated.UpdatedAt
+	if err := q.Where("deleted_at IS NOT NULL").Order("deleted_at desc").Limit(1).Find(&deleted).Error; err != nil {
+		log.Printf("DB::lastPostChange error: %s", err.Error())
+	}
+	if deleted.DeletedAt.Valid && deleted.DeletedAt.Time.After(last) {
+		last = deleted.DeletedAt.Time
+	}
+	return last
+}
@@ -0,0 +1,102 @@
+package db
+
+import (
+	"beeline/models"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+func (d *DB) NewInvite(createdBy string, expiresAt time.Time, maxUses int) *models.Invite {
+	i := &models.Invite{
+		Token:     uuid.New().String(),
+		CreatedBy: createdBy,
+		ExpiresAt: expiresAt,
+		MaxUses:   maxUses,
+	}
+	tx := d.db.Create(i)
+	if tx.Error != nil {
+		log.Printf("DB::NewInvite error: %s", tx.Error.Error())
+	}
+	return i
+}
+
+func (d *DB) GetInvite(token string) (*models.Invite, bool) {
+	var i models.Invite
+	tx := d.db.First(&i, "token = ?", token)
+	if tx.Error != nil {
+		return nil, false
+	}
+	return &i, true
+}
+
+// GetInvites returns the invites created by username, or every invite if
+// username is empty
+func (d *DB) GetInvites(username string) []models.Invite {
+	var invites []models.Invite
+	tx := d.db.Order("id desc")
+	if username != "" {
+		tx = tx.Where("created_by = ?", username)
+	}
+	tx = tx.Find(&invites)
+	if tx.Error != nil {
+		log.Printf("DB::GetInvites error: %s", tx.Error.Error())
+	}
+	return invites
+}
+
+func (d *DB) InviteCount(username string) int {
+	var count int64
+	tx := d.db.Model(&models.Invite{}).Where("created_by = ?", username).Count(&count)
+	if tx.Error != nil {
+		log.Printf("DB::InviteCount error: %s", tx.Error.Error())
+	}
+	return int(count)
+}
+
+// GetInvitees returns the usernames that signed up with each invite id
+func (d *DB) GetInvitees(inviteIds []uint) map[uint][]string {
+	invitees := map[uint][]string{}
+	if len(inviteIds) == 0 {
+		return invitees
+	}
+	var users []models.User
+	tx := d.db.Select("username", "invite_id").Where("invite_id in (?)", inviteIds).Order("id").Find(&users)
+	if tx.Error != nil {
+		log.Printf("DB::GetInvitees error: %s", tx.Error.Error())
+	}
+	for _, u := range users {
+		invitees[u.InviteID] = append(invitees[u.InviteID], u.Username)
+	}
+	return invitees
+}
+
+// UseInvite claims one use of the invite, it returns false if the invite is
+// expired, revoked or has no uses left
+func (d *DB) UseInvite(token string) bool {
+	tx := d.db.Model(&models.Invite{}).
+		Where("token = ? AND uses < max_uses AND revoked_at IS NULL AND expires_at > ?", token, time.Now()).
+		Update("uses", gorm.Expr("uses + 1"))
+	if tx.Error != nil {
+		log.Printf("DB::UseInvite error: %s", tx.Error.Error())
+		return false
+	}
+	return tx.RowsAffected == 1
+}
+
+// RevokeInvite revokes an invite created by username, admins pass an empty
+// username to revoke any invite
+func (d *DB) RevokeInvite(username string, id uint64) bool {
+	tx := d.db.Model(&models.Invite{}).Where("id = ? AND revoked_at IS NULL", id)
+	if username != "" {
+		tx = tx.Where("created_by = ?", username)
+	}
+	tx = tx.Update("revoked_at", time.Now())
+	if tx.Error != nil {
+		log.Printf("DB::RevokeInvite error: %s", tx.Error.Error())
+		return false
+	}
+	return tx.RowsAffected == 1
+}
@@ -0,0 +1,102 @@
+package db
+
+import (
+	"beeline/models"
+	"fmt"
+	"log"
+)
+
+func contentModel(contentType string) (interface{}, error) {
+	switch contentType {
+	case models.ContentTypePost:
+		return &models.Post{}, nil
+	case models.ContentTypePaste:
+		return &models.Paste{}, nil
+	case models.ContentTypeChatMessage:
+		return &models.ChatMessage{}, nil
+	}
+	return nil, fmt.Errorf("unknown content type `%s`", contentType)
+}
+
+// ModerateContent applies a moderation action to the content and logs who did it and why
+func (d *DB) ModerateContent(actor, action, contentType string, id uint64, reason string) error {
+	m, err := contentModel(contentType)
+	if err != nil {
+		return err
+	}
+	var owner string
+	tx := d.db.Unscoped().Model(m).Select("username").Where("id = ?", id).Scan(&owner)
+	if tx.Error != nil {
+		log.Printf("DB::ModerateContent error: %s", tx.Error.Error())
+		return fmt.Errorf("could not find %s %d", contentType, id)
+	}
+	if tx.RowsAffected == 0 {
+		return fmt.Errorf("could not find %s %d", contentType, id)
+	}
+	switch action {
+	case models.ModerationDelete:
+		tx = d.db.Where("id = ?", id).Delete(m)
+	case models.ModerationRestore:
+		tx = d.db.Unscoped().Model(m).Where("id = ? AND deleted_at IS NOT NULL", id).Update("deleted_at", nil)
+	case models.ModerationPurge:
+		// Only content already in the trash can be purged
+		tx = d.db.Unscoped().Where("id = ? AND deleted_at IS NOT NULL", id).Delete(m)
+	default:
+		return fmt.Errorf("unknown moderation action `%s`", action)
+	}
+	if tx.Error != nil {
+		log.Printf("DB::ModerateContent error: %s", tx.Error.Error())
+		return fmt.Errorf("could not %s %s %d", action, contentType, id)
+	}
+	if tx.RowsAffected == 0 {
+		return fmt.Errorf("could not %s %s %d", action, contentType, id)
+	}
+	tx = d.db.Create(&models.ModerationLog{
+		Actor:        actor,
+		Action:       action,
+		ContentType:  contentType,
+		ContentID:    uint(id),
+		ContentOwner: owner,
+		Reason:       reason,
+	})
+	if tx.Error != nil {
+		log.Printf("DB::ModerateContent error logging action: %s", tx.Error.Error())
+	}
+	return nil
+}
+
+func (d *DB) GetDeletedPosts() []models.Post {
+	var posts []models.Post
+	tx := d.db.Unscoped().Where("deleted_at IS NOT NULL").Order("deleted_at desc").Find(&posts)
+	if tx.Error != nil {
+		log.Printf("DB::GetDeletedPosts error: %s", tx.Error.Error())
+	}
+	return posts
+}
+
+func (d *DB) GetDeletedPastes() []models.Paste {
+	var pastes []models.Paste
+	tx := d.db.Unscoped().Where("deleted_at IS NOT NULL").Order("deleted_at desc").Find(&pastes)
+	if tx.Error != nil {
+		log.Printf("DB::GetDeletedPastes error: %s", tx.Error.Error())
+	}
+	return pastes
+}
+
+func (d *DB) GetDeletedChatMessages() []models.ChatMessage {
+	var messages []models.ChatMessage
+	tx := d.db.Unscoped().Where("deleted_at IS NOT NULL").Order("deleted_at desc").Find(&messages)
+	if tx.Error != nil {
+		log.Printf("DB::GetDeletedChatMessages error: %s", tx.Error.Error())
+	}
+	return messages
+}
+
+func (d *DB) GetModerationLogs(limit int) []models.ModerationLog {
+	var logs []models.ModerationLog
+	tx := d.db.Order("id desc").Limit(limit).Find(&logs)
+	if tx.Error != nil {
+		log.Printf("DB::GetModerationLogs error: %s", tx.Error.Error())
+	}
+	return logs
+}
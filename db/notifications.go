@@ -0,0 +1,121 @@
+package db
+
+import (
+	"beeline/markup"
+	"beeline/models"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+)
+
+// NotifyPost notifies the author of the post being replied to and everyone
+// mentioned in it. Nobody is notified of their own post or twice for one post.
+func (d *DB) NotifyPost(p *models.Post) []models.Notification {
+	link := fmt.Sprintf("/post/%d", p.ID)
+	notified := map[string]bool{p.Username: true}
+	var ns []models.Notification
+	if p.IsReply() {
+		if parent, ok := d.GetPost(uint64(p.ReplyToID)); ok && !parent.IsRemote() && !notified[parent.Username] {
+			notified[parent.Username] = true
+			ns = append(ns, models.NewNotification(parent.Username, p.Username, models.NotificationReply, link, p.Message))
+		}
+	}
+	for _, username := range markup.Mentions(p.Message) {
+		if notified[username] {
+			continue
+		}
+		notified[username] = true
+		if _, ok := d.FindUser(username); ok {
+			ns = append(ns, models.NewNotification(username, p.Username, models.NotificationMention, link, p.Message))
+		}
+	}
+	return d.createNotifications(ns)
+}
+
+// NotifyChatMessage notifies everyone mentioned in a chat message
+func (d *DB) NotifyChatMessage(cm *models.ChatMessage) []models.Notification {
+	link := "/chat/" + url.PathEscape(cm.Room)
+	var ns []models.Notification
+	for _, username := range markup.Mentions(cm.Message) {
+		if username == cm.Username {
+			continue
+		}
+		if _, ok := d.FindUser(username); ok {
+			ns = append(ns, models.NewNotification(username, cm.Username, models.NotificationMention, link, cm.Message))
+		}
+	}
+	return d.createNotifications(ns)
+}
+
+func (d *DB) NotifyFollow(username, follower string) []models.Notification {
+	return d.createNotifications([]models.Notification{
+		models.NewNotification(username, follower, models.NotificationFollow, "/user/"+url.PathEscape(follower), ""),
+	})
+}
+
+// NotifyWebmention tells the author of a post another site linked to it
+func (d *DB) NotifyWebmention(p *models.Post, w *models.Webmention) []models.Notification {
+	return d.createNotifications([]models.Notification{
+		models.NewNotification(p.Username, w.Host(), models.NotificationWebmention, fmt.Sprintf("/post/%d", p.ID), w.Title),
+	})
+}
+
+func (d *DB) createNotifications(ns []models.Notification) []models.Notification {
+	if len(ns) == 0 {
+		return nil
+	}
+	tx := d.db.Create(&ns)
+	if tx.Error != nil {
+		log.Printf("DB::createNotifications error: %s", tx.Error.Error())
+		return nil
+	}
+	return ns
+}
+
+// GetNotifications returns the user's notifications, newest first
+func (d *DB) GetNotifications(username string, page models.Page) ([]models.Notification, models.PageInfo) {
+	ns, info, err := paginate(d.db.Model(&models.Notification{}).Where("username = ?", username), page, notificationID)
+	if err != nil {
+		log.Printf("DB::GetNotifications error: %s", err.Error())
+	}
+	return ns, info
+}
+
+func (d *DB) UnreadNotificationCount(username string) int64 {
+	var count int64
+	tx := d.db.Model(&models.Notification{}).Where("username = ? AND read_at IS NULL", username).Count(&count)
+	if tx.Error != nil {
+		log.Printf("DB::UnreadNotificationCount error: %s", tx.Error.Error())
+	}
+	return count
+}
+
+// ReadNotification marks the user's notification as read and returns it
+func (d *DB) ReadNotification(username string, id uint64) (models.Notification, bool) {
+	var n models.Notification
+	tx := d.db.Where("id = ? AND username = ?", id, username).Limit(1).Find(&n)
+	if tx.Error != nil {
+		log.Printf("DB::ReadNotification error: %s", tx.Error.Error())
+		return n, false
+	}
+	if tx.RowsAffected == 0 {
+		return n, false
+	}
+	if !n.IsRead() {
+		now := time.Now()
+		n.ReadAt = &now
+		tx = d.db.Model(&n).Update("read_at", now)
+		if tx.Error != nil {
+			log.Printf("DB::ReadNotification error: %s", tx.Error.Error())
+		}
+	}
+	return n, true
+}
+
+func (d *DB) ReadAllNotifications(username string) {
+	tx := d.db.Model(&models.Notification{}).Where("username = ? AND read_at IS NULL", username).Update("read_at", time.Now())
+	if tx.Error != nil {
+		log.Printf("DB::ReadAllNotifications error: %s", tx.Error.Error())
+	}
+}
@@ -0,0 +1,71 @@
+package db
+
+import (
+	"beeline/models"
+
+	"gorm.io/gorm"
+)
+
+// paginate loads one page of tx's rows newest first using the id as the
+// cursor. id returns the id of a row so the surrounding cursors can be found.
+func paginate[T any](tx *gorm.DB, page models.Page, id func(T) uint) ([]T, models.PageInfo, error) {
+	var items []T
+	var info models.PageInfo
+	q := tx.Session(&gorm.Session{})
+	if page.After != 0 {
+		err := q.Where("id > ?", page.After).Order("id asc").Limit(models.PageSize + 1).Find(&items).Error
+		if err != nil {
+			return nil, info, err
+		}
+		if len(items) > models.PageSize {
+			items = items[:models.PageSize]
+			info.Newer = id(items[len(items)-1])
+		}
+		for i, j := 0, len(items)-1; i < j; i, j = i+1, j-1 {
+			items[i], items[j] = items[j], items[i]
+		}
+		if len(items) > 0 && exists(q.Where("id < ?", id(items[len(items)-1]))) {
+			info.Older = id(items[len(items)-1])
+		}
+		return items, info, nil
+	}
+
+	older := q
+	if page.Before != 0 {
+		older = q.Where("id < ?", page.Before)
+	}
+	err := older.Order("id desc").Limit(models.PageSize + 1).Find(&items).Error
+	if err != nil {
+		return nil, info, err
+	}
+	if len(items) > models.PageSize {
+		items = items[:models.PageSize]
+		info.Older = id(items[len(items)-1])
+	}
+	if page.Before != 0 && len(items) > 0 && exists(q.Where("id > ?", id(items[0]))) {
+		info.Newer = id(items[0])
+	}
+	return items, info, nil
+}
+
+func exists(tx *gorm.DB) bool {
+	var count int64
+	tx.Limit(1).Count(&count)
+	return count > 0
+}
+
+func postID(p models.Post) uint {
+	return p.ID
+}
+
+func pasteID(p models.Paste) uint {
+	return p.ID
+}
+
+func followingID(f models.Following) uint {
+	return f.ID
+}
+
+func notificationID(n models.Notification) uint {
+	return n.ID
+}
@@ -0,0 +1,103 @@
+package db
+
+import (
+	"beeline/models"
+	"log"
+
+	"gorm.io/gorm/clause"
+)
+
+// ToggleReaction adds the user's reaction to the post or removes it when they
+// already reacted with that kind
+func (d *DB) ToggleReaction(postID uint, username, kind string) {
+	tx := d.db.Where("post_id = ? AND username = ? AND kind = ?", postID, username, kind).Delete(&models.Reaction{})
+	if tx.Error != nil {
+		log.Printf("DB::ToggleReaction error: %s", tx.Error.Error())
+		return
+	}
+	if tx.RowsAffected != 0 {
+		return
+	}
+	tx = d.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&models.Reaction{
+		PostID:   postID,
+		Username: username,
+		Kind:     kind,
+	})
+	if tx.Error != nil {
+		log.Printf("DB::ToggleReaction error: %s", tx.Error.Error())
+	}
+}
+
+// GetReactions returns who reacted to the post, newest first
+func (d *DB) GetReactions(postID uint) []models.Reaction {
+	var reactions []models.Reaction
+	tx := d.db.Where("post_id = ?", postID).Order("id desc").Find(&reactions)
+	if tx.Error != nil {
+		log.Printf("DB::GetReactions error: %s", tx.Error.Error())
+	}
+	return reactions
+}
+
+// GetRecentReactionsTo returns the latest reactions others left on the
+// user's posts
+func (d *DB) GetRecentReactionsTo(username string, limit int) []models.Reaction {
+	var reactions []models.Reaction
+	tx := d.db.Joins("JOIN posts ON posts.id = reactions.post_id AND posts.deleted_at IS NULL").
+		Where("posts.username = ? AND reactions.username != ?", username, username).
+		Order("reactions.id desc").Limit(limit).Find(&reactions)
+	if tx.Error != nil {
+		log.Printf("DB::GetRecentReactionsTo error: %s", tx.Error.Error())
+	}
+	return reactions
+}
+
+// loadReactions fills in the reaction counts of posts as seen by viewer,
+// viewer is nil for logged out visitors
+func (d *DB) loadReactions(posts []models.Post, viewer *models.User) {
+	if len(posts) == 0 {
+		return
+	}
+	ids := make([]uint, 0, len(posts))
+	for _, p := range posts {
+		ids = append(ids, p.ID)
+	}
+	viewerName := ""
+	if viewer != nil {
+		viewerName = viewer.Username
+	}
+	var counts []struct {
+		PostID uint
+		Kind   string
+		Count  int64
+		Mine   bool
+	}
+	tx := d.db.Model(&models.Reaction{}).
+		Select("post_id, kind, count(*) AS count, max(username = ?) AS mine", viewerName).
+		Where("post_id IN ?", ids).Group("post_id, kind").Scan(&counts)
+	if tx.Error != nil {
+		log.Printf("DB::loadReactions error: %s", tx.Error.Error())
+	}
+	type key struct {
+		postID uint
+		kind   string
+	}
+	byKey := make(map[key]models.ReactionCount)
+	for _, c := range counts {
+		byKey[key{c.PostID, c.Kind}] = models.ReactionCount{Count: c.Count, Mine: c.Mine}
+	}
+	for i := range posts {
+		posts[i].Reactions = make([]models.ReactionCount, 0, len(models.ReactionKinds))
+		for _, rk := range models.ReactionKinds {
+			rc := byKey[key{posts[i].ID, rk.Name}]
+			rc.ReactionKind = rk
+			posts[i].Reactions = append(posts[i].Reactions, rc)
+		}
+	}
+}
+
+// GetPostReactions returns the reaction counts of a single post
+func (d *DB) GetPostReactions(post models.Post, viewer *models.User) models.Post {
+	posts := []models.Post{post}
+	d.loadReactions(posts, viewer)
+	return posts[0]
+}
@@ -0,0 +1,362 @@
+package db
+
+import (
+	"beeline/markup"
+	"beeline/models"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+	"unicode"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// SearchResultLimit caps how many results a search returns
+	SearchResultLimit = 50
+	snippetTokens     = 24
+)
+
+// setupSearch creates the FTS5 indexes over pastes and posts. sqlite must be
+// built with the sqlite_fts5 tag, without it search falls back to LIKE
+// queries without ranking.
+func (d *DB) setupSearch() {
+	d.backfillPostTags()
+	var enabled int64
+	d.db.Raw("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&enabled)
+	if enabled == 0 {
+		log.Printf("DB::setupSearch sqlite built without FTS5, falling back to LIKE search")
+		// Triggers left by an FTS5 build would make every insert fail
+		for _, table := range []string{"pastes", "posts"} {
+			for _, suffix := range []string{"_fts_ai", "_fts_ad", "_fts_au"} {
+				d.db.Exec("DROP TRIGGER IF EXISTS " + table + suffix)
+			}
+		}
+		return
+	}
+	d.hasFTS5 = d.createFTSIndex("pastes", "title", "text") && d.createFTSIndex("posts", "message", "username")
+}
+
+// createFTSIndex creates <table>_fts over columns, kept in sync with triggers
+func (d *DB) createFTSIndex(table string, columns ...string) bool {
+	fts := table + "_fts"
+	cols := strings.Join(columns, ", ")
+	newCols := "new." + strings.Join(columns, ", new.")
+	oldCols := "old." + strings.Join(columns, ", old.")
+	var exists int64
+	d.db.Raw("SELECT count(*) FROM sqlite_master WHERE type = 'trigger' AND name = ?", fts+"_ai").Scan(&exists)
+	stmts := []string{
+		fmt.Sprintf("CREATE VIRTUAL TABLE IF NOT EXISTS %s USING fts5(%s, content='%s', content_rowid='id', tokenize='porter unicode61')", fts, cols, table),
+		fmt.Sprintf(`CREATE TRIGGER IF NOT EXISTS %[1]s_ai AFTER INSERT ON %[2]s BEGIN
+			INSERT INTO %[1]s(rowid, %[3]s) VALUES (new.id, %[4]s);
+		END`, fts, table, cols, newCols),
+		fmt.Sprintf(`CREATE TRIGGER IF NOT EXISTS %[1]s_ad AFTER DELETE ON %[2]s BEGIN
+			INSERT INTO %[1]s(%[1]s, rowid, %[3]s) VALUES ('delete', old.id, %[4]s);
+		END`, fts, table, cols, oldCols),
+		fmt.Sprintf(`CREATE TRIGGER IF NOT EXISTS %[1]s_au AFTER UPDATE OF %[3]s ON %[2]s BEGIN
+			INSERT INTO %[1]s(%[1]s, rowid, %[3]s) VALUES ('delete', old.id, %[4]s);
+			INSERT INTO %[1]s(rowid, %[3]s) VALUES (new.id, %[5]s);
+		END`, fts, table, cols, oldCols, newCols),
+	}
+	for _, stmt := range stmts {
+		if err := d.db.Exec(stmt).Error; err != nil {
+			log.Printf("DB::createFTSIndex %s error: %s", fts, err.Error())
+			return false
+		}
+	}
+	if exists == 0 {
+		// Index rows created before search existed or while it was unavailable
+		if err := d.db.Exec(fmt.Sprintf("INSERT INTO %[1]s(%[1]s) VALUES ('rebuild')", fts)).Error; err != nil {
+			log.Printf("DB::createFTSIndex %s rebuild error: %s", fts, err.Error())
+			return false
+		}
+	}
+	return true
+}
+
+// SearchPastes returns the user's pastes matching query ranked best first.
+// Words match by prefix when they end with *, "quoted words" match as a phrase.
+func (d *DB) SearchPastes(user *models.User, query string) []models.PasteSearchResult {
+	terms := parseSearchQuery(query)
+	if len(terms) == 0 {
+		return nil
+	}
+	var results []models.PasteSearchResult
+	if d.hasFTS5 {
+		tx := d.db.Raw(`SELECT pastes.id AS id,
+				highlight(pastes_fts, 0, ?, ?) AS title,
+				snippet(pastes_fts, 1, ?, ?, '…', ?) AS snippet
+			FROM pastes_fts JOIN pastes ON pastes.id = pastes_fts.rowid
+			WHERE pastes_fts MATCH ? AND pastes.username = ? AND pastes.deleted_at IS NULL
+			ORDER BY rank LIMIT ?`,
+			markup.HighlightStart, markup.HighlightEnd,
+			markup.HighlightStart, markup.HighlightEnd, snippetTokens,
+			ftsMatchExpression(terms), user.Username, SearchResultLimit).Scan(&results)
+		if tx.Error != nil {
+			log.Printf("DB::SearchPastes error: %s", tx.Error.Error())
+		}
+		return results
+	}
+	tx := d.db.Model(&models.Paste{}).Where("username = ?", user.Username)
+	for _, t := range terms {
+		like := "%" + escapeLike(t.text) + "%"
+		tx = tx.Where("(title LIKE ? ESCAPE '\\' OR text LIKE ? ESCAPE '\\')", like, like)
+	}
+	var pastes []models.Paste
+	tx = tx.Order("id desc").Limit(SearchResultLimit).Find(&pastes)
+	if tx.Error != nil {
+		log.Printf("DB::SearchPastes error: %s", tx.Error.Error())
+	}
+	for _, p := range pastes {
+		results = append(results, models.PasteSearchResult{
+			ID:      p.ID,
+			Title:   likeHighlight(p.Title, terms, len(p.Title)),
+			Snippet: likeHighlight(p.Text, terms, snippetTokens*8),
+		})
+	}
+	return results
+}
+
+type searchTerm struct {
+	text   string
+	prefix bool
+	phrase bool
+}
+
+// parseSearchQuery splits a user's query into words and "quoted phrases",
+// anything else that would be FTS5 syntax is treated as plain text
+func parseSearchQuery(query string) []searchTerm {
+	var terms []searchTerm
+	rs := []rune(query)
+	for i := 0; i < len(rs); {
+		switch {
+		case unicode.IsSpace(rs[i]):
+			i++
+		case rs[i] == '"':
+			end := i + 1
+			for end < len(rs) && rs[end] != '"' {
+				end++
+			}
+			if phrase := strings.TrimSpace(string(rs[i+1 : end])); phrase != "" {
+				terms = append(terms, searchTerm{text: phrase, phrase: true})
+			}
+			i = end + 1
+		default:
+			end := i
+			for end < len(rs) && !unicode.IsSpace(rs[end]) && rs[end] != '"' {
+				end++
+			}
+			word := string(rs[i:end])
+			prefix := strings.HasSuffix(word, "*")
+			word = strings.Trim(word, "*")
+			if word != "" {
+				terms = append(terms, searchTerm{text: word, prefix: prefix})
+			}
+			i = end
+		}
+	}
+	return terms
+}
+
+// ftsMatchExpression quotes every term so user input can never be FTS5 syntax
+func ftsMatchExpression(terms []searchTerm) string {
+	parts := make([]string, 0, len(terms))
+	for _, t := range terms {
+		part := `"` + strings.ReplaceAll(t.text, `"`, `""`) + `"`
+		if t.prefix {
+			part += "*"
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, " ")
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// likeHighlight imitates FTS5 snippets for the LIKE fallback, it marks the
+// terms and cuts the text down to around maxLen bytes around the first match
+func likeHighlight(s string, terms []searchTerm, maxLen int) string {
+	start := 0
+	for _, t := range terms {
+		if i := strings.Index(strings.ToLower(s), strings.ToLower(t.text)); i >= 0 {
+			start = i
+			break
+		}
+	}
+	prefix, suffix := "", ""
+	if len(s) > maxLen {
+		start -= maxLen / 4
+		if start < 0 {
+			start = 0
+		}
+		end := start + maxLen
+		if end > len(s) {
+			end = len(s)
+		}
+		for start > 0 && !utf8RuneStart(s[start]) {
+			start--
+		}
+		for end < len(s) && !utf8RuneStart(s[end]) {
+			end++
+		}
+		if start > 0 {
+			prefix = "…"
+		}
+		if end < len(s) {
+			suffix = "…"
+		}
+		s = s[start:end]
+	}
+	var sb strings.Builder
+	for i := 0; i < len(s); {
+		matched := false
+		for _, t := range terms {
+			n := len(t.text)
+			if i+n <= len(s) && strings.EqualFold(s[i:i+n], t.text) {
+				sb.WriteString(markup.HighlightStart + s[i:i+n] + markup.HighlightEnd)
+				i += n
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			sb.WriteByte(s[i])
+			i++
+		}
+	}
+	return prefix + sb.String() + suffix
+}
+
+func utf8RuneStart(b byte) bool {
+	return b&0xC0 != 0x80
+}
+
+// savePostTags stores the hashtags of p so they can be searched exactly
+func (d *DB) savePostTags(p *models.Post) {
+	tx := d.db.Where("post_id = ?", p.ID).Delete(&models.PostTag{})
+	if tx.Error != nil {
+		log.Printf("DB::savePostTags error: %s", tx.Error.Error())
+		return
+	}
+	for _, tag := range markup.Hashtags(p.Message) {
+		tx = d.db.Create(&models.PostTag{PostID: p.ID, Tag: tag})
+		if tx.Error != nil {
+			log.Printf("DB::savePostTags error: %s", tx.Error.Error())
+		}
+	}
+}
+
+// backfillPostTags tags posts written before hashtags were stored
+func (d *DB) backfillPostTags() {
+	var count int64
+	d.db.Model(&models.PostTag{}).Count(&count)
+	if count != 0 {
+		return
+	}
+	var posts []models.Post
+	tx := d.db.Unscoped().Where("message LIKE ?", "%#%").Find(&posts)
+	if tx.Error != nil {
+		log.Printf("DB::backfillPostTags error: %s", tx.Error.Error())
+		return
+	}
+	for i := range posts {
+		d.savePostTags(&posts[i])
+	}
+}
+
+// SearchPosts returns posts matching the search. With search terms they are
+// ranked best first, with only filters they are newest first. Terms starting
+// with # only match posts using that hashtag.
+func (d *DB) SearchPosts(ps models.PostSearch) []models.PostSearchResult {
+	var terms []searchTerm
+	var tags []string
+	for _, t := range parseSearchQuery(ps.Query) {
+		if !t.phrase && strings.HasPrefix(t.text, "#") {
+			if tag := strings.ToLower(strings.TrimLeft(t.text, "#")); tag != "" {
+				tags = append(tags, tag)
+			}
+			continue
+		}
+		terms = append(terms, t)
+	}
+	if len(terms) == 0 && len(tags) == 0 && ps.IsEmpty() {
+		return nil
+	}
+
+	var tx *gorm.DB
+	switch {
+	case len(terms) != 0 && d.hasFTS5:
+		tx = d.db.Table("posts_fts").
+			Select("posts.id, posts.username, posts.message, posts.timestamp, snippet(posts_fts, 0, ?, ?, '…', ?) AS snippet",
+				markup.HighlightStart, markup.HighlightEnd, snippetTokens).
+			Joins("JOIN posts ON posts.id = posts_fts.rowid").
+			Where("posts_fts MATCH ?", ftsMatchExpression(terms)).
+			Order("rank")
+	default:
+		tx = d.db.Table("posts").
+			Select("posts.id, posts.username, posts.message, posts.timestamp, posts.message AS snippet").
+			Order("posts.id desc")
+		for _, t := range terms {
+			like := "%" + escapeLike(t.text) + "%"
+			tx = tx.Where("(posts.message LIKE ? ESCAPE '\\' OR posts.username LIKE ? ESCAPE '\\')", like, like)
+		}
+	}
+	tx = tx.Where("posts.deleted_at IS NULL")
+	for _, tag := range tags {
+		tx = tx.Where("posts.id IN (SELECT post_id FROM post_tags WHERE tag = ?)", tag)
+	}
+	if ps.Author != "" {
+		tx = tx.Where("posts.username = ?", ps.Author)
+	}
+	if !ps.From.IsZero() {
+		tx = tx.Where("julianday(posts.timestamp) >= julianday(?)", sqliteTime(ps.From))
+	}
+	if !ps.To.IsZero() {
+		tx = tx.Where("julianday(posts.timestamp) < julianday(?)", sqliteTime(ps.To))
+	}
+	if ps.Following && ps.Viewer != nil {
+		tx = tx.Where("posts.username IN (SELECT username FROM followings WHERE follower = ? AND deleted_at IS NULL)", ps.Viewer.Username)
+	}
+
+	var results []models.PostSearchResult
+	tx = tx.Limit(SearchResultLimit).Scan(&results)
+	if tx.Error != nil {
+		log.Printf("DB::SearchPosts error: %s", tx.Error.Error())
+	}
+	if len(terms) == 0 || !d.hasFTS5 {
+		for i := range results {
+			results[i].Snippet = likeHighlight(results[i].Message, terms, len(results[i].Message))
+		}
+	}
+	return results
+}
+
+// SearchUsers returns users whose username contains any word of query
+func (d *DB) SearchUsers(query string) []models.User {
+	tx := d.db.Model(&models.User{})
+	matched := false
+	for _, t := range parseSearchQuery(query) {
+		if t.phrase || strings.HasPrefix(t.text, "#") {
+			continue
+		}
+		tx = tx.Or("username LIKE ? ESCAPE '\\'", "%"+escapeLike(t.text)+"%")
+		matched = true
+	}
+	if !matched {
+		return nil
+	}
+	var users []models.User
+	tx = tx.Order("username").Limit(SearchResultLimit).Find(&users)
+	if tx.Error != nil {
+		log.Printf("DB::SearchUsers error: %s", tx.Error.Error())
+	}
+	return users
+}
+
+// sqliteTime formats t the way julianday() expects
+func sqliteTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04:05")
+}
@@ -0,0 +1,107 @@
+package db
+
+import (
+	"beeline/models"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// sessionTouchInterval limits how often LastSeenAt is written for a session
+const sessionTouchInterval = time.Minute
+
+func (d *DB) NewSession(username, userAgent, ip string) *models.Session {
+	d.DeleteExpiredSessions()
+	now := time.Now()
+	s := &models.Session{
+		Username:   username,
+		Token:      uuid.New().String(),
+		UserAgent:  userAgent,
+		IP:         ip,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(models.SessionDuration),
+	}
+	tx := d.db.Create(s)
+	if tx.Error != nil {
+		log.Printf("DB::NewSession error: %s", tx.Error.Error())
+	}
+	return s
+}
+
+// GetSession returns the unexpired session for the username and token and
+// marks it as seen
+func (d *DB) GetSession(username, token string) (*models.Session, bool) {
+	if token == "" {
+		return nil, false
+	}
+	var s models.Session
+	tx := d.db.First(&s, "username = ? AND token = ?", username, token)
+	if tx.Error != nil {
+		return nil, false
+	}
+	if s.IsExpired() {
+		return nil, false
+	}
+	if time.Since(s.LastSeenAt) > sessionTouchInterval {
+		s.LastSeenAt = time.Now()
+		tx = d.db.Model(&s).Update("last_seen_at", s.LastSeenAt)
+		if tx.Error != nil {
+			log.Printf("DB::GetSession error: %s", tx.Error.Error())
+		}
+	}
+	return &s, true
+}
+
+func (d *DB) GetUserSessions(username string) []models.Session {
+	var sessions []models.Session
+	tx := d.db.Where("username = ? AND expires_at > ?", username, time.Now()).Order("last_seen_at desc").Find(&sessions)
+	if tx.Error != nil {
+		log.Printf("DB::GetUserSessions error: %s", tx.Error.Error())
+	}
+	return sessions
+}
+
+// DeleteUserSession revokes a single session, it must belong to username
+func (d *DB) DeleteUserSession(username string, id uint64) bool {
+	tx := d.db.Unscoped().Where("username = ? AND id = ?", username, id).Delete(&models.Session{})
+	if tx.Error != nil {
+		log.Printf("DB::DeleteUserSession error: %s", tx.Error.Error())
+		return false
+	}
+	return tx.RowsAffected == 1
+}
+
+func (d *DB) DeleteSessionByToken(token string) {
+	tx := d.db.Unscoped().Where("token = ?", token).Delete(&models.Session{})
+	if tx.Error != nil {
+		log.Printf("DB::DeleteSessionByToken error: %s", tx.Error.Error())
+	}
+}
+
+func (d *DB) DeleteUserSessions(username string) {
+	tx := d.db.Unscoped().Where("username = ?", username).Delete(&models.Session{})
+	if tx.Error != nil {
+		log.Printf("DB::DeleteUserSessions error: %s", tx.Error.Error())
+	}
+}
+
+// DeleteOtherUserSessions revokes every session of the user except the one with keepToken
+func (d *DB) DeleteOtherUserSessions(username, keepToken string) {
+	tx := d.db.Unscoped().Where("username = ? AND token <> ?", username, keepToken).Delete(&models.Session{})
+	if tx.Error != nil {
+		log.Printf("DB::DeleteOtherUserSessions error: %s", tx.Error.Error())
+	}
+}
+
+func (d *DB) DeleteExpiredSessions() {
+	tx := d.db.Unscoped().Where("expires_at <= ?", time.Now()).Delete(&models.Session{})
+	if tx.Error != nil {
+		log.Printf("DB::DeleteExpiredSessions error: %s", tx.Error.Error())
+	}
+}
+
+func (d *DB) DeleteAllSessions() {
+	d.db.Session(&gorm.Session{AllowGlobalUpdate: true}).Unscoped().Delete(&models.Session{})
+}
@@ -0,0 +1,58 @@
+package db
+
+import (
+	"beeline/models"
+	"log"
+	"strconv"
+
+	"gorm.io/gorm/clause"
+)
+
+const (
+	settingMaxUsers         = "max_users"
+	settingAllowUserInvites = "allow_user_invites"
+	settingInvitesPerUser   = "invites_per_user"
+)
+
+// GetSiteSettings returns the stored site settings, anything that was never
+// set (or is invalid) uses the default
+func (d *DB) GetSiteSettings() models.SiteSettings {
+	ss := models.DefaultSiteSettings()
+	var settings []models.Setting
+	tx := d.db.Find(&settings)
+	if tx.Error != nil {
+		log.Printf("DB::GetSiteSettings error: %s", tx.Error.Error())
+		return ss
+	}
+	for _, s := range settings {
+		var err error
+		switch s.Key {
+		case settingMaxUsers:
+			ss.MaxUsers, err = strconv.Atoi(s.Value)
+		case settingAllowUserInvites:
+			ss.AllowUserInvites, err = strconv.ParseBool(s.Value)
+		case settingInvitesPerUser:
+			ss.InvitesPerUser, err = strconv.Atoi(s.Value)
+		}
+		if err != nil {
+			log.Printf("DB::GetSiteSettings invalid value for %s: %s", s.Key, err.Error())
+			return models.DefaultSiteSettings()
+		}
+	}
+	return ss
+}
+
+func (d *DB) UpdateSiteSettings(ss models.SiteSettings) {
+	settings := []models.Setting{
+		{Key: settingMaxUsers, Value: strconv.Itoa(ss.MaxUsers)},
+		{Key: settingAllowUserInvites, Value: strconv.FormatBool(ss.AllowUserInvites)},
+		{Key: settingInvitesPerUser, Value: strconv.Itoa(ss.InvitesPerUser)},
+	}
+	tx := d.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "key"}},
+		DoUpdates: clause.AssignmentColumns([]string{"value", "updated_at"}),
+	}).Create(&settings)
+	if tx.Error != nil {
+		log.Printf("DB::UpdateSiteSettings error: %s", tx.Error.Error())
+	}
+}
@@ -0,0 +1,227 @@
+package db
+
+import (
+	"beeline/models"
+	"log"
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// GetPost returns a post that hasn't been deleted
+func (d *DB) GetPost(id uint64) (models.Post, bool) {
+	var post models.Post
+	tx := d.db.Where("id = ?", id).Limit(1).Find(&post)
+	if tx.Error != nil {
+		log.Printf("DB::GetPost error: %s", tx.Error.Error())
+	}
+	return post, tx.RowsAffected == 1
+}
+
+// GetThread returns the chain of posts the post answers (oldest first), the
+// post itself and all of the replies below it depth first with their Depth set.
+// viewer is nil for logged out visitors who don't see the posts of users with
+// private feeds, nor the replies below them.
+func (d *DB) GetThread(id uint64, viewer *models.User) ([]models.Post, models.Post, []models.Post, bool) {
+	post, ok := d.GetPost(id)
+	if !ok {
+		return nil, post, nil, false
+	}
+	hidden := map[string]bool{}
+	if viewer == nil {
+		var err error
+		if hidden, err = d.privateFeedUsernames(); err != nil {
+			log.Printf("DB::GetThread error: %s", err.Error())
+			return nil, post, nil, false
+		}
+	}
+
+	var ancestors []models.Post
+	parentID := post.ReplyToID
+	for parentID != 0 && len(ancestors) < 100 {
+		parent, ok := d.GetPost(uint64(parentID))
+		if !ok {
+			break
+		}
+		if !hidden[parent.Username] {
+			ancestors = append([]models.Post{parent}, ancestors...)
+		}
+		parentID = parent.ReplyToID
+	}
+
+	var descendants []models.Post
+	tx := d.db.Raw(`WITH RECURSIVE thread(id) AS (
+			SELECT id FROM posts WHERE reply_to_id = ? AND deleted_at IS NULL
+			UNION SELECT posts.id FROM posts JOIN thread ON posts.reply_to_id = thread.id WHERE posts.deleted_at IS NULL
+		)
+		SELECT * FROM posts WHERE id IN thread ORDER BY id`, post.ID).Scan(&descendants)
+	if tx.Error != nil {
+		log.Printf("DB::GetThread error: %s", tx.Error.Error())
+	}
+	children := make(map[uint][]models.Post)
+	for _, p := range descendants {
+		children[p.ReplyToID] = append(children[p.ReplyToID], p)
+	}
+	var replies []models.Post
+	var walk func(parent uint, depth int)
+	walk = func(parent uint, depth int) {
+		for _, p := range children[parent] {
+			if hidden[p.Username] {
+				continue
+			}
+			p.Depth = depth
+			replies = append(replies, p)
+			walk(p.ID, depth+1)
+		}
+	}
+	walk(post.ID, 1)
+
+	all := append(append(ancestors, post), replies...)
+	d.loadReplyCounts(all)
+	d.loadReactions(all, viewer)
+	return all[:len(ancestors)], all[len(ancestors)], all[len(ancestors)+1:], true
+}
+
+// loadReplyCounts fills in ReplyCount for posts
+func (d *DB) loadReplyCounts(posts []models.Post) {
+	if len(posts) == 0 {
+		return
+	}
+	ids := make([]uint, 0, len(posts))
+	for _, p := range posts {
+		ids = append(ids, p.ID)
+	}
+	var counts []struct {
+		ReplyToID uint
+		Count     int64
+	}
+	tx := d.db.Model(&models.Post{}).Select("reply_to_id, count(*) AS count").
+		Where("reply_to_id IN ?", ids).Group("reply_to_id").Scan(&counts)
+	if tx.Error != nil {
+		log.Printf("DB::loadReplyCounts error: %s", tx.Error.Error())
+		return
+	}
+	byID := make(map[uint]int64)
+	for _, c := range counts {
+		byID[c.ReplyToID] = c.Count
+	}
+	for i := range posts {
+		posts[i].ReplyCount = byID[posts[i].ID]
+	}
+}
+
+// loadParents fills in Parent for the replies in posts
+func (d *DB) loadParents(posts []models.Post) {
+	var ids []uint
+	for _, p := range posts {
+		if p.IsReply() {
+			ids = append(ids, p.ReplyToID)
+		}
+	}
+	if len(ids) == 0 {
+		return
+	}
+	var parents []models.Post
+	tx := d.db.Where("id IN ?", ids).Find(&parents)
+	if tx.Error != nil {
+		log.Printf("DB::loadParents error: %s", tx.Error.Error())
+		return
+	}
+	byID := make(map[uint]*models.Post)
+	for i := range parents {
+		byID[parents[i].ID] = &parents[i]
+	}
+	for i := range posts {
+		if posts[i].IsReply() {
+			posts[i].Parent = byID[posts[i].ReplyToID]
+		}
+	}
+}
+
+// groupReplies moves replies whose parent is also in posts under the post
+// starting their conversation, oldest reply first. A conversation is placed
+// where its newest post was so new replies bring it back up.
+func groupReplies(posts []models.Post) []models.Post {
+	index := make(map[uint]int)
+	for i, p := range posts {
+		index[p.ID] = i
+	}
+	root := func(i int) int {
+		for posts[i].IsReply() {
+			j, ok := index[posts[i].ReplyToID]
+			if !ok {
+				break
+			}
+			i = j
+		}
+		return i
+	}
+
+	var grouped []models.Post
+	groupAt := make(map[int]int)
+	replies := make(map[int][]models.Post)
+	for i := range posts {
+		r := root(i)
+		if _, ok := groupAt[r]; !ok {
+			groupAt[r] = len(grouped)
+			grouped = append(grouped, posts[r])
+		}
+		if r != i {
+			replies[r] = append(replies[r], posts[i])
+		}
+	}
+	for r, rs := range replies {
+		sort.Slice(rs, func(a, b int) bool { return rs[a].ID < rs[b].ID })
+		grouped[groupAt[r]].GroupedReplies = rs
+	}
+	return grouped
+}
+
+// EditPost changes the message of the user's own post, keeping the previous
+// message as a revision
+func (d *DB) EditPost(id uint64, username, message string) bool {
+	var post models.Post
+	err := d.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Where("id = ? AND username = ?", id, username).Limit(1).Find(&post)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		if err := tx.Create(&models.PostRevision{PostID: post.ID, Message: post.Message}).Error; err != nil {
+			return err
+		}
+		now := time.Now()
+		post.Message = message
+		post.EditedAt = &now
+		return tx.Model(&post).Select("message", "edited_at").Updates(&post).Error
+	})
+	if err != nil {
+		log.Printf("DB::EditPost error: %s", err.Error())
+		return false
+	}
+	d.savePostTags(&post)
+	return true
+}
+
+// DeletePost soft deletes the user's own post, admins can still restore it
+// from the trash
+func (d *DB) DeletePost(id uint64, username string) bool {
+	tx := d.db.Where("id = ? AND username = ?", id, username).Delete(&models.Post{})
+	if tx.Error != nil {
+		log.Printf("DB::DeletePost error: %s", tx.Error.Error())
+	}
+	return tx.RowsAffected == 1
+}
+
+// GetPostRevisions returns the earlier versions of a post, newest first
+func (d *DB) GetPostRevisions(postID uint) []models.PostRevision {
+	var revisions []models.PostRevision
+	tx := d.db.Where("post_id = ?", postID).Order("id desc").Find(&revisions)
+	if tx.Error != nil {
+		log.Printf("DB::GetPostRevisions error: %s", tx.Error.Error())
+	}
+	return revisions
+}
@@ -0,0 +1,70 @@
+package db
+
+import (
+	"beeline/models"
+	"reflect"
+	"testing"
+)
+
+func postMessages(posts []models.Post) []string {
+	var messages []string
+	for _, p := range posts {
+		messages = append(messages, p.Message)
+	}
+	return messages
+}
+
+func TestGetThreadHidesPrivateFeeds(t *testing.T) {
+	d := newTestDB(t)
+	d.CreateUser("alice", "password123", false)
+	d.CreateUser("bobby", "password123", false)
+	bobby, _ := d.FindUser("bobby")
+	d.UpdateUserPreferences(uint64(bobby.ID), "", "", true)
+
+	// root (alice) <- private parent (bobby) <- post (alice), with replies
+	// from both below the post and a public reply under bobby's reply
+	post := func(username, message string, replyTo uint) uint {
+		p := models.Post{Username: username, Message: message, ReplyToID: replyTo}
+		d.NewPost(&p)
+		return p.ID
+	}
+	root := post("alice", "root", 0)
+	parent := post("bobby", "private parent", root)
+	id := post("alice", "post", parent)
+	post("alice", "public reply", id)
+	private := post("bobby", "private reply", id)
+	post("alice", "reply to private reply", private)
+
+	tests := []struct {
+		name          string
+		viewer        *models.User
+		wantAncestors []string
+		wantReplies   []string
+	}{
+		{
+			name:          "logged in",
+			viewer:        bobby,
+			wantAncestors: []string{"root", "private parent"},
+			wantReplies:   []string{"public reply", "private reply", "reply to private reply"},
+		},
+		{
+			name:          "logged out",
+			wantAncestors: []string{"root"},
+			wantReplies:   []string{"public reply"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ancestors, got, replies, ok := d.GetThread(uint64(id), tt.viewer)
+			if !ok || got.ID != id {
+				t.Fatalf("GetThread(%d) = %v, %v", id, got, ok)
+			}
+			if msgs := postMessages(ancestors); !reflect.DeepEqual(msgs, tt.wantAncestors) {
+				t.Errorf("ancestors = %q, want %q", msgs, tt.wantAncestors)
+			}
+			if msgs := postMessages(replies); !reflect.DeepEqual(msgs, tt.wantReplies) {
+				t.Errorf("replies = %q, want %q", msgs, tt.wantReplies)
+			}
+		})
+	}
+}
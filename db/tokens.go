@@ -0,0 +1,86 @@
+package db
+
+import (
+	"beeline/models"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"time"
+)
+
+// tokenTouchInterval limits how often LastUsedAt is written for a token
+const tokenTouchInterval = time.Minute
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewAccessToken creates a token for username, the token itself is only
+// returned here and never stored
+func (d *DB) NewAccessToken(t *models.AccessToken) (string, bool) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		log.Printf("DB::NewAccessToken error: %s", err.Error())
+		return "", false
+	}
+	token := hex.EncodeToString(b)
+	t.TokenHash = hashToken(token)
+	tx := d.db.Create(t)
+	if tx.Error != nil {
+		log.Printf("DB::NewAccessToken error: %s", tx.Error.Error())
+		return "", false
+	}
+	return token, true
+}
+
+// GetAccessToken finds the token and marks it as used
+func (d *DB) GetAccessToken(token string) (*models.AccessToken, bool) {
+	if token == "" {
+		return nil, false
+	}
+	var t models.AccessToken
+	tx := d.db.Where("token_hash = ?", hashToken(token)).Limit(1).Find(&t)
+	if tx.Error != nil {
+		log.Printf("DB::GetAccessToken error: %s", tx.Error.Error())
+	}
+	if tx.RowsAffected != 1 {
+		return nil, false
+	}
+	if t.LastUsedAt == nil || time.Since(*t.LastUsedAt) > tokenTouchInterval {
+		now := time.Now()
+		t.LastUsedAt = &now
+		tx = d.db.Model(&t).Update("last_used_at", now)
+		if tx.Error != nil {
+			log.Printf("DB::GetAccessToken error: %s", tx.Error.Error())
+		}
+	}
+	return &t, true
+}
+
+func (d *DB) GetAccessTokens(username string) []models.AccessToken {
+	var tokens []models.AccessToken
+	tx := d.db.Where("username = ?", username).Order("id desc").Find(&tokens)
+	if tx.Error != nil {
+		log.Printf("DB::GetAccessTokens error: %s", tx.Error.Error())
+	}
+	return tokens
+}
+
+// RevokeAccessToken deletes one of username's tokens
+func (d *DB) RevokeAccessToken(username string, id uint64) bool {
+	tx := d.db.Unscoped().Where("username = ? AND id = ?", username, id).Delete(&models.AccessToken{})
+	if tx.Error != nil {
+		log.Printf("DB::RevokeAccessToken error: %s", tx.Error.Error())
+	}
+	return tx.RowsAffected == 1
+}
+
+// RevokeAccessTokens deletes all of username's tokens
+func (d *DB) RevokeAccessTokens(username string) {
+	tx := d.db.Unscoped().Where("username = ?", username).Delete(&models.AccessToken{})
+	if tx.Error != nil {
+		log.Printf("DB::RevokeAccessTokens error: %s", tx.Error.Error())
+	}
+}
@@ -0,0 +1,166 @@
+package db
+
+import (
+	"beeline/models"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	recoveryCodeCount    = 10
+	recoveryCodeAlphabet = "abcdefghjkmnpqrstuvwxyz023456789"
+)
+
+func (d *DB) SetPendingTOTPSecret(username, secret string) {
+	tx := d.db.Model(&models.User{}).Where("username = ?", username).Updates(map[string]interface{}{
+		"totp_secret":    secret,
+		"totp_enabled":   false,
+		"totp_last_step": 0,
+	})
+	if tx.Error != nil {
+		log.Printf("DB::SetPendingTOTPSecret error: %s", tx.Error.Error())
+	}
+}
+
+func (d *DB) EnableTOTP(username string, step int64) {
+	tx := d.db.Model(&models.User{}).Where("username = ?", username).Updates(map[string]interface{}{
+		"totp_enabled":   true,
+		"totp_last_step": step,
+	})
+	if tx.Error != nil {
+		log.Printf("DB::EnableTOTP error: %s", tx.Error.Error())
+	}
+}
+
+// UseTOTPStep records step as used, it returns false if the step (or a later
+// one) was already used so a code can never be accepted twice
+func (d *DB) UseTOTPStep(username string, step int64) bool {
+	tx := d.db.Model(&models.User{}).Where("username = ? AND totp_last_step < ?", username, step).Update("totp_last_step", step)
+	if tx.Error != nil {
+		log.Printf("DB::UseTOTPStep error: %s", tx.Error.Error())
+		return false
+	}
+	return tx.RowsAffected == 1
+}
+
+func (d *DB) DisableTOTP(username string) {
+	tx := d.db.Model(&models.User{}).Where("username = ?", username).Updates(map[string]interface{}{
+		"totp_secret":    "",
+		"totp_enabled":   false,
+		"totp_last_step": 0,
+	})
+	if tx.Error != nil {
+		log.Printf("DB::DisableTOTP error: %s", tx.Error.Error())
+	}
+	tx = d.db.Unscoped().Where("username = ?", username).Delete(&models.RecoveryCode{})
+	if tx.Error != nil {
+		log.Printf("DB::DisableTOTP error: %s", tx.Error.Error())
+	}
+}
+
+// NewRecoveryCodes replaces any existing recovery codes for the user, the
+// plain text codes are only ever returned here
+func (d *DB) NewRecoveryCodes(username string) []string {
+	tx := d.db.Unscoped().Where("username = ?", username).Delete(&models.RecoveryCode{})
+	if tx.Error != nil {
+		log.Printf("DB::NewRecoveryCodes error: %s", tx.Error.Error())
+	}
+	codes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		code := generateRecoveryCode()
+		codes = append(codes, code)
+		tx = d.db.Create(&models.RecoveryCode{
+			Username: username,
+			CodeHash: hashRecoveryCode(code),
+		})
+		if tx.Error != nil {
+			log.Printf("DB::NewRecoveryCodes error: %s", tx.Error.Error())
+		}
+	}
+	return codes
+}
+
+func (d *DB) RemainingRecoveryCodes(username string) int {
+	var count int64
+	tx := d.db.Model(&models.RecoveryCode{}).Where("username = ? AND used_at IS NULL", username).Count(&count)
+	if tx.Error != nil {
+		log.Printf("DB::RemainingRecoveryCodes error: %s", tx.Error.Error())
+	}
+	return int(count)
+}
+
+// UseRecoveryCode marks the code as used, returns false if it does not exist
+// or was already used
+func (d *DB) UseRecoveryCode(username, code string) bool {
+	tx := d.db.Model(&models.RecoveryCode{}).
+		Where("username = ? AND code_hash = ? AND used_at IS NULL", username, hashRecoveryCode(code)).
+		Update("used_at", time.Now())
+	if tx.Error != nil {
+		log.Printf("DB::UseRecoveryCode error: %s", tx.Error.Error())
+		return false
+	}
+	return tx.RowsAffected == 1
+}
+
+func (d *DB) NewLoginChallenge(username string) *models.LoginChallenge {
+	tx := d.db.Unscoped().Where("expires_at <= ?", time.Now()).Delete(&models.LoginChallenge{})
+	if tx.Error != nil {
+		log.Printf("DB::NewLoginChallenge error: %s", tx.Error.Error())
+	}
+	lc := &models.LoginChallenge{
+		Username:  username,
+		Token:     uuid.New().String(),
+		ExpiresAt: time.Now().Add(models.LoginChallengeDuration),
+	}
+	tx = d.db.Create(lc)
+	if tx.Error != nil {
+		log.Printf("DB::NewLoginChallenge error: %s", tx.Error.Error())
+	}
+	return lc
+}
+
+func (d *DB) GetLoginChallenge(token string) (*models.LoginChallenge, bool) {
+	if token == "" {
+		return nil, false
+	}
+	var lc models.LoginChallenge
+	tx := d.db.First(&lc, "token = ? AND expires_at > ?", token, time.Now())
+	if tx.Error != nil {
+		return nil, false
+	}
+	return &lc, true
+}
+
+func (d *DB) DeleteLoginChallenge(token string) {
+	tx := d.db.Unscoped().Where("token = ?", token).Delete(&models.LoginChallenge{})
+	if tx.Error != nil {
+		log.Printf("DB::DeleteLoginChallenge error: %s", tx.Error.Error())
+	}
+}
+
+func generateRecoveryCode() string {
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		// TODO: Properly handle error
+		log.Fatal(err)
+	}
+	var sb strings.Builder
+	for i, v := range b {
+		if i == 5 {
+			sb.WriteByte('-')
+		}
+		sb.WriteByte(recoveryCodeAlphabet[int(v)%len(recoveryCodeAlphabet)])
+	}
+	return sb.String()
+}
+
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(code))))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,29 @@
+package db
+
+import "testing"
+
+func TestUseTOTPStep(t *testing.T) {
+	d := newTestDB(t)
+	d.CreateUser("alice", "password123", false)
+	d.SetPendingTOTPSecret("alice", "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ")
+	d.EnableTOTP("alice", 100)
+
+	if d.UseTOTPStep("alice", 100) {
+		t.Errorf("the step used to enable TOTP was accepted again")
+	}
+	if !d.UseTOTPStep("alice", 101) {
+		t.Fatalf("a new step was rejected")
+	}
+	if d.UseTOTPStep("alice", 101) {
+		t.Errorf("a replayed step was accepted")
+	}
+	if d.UseTOTPStep("alice", 99) {
+		t.Errorf("an earlier step was accepted after a later one")
+	}
+	if !d.UseTOTPStep("alice", 102) {
+		t.Errorf("the next step was rejected")
+	}
+	if d.UseTOTPStep("bob", 200) {
+		t.Errorf("a step was accepted for a user that does not exist")
+	}
+}
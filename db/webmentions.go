@@ -0,0 +1,170 @@
+package db
+
+import (
+	"beeline/models"
+	"log"
+	"time"
+
+	"gorm.io/gorm/clause"
+)
+
+// webmentionBatchSize is how many queued Webmentions are handled at once
+const webmentionBatchSize = 20
+
+// ReceiveWebmention queues a received Webmention to be verified, a repeated
+// one is verified again since the source may have changed
+func (d *DB) ReceiveWebmention(source, target string, postID uint) bool {
+	w := models.Webmention{
+		Source:        source,
+		Target:        target,
+		PostID:        postID,
+		Status:        models.WebmentionPending,
+		NextAttemptAt: time.Now(),
+	}
+	tx := d.db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "source"}, {Name: "target"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"post_id":         postID,
+			"status":          models.WebmentionPending,
+			"attempts":        0,
+			"next_attempt_at": w.NextAttemptAt,
+			"error":           "",
+			"updated_at":      time.Now(),
+		}),
+	}).Create(&w)
+	if tx.Error != nil {
+		log.Printf("DB::ReceiveWebmention error: %s", tx.Error.Error())
+		return false
+	}
+	return true
+}
+
+// DueWebmentions are the received Webmentions waiting to be verified
+func (d *DB) DueWebmentions() []models.Webmention {
+	var ws []models.Webmention
+	tx := d.db.Where("status = ? AND next_attempt_at <= ?", models.WebmentionPending, time.Now()).
+		Order("next_attempt_at asc").Limit(webmentionBatchSize).Find(&ws)
+	if tx.Error != nil {
+		log.Printf("DB::DueWebmentions error: %s", tx.Error.Error())
+	}
+	return ws
+}
+
+func (d *DB) VerifyWebmention(id uint, title string) {
+	tx := d.db.Model(&models.Webmention{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"status": models.WebmentionVerified,
+		"title":  title,
+		"error":  "",
+	})
+	if tx.Error != nil {
+		log.Printf("DB::VerifyWebmention error: %s", tx.Error.Error())
+	}
+}
+
+// RetryWebmention schedules another attempt, after too many it fails for good
+func (d *DB) RetryWebmention(w models.Webmention, reason string) {
+	tx := d.db.Model(&models.Webmention{}).Where("id = ?", w.ID).Updates(retryUpdates(w.Attempts, reason))
+	if tx.Error != nil {
+		log.Printf("DB::RetryWebmention error: %s", tx.Error.Error())
+	}
+}
+
+// RemoveWebmention forgets a mention whose source went away or stopped
+// linking to us
+func (d *DB) RemoveWebmention(id uint) {
+	tx := d.db.Unscoped().Delete(&models.Webmention{}, id)
+	if tx.Error != nil {
+		log.Printf("DB::RemoveWebmention error: %s", tx.Error.Error())
+	}
+}
+
+// GetWebmentions returns the verified Webmentions of a post, oldest first
+func (d *DB) GetWebmentions(postID uint) []models.Webmention {
+	var ws []models.Webmention
+	tx := d.db.Where("post_id = ? AND status = ?", postID, models.WebmentionVerified).Order("id asc").Find(&ws)
+	if tx.Error != nil {
+		log.Printf("DB::GetWebmentions error: %s", tx.Error.Error())
+	}
+	return ws
+}
+
+// QueueWebmentions queues a Webmention from source to each target, targets
+// already sent to are sent again since the post changed
+func (d *DB) QueueWebmentions(postID uint, source string, targets []string) {
+	for _, target := range targets {
+		wd := models.WebmentionDelivery{
+			PostID:        postID,
+			Source:        source,
+			Target:        target,
+			Status:        models.WebmentionPending,
+			NextAttemptAt: time.Now(),
+		}
+		tx := d.db.Clauses(clause.OnConflict{
+			Columns: []clause.Column{{Name: "source"}, {Name: "target"}},
+			DoUpdates: clause.Assignments(map[string]interface{}{
+				"status":          models.WebmentionPending,
+				"attempts":        0,
+				"next_attempt_at": wd.NextAttemptAt,
+				"error":           "",
+				"updated_at":      time.Now(),
+			}),
+		}).Create(&wd)
+		if tx.Error != nil {
+			log.Printf("DB::QueueWebmentions error: %s", tx.Error.Error())
+		}
+	}
+}
+
+// DueWebmentionDeliveries are the Webmentions waiting to be sent
+func (d *DB) DueWebmentionDeliveries() []models.WebmentionDelivery {
+	var wds []models.WebmentionDelivery
+	tx := d.db.Where("status = ? AND next_attempt_at <= ?", models.WebmentionPending, time.Now()).
+		Order("next_attempt_at asc").Limit(webmentionBatchSize).Find(&wds)
+	if tx.Error != nil {
+		log.Printf("DB::DueWebmentionDeliveries error: %s", tx.Error.Error())
+	}
+	return wds
+}
+
+func (d *DB) MarkWebmentionSent(id uint) {
+	tx := d.db.Model(&models.WebmentionDelivery{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"status": models.WebmentionSent,
+		"error":  "",
+	})
+	if tx.Error != nil {
+		log.Printf("DB::MarkWebmentionSent error: %s", tx.Error.Error())
+	}
+}
+
+// FailWebmentionDelivery gives up on a target that takes no Webmentions
+func (d *DB) FailWebmentionDelivery(id uint, reason string) {
+	tx := d.db.Model(&models.WebmentionDelivery{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"status": models.WebmentionFailed,
+		"error":  reason,
+	})
+	if tx.Error != nil {
+		log.Printf("DB::FailWebmentionDelivery error: %s", tx.Error.Error())
+	}
+}
+
+// RetryWebmentionDelivery schedules another attempt, after too many it fails
+// for good
+func (d *DB) RetryWebmentionDelivery(wd models.WebmentionDelivery, reason string) {
+	tx := d.db.Model(&models.WebmentionDelivery{}).Where("id = ?", wd.ID).Updates(retryUpdates(wd.Attempts, reason))
+	if tx.Error != nil {
+		log.Printf("DB::RetryWebmentionDelivery error: %s", tx.Error.Error())
+	}
+}
+
+func retryUpdates(attempts int, reason string) map[string]interface{} {
+	attempts++
+	updates := map[string]interface{}{
+		"attempts":        attempts,
+		"next_attempt_at": time.Now().Add(models.WebmentionRetryDelay(attempts)),
+		"error":           reason,
+	}
+	if attempts >= models.MaxWebmentionAttempts {
+		updates["status"] = models.WebmentionFailed
+	}
+	return updates
+}
@@ -0,0 +1,181 @@
+// Package feed renders Atom and RSS documents for timelines
+package feed
+
+import (
+	"beeline/markup"
+	"encoding/xml"
+	"strings"
+	"time"
+)
+
+// Feed is the format independent description of a feed
+type Feed struct {
+	// ID is a stable identifier such as a tag URI
+	ID    string
+	Title string
+	// Link is the html page the feed belongs to
+	Link string
+	// Self is the url of the feed itself
+	Self    string
+	Updated time.Time
+	Entries []Entry
+}
+
+type Entry struct {
+	ID        string
+	Title     string
+	Link      string
+	Author    string
+	AuthorURI string
+	// Content is html
+	Content   string
+	Published time.Time
+	Updated   time.Time
+}
+
+// TagURI builds an RFC 4151 tag URI, these stay the same even if the site
+// later moves to https or another path
+func TagURI(host string, date time.Time, specific string) string {
+	return "tag:" + host + "," + date.UTC().Format("2006-01-02") + ":" + specific
+}
+
+// Title shortens a plain text message to a one line entry title
+func Title(message string, max int) string {
+	title := strings.Join(strings.Fields(message), " ")
+	runes := []rune(title)
+	if len(runes) <= max {
+		return title
+	}
+	return strings.TrimSpace(string(runes[:max])) + "…"
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Base    string      `xml:"xml:base,attr,omitempty"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomEntry struct {
+	ID        string      `xml:"id"`
+	Title     string      `xml:"title"`
+	Published string      `xml:"published"`
+	Updated   string      `xml:"updated"`
+	Links     []atomLink  `xml:"link"`
+	Author    atomAuthor  `xml:"author"`
+	Content   atomContent `xml:"content"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+	URI  string `xml:"uri,omitempty"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+// Atom renders f as an Atom 1.0 document, base is used to resolve relative
+// links inside the entry content
+func Atom(f Feed, base string) ([]byte, error) {
+	af := atomFeed{
+		Base:    base + "/",
+		ID:      f.ID,
+		Title:   f.Title,
+		Updated: f.Updated.UTC().Format(time.RFC3339),
+		Links: []atomLink{
+			{Rel: "self", Type: "application/atom+xml", Href: f.Self},
+			{Rel: "alternate", Type: "text/html", Href: f.Link},
+		},
+	}
+	for _, e := range f.Entries {
+		af.Entries = append(af.Entries, atomEntry{
+			ID:        e.ID,
+			Title:     e.Title,
+			Published: e.Published.UTC().Format(time.RFC3339),
+			Updated:   e.Updated.UTC().Format(time.RFC3339),
+			Links:     []atomLink{{Rel: "alternate", Type: "text/html", Href: e.Link}},
+			Author:    atomAuthor{Name: e.Author, URI: e.AuthorURI},
+			Content:   atomContent{Type: "html", Body: markup.AbsoluteLinks(e.Content, base)},
+		})
+	}
+	return marshal(af)
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Atom    string     `xml:"xmlns:atom,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate"`
+	Self          rssSelf   `xml:"atom:link"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssSelf struct {
+	Rel  string `xml:"rel,attr"`
+	Type string `xml:"type,attr"`
+	Href string `xml:"href,attr"`
+}
+
+type rssItem struct {
+	Title       string  `xml:"title"`
+	Link        string  `xml:"link"`
+	GUID        rssGUID `xml:"guid"`
+	Description string  `xml:"description"`
+	PubDate     string  `xml:"pubDate"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+// RSS renders f as an RSS 2.0 document
+func RSS(f Feed, base string) ([]byte, error) {
+	rf := rssFeed{
+		Version: "2.0",
+		Atom:    "http://www.w3.org/2005/Atom",
+		Channel: rssChannel{
+			Title:         f.Title,
+			Link:          f.Link,
+			Description:   f.Title,
+			LastBuildDate: f.Updated.UTC().Format(time.RFC1123Z),
+			Self:          rssSelf{Rel: "self", Type: "application/rss+xml", Href: f.Self},
+		},
+	}
+	for _, e := range f.Entries {
+		rf.Channel.Items = append(rf.Channel.Items, rssItem{
+			Title:       e.Title,
+			Link:        e.Link,
+			GUID:        rssGUID{Value: e.ID},
+			Description: markup.AbsoluteLinks(e.Content, base),
+			PubDate:     e.Published.UTC().Format(time.RFC1123Z),
+		})
+	}
+	return marshal(rf)
+}
+
+func marshal(v interface{}) ([]byte, error) {
+	b, err := xml.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), b...), nil
+}
@@ -0,0 +1,559 @@
+package handlers
+
+import (
+	"beeline/activitypub"
+	"beeline/models"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// APIPrefix is where version 1 of the JSON API is mounted
+const APIPrefix = "/api/v1"
+
+// apiRoute is one endpoint of the JSON API, the routes are registered and the
+// OpenAPI document is generated from the same list so they always agree
+type apiRoute struct {
+	Method  string
+	Path    string
+	Summary string
+	// Scope the access token needs, empty for any token
+	Scope     string
+	AdminOnly bool
+	// Body and Response name schemas of the OpenAPI document, List responses
+	// are pages of Response, Unpaged ones always fit on the first page
+	Body     string
+	Response string
+	List     bool
+	Unpaged  bool
+	Status   int
+	Handler  fiber.Handler
+}
+
+var apiRoutes = []apiRoute{
+	{Method: fiber.MethodGet, Path: "/me", Summary: "The user the token belongs to", Response: "Profile", Handler: apiMe},
+	{Method: fiber.MethodGet, Path: "/timeline", Summary: "Posts from you and the people you follow", Scope: models.ScopeRead, Response: "Post", List: true, Handler: apiTimeline},
+	{Method: fiber.MethodGet, Path: "/posts", Summary: "Posts from everyone", Scope: models.ScopeRead, Response: "Post", List: true, Handler: apiAllPosts},
+	{Method: fiber.MethodPost, Path: "/posts", Summary: "Create a post or a reply", Scope: models.ScopeCreate, Body: "NewPost", Response: "Post", Status: fiber.StatusCreated, Handler: apiNewPost},
+	{Method: fiber.MethodGet, Path: "/posts/:id", Summary: "One post", Scope: models.ScopeRead, Response: "Post", Handler: apiPost},
+	{Method: fiber.MethodGet, Path: "/posts/:id/thread", Summary: "A post with the posts it answers and all replies below it", Scope: models.ScopeRead, Response: "Thread", Handler: apiThread},
+	{Method: fiber.MethodPatch, Path: "/posts/:id", Summary: "Edit one of your posts", Scope: models.ScopeUpdate, Body: "EditPost", Response: "Post", Handler: apiEditPost},
+	{Method: fiber.MethodDelete, Path: "/posts/:id", Summary: "Delete one of your posts", Scope: models.ScopeDelete, Status: fiber.StatusNoContent, Handler: apiDeletePost},
+	{Method: fiber.MethodGet, Path: "/users/:username", Summary: "A user's profile", Scope: models.ScopeRead, Response: "Profile", Handler: apiProfile},
+	{Method: fiber.MethodGet, Path: "/users/:username/posts", Summary: "A user's posts", Scope: models.ScopeRead, Response: "Post", List: true, Handler: apiUserPosts},
+	{Method: fiber.MethodGet, Path: "/users/:username/followers", Summary: "Who follows a user", Scope: models.ScopeRead, Response: "Follow", List: true, Handler: apiFollows(true)},
+	{Method: fiber.MethodGet, Path: "/users/:username/following", Summary: "Who a user follows", Scope: models.ScopeRead, Response: "Follow", List: true, Handler: apiFollows(false)},
+	{Method: fiber.MethodPut, Path: "/users/:username/follow", Summary: "Follow a user, user@host handles follow people on other servers", Scope: models.ScopeFollow, Response: "Profile", Handler: apiFollow},
+	{Method: fiber.MethodDelete, Path: "/users/:username/follow", Summary: "Unfollow a user", Scope: models.ScopeFollow, Status: fiber.StatusNoContent, Handler: apiUnfollow},
+	{Method: fiber.MethodGet, Path: "/pastes", Summary: "Your pastes", Scope: models.ScopePastes, Response: "Paste", List: true, Handler: apiPastes},
+	{Method: fiber.MethodPost, Path: "/pastes", Summary: "Create a paste", Scope: models.ScopePastes, Body: "NewPaste", Response: "Paste", Status: fiber.StatusCreated, Handler: apiNewPaste},
+	{Method: fiber.MethodGet, Path: "/pastes/:id", Summary: "One of your pastes, admins can read any with the admin scope", Scope: models.ScopePastes, Response: "Paste", Handler: apiPaste},
+	{Method: fiber.MethodGet, Path: "/chat/rooms", Summary: "Every chat room that has been joined", Scope: models.ScopeChat, Response: "ChatRoom", List: true, Unpaged: true, Handler: apiChatRooms},
+	{Method: fiber.MethodGet, Path: "/chat/rooms/:room/messages", Summary: "The recent messages of a room, oldest first", Scope: models.ScopeChat, Response: "ChatMessage", List: true, Unpaged: true, Handler: apiChatMessages},
+	{Method: fiber.MethodPost, Path: "/chat/rooms/:room/messages", Summary: "Send a message to a room", Scope: models.ScopeChat, Body: "NewChatMessage", Response: "ChatMessage", Status: fiber.StatusCreated, Handler: apiNewChatMessage},
+	{Method: fiber.MethodGet, Path: "/admin/users", Summary: "Every user", Scope: models.ScopeAdmin, AdminOnly: true, Response: "User", List: true, Unpaged: true, Handler: apiUsers},
+	{Method: fiber.MethodGet, Path: "/admin/users/:username", Summary: "One user", Scope: models.ScopeAdmin, AdminOnly: true, Response: "User", Handler: apiUser},
+}
+
+// RegisterAPI adds the API routes to router, each checks the access token
+// itself and the session cookies are never used
+func RegisterAPI(router fiber.Router) {
+	router.Get("/openapi.json", OpenAPI)
+	for _, r := range apiRoutes {
+		router.Add(r.Method, r.Path, requireToken(r.Scope, r.AdminOnly), r.Handler)
+	}
+	router.Use(func(c *fiber.Ctx) error {
+		return jsonError(c, fiber.StatusNotFound, "not_found", "no such endpoint")
+	})
+}
+
+// requireToken replaces the user of the session, if any, with the user of
+// the access token
+func requireToken(scope string, adminOnly bool) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		user, err := authenticateToken(c, scope)
+		if user == nil {
+			return err
+		}
+		if adminOnly && !user.IsAdmin() {
+			return jsonError(c, fiber.StatusForbidden, "forbidden", "only admins can do this")
+		}
+		c.Locals(userLocalsKey, user)
+		return c.Next()
+	}
+}
+
+// apiPage is one page of a list with the urls of the pages around it
+func apiPage[T any](c *fiber.Ctx, items []T, info models.PageInfo) fiber.Map {
+	if items == nil {
+		items = []T{}
+	}
+	m := fiber.Map{"items": items, "older": nil, "newer": nil}
+	if info.Older != 0 {
+		m["older"] = c.Path() + "?before=" + strconv.FormatUint(uint64(info.Older), 10)
+	}
+	if info.Newer != 0 {
+		m["newer"] = c.Path() + "?after=" + strconv.FormatUint(uint64(info.Newer), 10)
+	}
+	return m
+}
+
+func apiNotFound(c *fiber.Ctx, what string) error {
+	return jsonError(c, fiber.StatusNotFound, "not_found", what+" not found")
+}
+
+func apiInvalid(c *fiber.Ctx, description string) error {
+	return jsonError(c, fiber.StatusBadRequest, "invalid_request", description)
+}
+
+func apiPostJSON(c *fiber.Ctx, p models.Post) fiber.Map {
+	reactions := make([]fiber.Map, 0, len(p.Reactions))
+	for _, r := range p.Reactions {
+		reactions = append(reactions, fiber.Map{"name": r.Name, "emoji": r.Emoji, "count": r.Count, "mine": r.Mine})
+	}
+	m := fiber.Map{
+		"id":          p.ID,
+		"username":    p.Username,
+		"message":     p.Message,
+		"html":        string(p.MessageHTML()),
+		"timestamp":   p.Timestamp,
+		"edited_at":   p.EditedAt,
+		"reply_to_id": nil,
+		"reply_count": p.ReplyCount,
+		"reactions":   reactions,
+		"url":         postURL(c, p.ID),
+		"remote_url":  nil,
+	}
+	if p.IsReply() {
+		m["reply_to_id"] = p.ReplyToID
+	}
+	if p.IsRemote() {
+		m["remote_url"] = p.RemoteURL
+	}
+	return m
+}
+
+// apiPostsJSON flattens the replies grouped under their parents back into
+// the list, newest first
+func apiPostsJSON(c *fiber.Ctx, posts []models.Post) []fiber.Map {
+	var flat []models.Post
+	for _, p := range posts {
+		flat = append(flat, p)
+		flat = append(flat, p.GroupedReplies...)
+	}
+	sort.SliceStable(flat, func(i, j int) bool { return flat[i].ID > flat[j].ID })
+	items := make([]fiber.Map, 0, len(flat))
+	for _, p := range flat {
+		items = append(items, apiPostJSON(c, p))
+	}
+	return items
+}
+
+func apiPasteJSON(c *fiber.Ctx, p models.Paste) fiber.Map {
+	return fiber.Map{
+		"id":         p.ID,
+		"username":   p.Username,
+		"title":      p.Title,
+		"text":       p.Text,
+		"created_at": p.CreatedAt,
+		"url":        siteURL(c) + "/paste/" + strconv.FormatUint(uint64(p.ID), 10),
+	}
+}
+
+func apiChatMessageJSON(cm models.ChatMessage) fiber.Map {
+	return fiber.Map{
+		"id":        cm.ID,
+		"room":      cm.Room,
+		"username":  cm.Username,
+		"message":   cm.Message,
+		"timestamp": cm.Timestamp,
+	}
+}
+
+func apiUserJSON(u models.User) fiber.Map {
+	return fiber.Map{
+		"id":                    u.ID,
+		"username":              u.Username,
+		"admin":                 u.IsAdmin(),
+		"created_at":            u.CreatedAt,
+		"failed_login_attempts": u.FailedLoginAttempts,
+		"must_change_password":  u.MustChangePassword,
+		"totp_enabled":          u.TOTPEnabled,
+		"invited_by":            u.InvitedBy,
+		"feeds_private":         u.FeedsPrivate,
+	}
+}
+
+// apiProfileJSON describes username as seen by viewer, remote users have a
+// remote_url
+func apiProfileJSON(c *fiber.Ctx, viewer *models.User, username string) (fiber.Map, bool) {
+	dbc := getDB(c)
+	m := fiber.Map{
+		"username":        username,
+		"url":             siteURL(c) + "/user/" + url.PathEscape(username),
+		"admin":           false,
+		"remote_url":      nil,
+		"follower_count":  dbc.FollowerCount(username),
+		"following_count": dbc.FollowingCount(username),
+		"following":       username != viewer.Username && dbc.IsUserFollowing(username, viewer.Username),
+		"follows_you":     username != viewer.Username && dbc.IsUserFollowing(viewer.Username, username),
+	}
+	if user, ok := dbc.FindUser(username); ok {
+		m["admin"] = user.IsAdmin()
+		return m, true
+	}
+	remote, ok := dbc.FindRemoteActor(username)
+	if !ok {
+		return nil, false
+	}
+	m["remote_url"] = remote.URL
+	return m, true
+}
+
+func apiPostID(c *fiber.Ctx) (uint64, bool) {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+	return id, err == nil
+}
+
+func apiMe(c *fiber.Ctx) error {
+	user := currentUser(c)
+	m, _ := apiProfileJSON(c, user, user.Username)
+	return c.JSON(m)
+}
+
+func apiTimeline(c *fiber.Ctx) error {
+	posts, info := getDB(c).GetPosts(currentUser(c), pageFromQuery(c))
+	return c.JSON(apiPage(c, apiPostsJSON(c, posts), info))
+}
+
+func apiAllPosts(c *fiber.Ctx) error {
+	posts, info := getDB(c).GetAllPosts(currentUser(c), pageFromQuery(c))
+	return c.JSON(apiPage(c, apiPostsJSON(c, posts), info))
+}
+
+func apiPost(c *fiber.Ctx) error {
+	id, ok := apiPostID(c)
+	if !ok {
+		return apiInvalid(c, "post id must be a number")
+	}
+	_, post, _, ok := getDB(c).GetThread(id, currentUser(c))
+	if !ok {
+		return apiNotFound(c, "post")
+	}
+	return c.JSON(apiPostJSON(c, post))
+}
+
+func apiThread(c *fiber.Ctx) error {
+	id, ok := apiPostID(c)
+	if !ok {
+		return apiInvalid(c, "post id must be a number")
+	}
+	ancestors, post, replies, ok := getDB(c).GetThread(id, currentUser(c))
+	if !ok {
+		return apiNotFound(c, "post")
+	}
+	jsonReplies := make([]fiber.Map, 0, len(replies))
+	for _, r := range replies {
+		m := apiPostJSON(c, r)
+		m["depth"] = r.Depth
+		jsonReplies = append(jsonReplies, m)
+	}
+	jsonAncestors := make([]fiber.Map, 0, len(ancestors))
+	for _, a := range ancestors {
+		jsonAncestors = append(jsonAncestors, apiPostJSON(c, a))
+	}
+	return c.JSON(fiber.Map{"ancestors": jsonAncestors, "post": apiPostJSON(c, post), "replies": jsonReplies})
+}
+
+type apiPostBody struct {
+	Message   string `json:"message" form:"message"`
+	ReplyToID uint   `json:"reply_to_id" form:"reply_to_id"`
+}
+
+func apiNewPost(c *fiber.Ctx) error {
+	user := currentUser(c)
+	var body apiPostBody
+	if err := c.BodyParser(&body); err != nil {
+		return apiInvalid(c, "body must be JSON with a message")
+	}
+	post := &models.Post{
+		Message:   body.Message,
+		Timestamp: time.Now(),
+		Username:  user.Username,
+	}
+	dbc := getDB(c)
+	if body.ReplyToID != 0 {
+		parent, ok := dbc.GetPost(uint64(body.ReplyToID))
+		if !ok {
+			return apiNotFound(c, "reply_to_id post")
+		}
+		post.ReplyToID = parent.ID
+	}
+	if err := post.Validate(); err != nil {
+		return apiInvalid(c, err.Error())
+	}
+	publishPost(c, dbc, user, post)
+	c.Location(postURL(c, post.ID))
+	_, created, _, _ := dbc.GetThread(uint64(post.ID), user)
+	return c.Status(fiber.StatusCreated).JSON(apiPostJSON(c, created))
+}
+
+// apiOwnPost finds the post of the request, it must be the user's
+func apiOwnPost(c *fiber.Ctx, user *models.User) (*models.Post, error) {
+	id, ok := apiPostID(c)
+	if !ok {
+		return nil, apiInvalid(c, "post id must be a number")
+	}
+	post, ok := getDB(c).GetPost(id)
+	if !ok {
+		return nil, apiNotFound(c, "post")
+	}
+	if !user.Owns(post.Username) {
+		return nil, jsonError(c, fiber.StatusForbidden, "forbidden", "you can only change your own posts")
+	}
+	return &post, nil
+}
+
+func apiEditPost(c *fiber.Ctx) error {
+	user := currentUser(c)
+	var body apiPostBody
+	if err := c.BodyParser(&body); err != nil {
+		return apiInvalid(c, "body must be JSON with a message")
+	}
+	post, err := apiOwnPost(c, user)
+	if post == nil {
+		return err
+	}
+	oldMessage := post.Message
+	post.Message = body.Message
+	if err := post.Validate(); err != nil {
+		return apiInvalid(c, err.Error())
+	}
+	dbc := getDB(c)
+	if !updatePost(c, dbc, user, *post, oldMessage) {
+		return jsonError(c, fiber.StatusForbidden, "forbidden", "you can only change your own posts")
+	}
+	_, edited, _, _ := dbc.GetThread(uint64(post.ID), user)
+	return c.JSON(apiPostJSON(c, edited))
+}
+
+func apiDeletePost(c *fiber.Ctx) error {
+	user := currentUser(c)
+	post, err := apiOwnPost(c, user)
+	if post == nil {
+		return err
+	}
+	if !removePost(getDB(c), user, *post) {
+		return jsonError(c, fiber.StatusForbidden, "forbidden", "you can only delete your own posts")
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func apiProfile(c *fiber.Ctx) error {
+	m, ok := apiProfileJSON(c, currentUser(c), c.Params("username"))
+	if !ok {
+		return apiNotFound(c, "user")
+	}
+	return c.JSON(m)
+}
+
+func apiUserPosts(c *fiber.Ctx) error {
+	un := c.Params("username")
+	dbc := getDB(c)
+	user, ok := dbc.FindUser(un)
+	if !ok {
+		remote, isRemote := dbc.FindRemoteActor(un)
+		if !isRemote {
+			return apiNotFound(c, "user")
+		}
+		user = &models.User{Username: remote.Handle}
+	}
+	posts, info := dbc.GetSingleUsersPosts(user, currentUser(c), pageFromQuery(c))
+	return c.JSON(apiPage(c, apiPostsJSON(c, posts), info))
+}
+
+func apiFollows(followers bool) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		un := c.Params("username")
+		dbc := getDB(c)
+		if _, ok := dbc.FindUser(un); !ok {
+			return apiNotFound(c, "user")
+		}
+		var follows []models.Following
+		var info models.PageInfo
+		if followers {
+			follows, info = dbc.GetFollowers(un, pageFromQuery(c))
+		} else {
+			follows, info = dbc.GetFollowing(un, pageFromQuery(c))
+		}
+		items := make([]fiber.Map, 0, len(follows))
+		for _, f := range follows {
+			items = append(items, fiber.Map{"username": f.Username, "follower": f.Follower, "since": f.CreatedAt})
+		}
+		return c.JSON(apiPage(c, items, info))
+	}
+}
+
+func apiFollow(c *fiber.Ctx) error {
+	user := currentUser(c)
+	un := c.Params("username")
+	if un == user.Username {
+		return apiInvalid(c, "you cannot follow yourself")
+	}
+	dbc := getDB(c)
+	if _, ok := dbc.FindUser(un); ok {
+		if dbc.FollowUser(un, user.Username) {
+			publishNotifications(dbc.NotifyFollow(un, user.Username))
+		}
+	} else if activitypub.IsHandle(un) {
+		ra, err := followRemoteActor(dbc, user, un)
+		if err == errFederationOff {
+			return jsonError(c, fiber.StatusForbidden, "forbidden", "following people on other servers needs federation and public posts to be turned on")
+		}
+		if err != nil {
+			return apiNotFound(c, "user")
+		}
+		un = ra.Handle
+	} else {
+		return apiNotFound(c, "user")
+	}
+	m, _ := apiProfileJSON(c, user, un)
+	return c.JSON(m)
+}
+
+func apiUnfollow(c *fiber.Ctx) error {
+	user := currentUser(c)
+	un := c.Params("username")
+	dbc := getDB(c)
+	dbc.UnfollowUser(un, user.Username)
+	if activitypub.IsHandle(un) {
+		unfollowRemote(dbc, user, un)
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func apiPastes(c *fiber.Ctx) error {
+	pastes, info := getDB(c).GetAllPastes(currentUser(c), pageFromQuery(c))
+	items := make([]fiber.Map, 0, len(pastes))
+	for _, p := range pastes {
+		items = append(items, apiPasteJSON(c, p))
+	}
+	return c.JSON(apiPage(c, items, info))
+}
+
+type apiPasteBody struct {
+	Title string `json:"title" form:"title"`
+	Text  string `json:"text" form:"text"`
+}
+
+func apiNewPaste(c *fiber.Ctx) error {
+	user := currentUser(c)
+	var body apiPasteBody
+	if err := c.BodyParser(&body); err != nil {
+		return apiInvalid(c, "body must be JSON with a title and text")
+	}
+	p := &models.Paste{Title: body.Title, Text: body.Text, Username: user.Username}
+	if err := p.Validate(); err != nil {
+		return apiInvalid(c, err.Error())
+	}
+	getDB(c).NewPaste(p)
+	c.Location(siteURL(c) + "/paste/" + strconv.FormatUint(uint64(p.ID), 10))
+	return c.Status(fiber.StatusCreated).JSON(apiPasteJSON(c, *p))
+}
+
+func apiPaste(c *fiber.Ctx) error {
+	user := currentUser(c)
+	id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+	if err != nil {
+		return apiInvalid(c, "paste id must be a number")
+	}
+	var paste models.Paste
+	var ok bool
+	// Reading other users' pastes is an admin action, the token needs that scope
+	if user.IsAdmin() && tokenHasScope(c, models.ScopeAdmin) {
+		paste, ok = getDB(c).GetAnyPaste(id)
+	} else {
+		paste, ok = getDB(c).GetPaste(user, id)
+	}
+	if !ok {
+		return apiNotFound(c, "paste")
+	}
+	return c.JSON(apiPasteJSON(c, paste))
+}
+
+func apiChatRooms(c *fiber.Ctx) error {
+	rooms := getDB(c).GetChatRooms()
+	items := make([]fiber.Map, 0, len(rooms))
+	for _, cr := range rooms {
+		items = append(items, fiber.Map{
+			"name":            cr.Name,
+			"max_age_seconds": int64(cr.MaxAge / time.Second),
+			"max_messages":    cr.MaxMessages,
+			"max_bytes":       cr.MaxBytes,
+		})
+	}
+	return c.JSON(apiPage(c, items, models.PageInfo{}))
+}
+
+func apiChatMessages(c *fiber.Ctx) error {
+	room := c.Params("room")
+	dbc := getDB(c)
+	if _, ok := dbc.FindChatRoom(room); !ok {
+		return apiNotFound(c, "chat room")
+	}
+	dbc.PruneChatMessages(room)
+	messages := dbc.GetRecentChatMessages(room, models.ChatHistoryLength)
+	items := make([]fiber.Map, 0, len(messages))
+	for _, cm := range messages {
+		items = append(items, apiChatMessageJSON(cm))
+	}
+	return c.JSON(apiPage(c, items, models.PageInfo{}))
+}
+
+func apiNewChatMessage(c *fiber.Ctx) error {
+	user := currentUser(c)
+	var body struct {
+		Message string `json:"message" form:"message"`
+	}
+	if err := c.BodyParser(&body); err != nil {
+		return apiInvalid(c, "body must be JSON with a message")
+	}
+	dbc := getDB(c)
+	room := c.Params("room")
+	if _, ok := dbc.FindChatRoom(room); !ok {
+		return apiNotFound(c, "chat room")
+	}
+	cm := models.ChatMessage{
+		Room:      room,
+		Username:  user.Username,
+		Message:   body.Message,
+		Timestamp: time.Now(),
+	}
+	if err := cm.Validate(); err != nil {
+		return apiInvalid(c, err.Error())
+	}
+	dbc.NewChatMessage(&cm)
+	broker.Publish(cm.Room, cm)
+	publishNotifications(dbc.NotifyChatMessage(&cm))
+	return c.Status(fiber.StatusCreated).JSON(apiChatMessageJSON(cm))
+}
+
+func apiUsers(c *fiber.Ctx) error {
+	users := getDB(c).GetAllUsers()
+	items := make([]fiber.Map, 0, len(users))
+	for _, u := range users {
+		items = append(items, apiUserJSON(u))
+	}
+	return c.JSON(apiPage(c, items, models.PageInfo{}))
+}
+
+func apiUser(c *fiber.Ctx) error {
+	user, ok := getDB(c).FindUser(c.Params("username"))
+	if !ok {
+		return apiNotFound(c, "user")
+	}
+	return c.JSON(apiUserJSON(*user))
+}
@@ -0,0 +1,608 @@
+package handlers
+
+import (
+	"beeline/activitypub"
+	"beeline/db"
+	"beeline/markup"
+	"beeline/models"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// federationURL is the public base url of this instance, ActivityPub is
+// turned off while it is empty
+var federationURL string
+
+// deliveryRetries are the waits between attempts to deliver an activity
+var deliveryRetries = []time.Duration{10 * time.Second, time.Minute, 10 * time.Minute}
+
+// EnableFederation turns on ActivityPub for the instance reachable at baseURL
+func EnableFederation(baseURL string) {
+	federationURL = strings.TrimSuffix(baseURL, "/")
+}
+
+func federationHost() string {
+	u, err := url.Parse(federationURL)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+func actorID(username string) string {
+	return federationURL + "/user/" + username
+}
+
+func keyID(username string) string {
+	return actorID(username) + "#main-key"
+}
+
+func noteID(id uint) string {
+	return fmt.Sprintf("%s/post/%d", federationURL, id)
+}
+
+// localUsername is the username of a local actor id, our activity ids start
+// with the actor's id so they work too
+func localUsername(id string) (string, bool) {
+	id, _, _ = strings.Cut(id, "#")
+	un := strings.TrimPrefix(id, federationURL+"/user/")
+	if un == id || un == "" || strings.Contains(un, "/") {
+		return "", false
+	}
+	return un, true
+}
+
+// federatedUser finds a local user that takes part in federation, people
+// keeping their posts to logged in members do not
+func federatedUser(dbc *db.DB, username string) (*models.User, bool) {
+	if federationURL == "" {
+		return nil, false
+	}
+	user, ok := dbc.FindUser(username)
+	if !ok || user.FeedsPrivate {
+		return nil, false
+	}
+	return user, true
+}
+
+func wantsActivityJSON(c *fiber.Ctx) bool {
+	accept := c.Get(fiber.HeaderAccept)
+	return strings.Contains(accept, activitypub.ContentType) || strings.Contains(accept, "application/ld+json")
+}
+
+func sendJSON(c *fiber.Ctx, contentType string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	c.Set(fiber.HeaderContentType, contentType+"; charset=utf-8")
+	return c.Send(b)
+}
+
+func sendActivityJSON(c *fiber.Ctx, v interface{}) error {
+	c.Vary(fiber.HeaderAccept)
+	return sendJSON(c, activitypub.ContentType, v)
+}
+
+// WebFinger resolves acct:username@host to the user's actor
+func WebFinger(c *fiber.Ctx) error {
+	resource := strings.TrimPrefix(c.Query("resource"), "acct:")
+	un, host, ok := activitypub.ParseHandle(resource)
+	if !ok || host != federationHost() {
+		return fiber.ErrNotFound
+	}
+	user, ok := federatedUser(getDB(c), un)
+	if !ok {
+		return fiber.ErrNotFound
+	}
+	id := actorID(user.Username)
+	return sendJSON(c, "application/jrd+json", activitypub.WebFinger{
+		Subject: "acct:" + user.Username + "@" + host,
+		Aliases: []string{id},
+		Links: []activitypub.WebFingerLink{
+			{Rel: "self", Type: activitypub.ContentType, Href: id},
+			{Rel: "http://webfinger.net/rel/profile-page", Type: "text/html", Href: id},
+		},
+	})
+}
+
+// Actor serves the user's actor to other servers, browsers get the html
+// profile from the next handler
+func Actor(c *fiber.Ctx) error {
+	if !wantsActivityJSON(c) {
+		return c.Next()
+	}
+	dbc := getDB(c)
+	user, ok := federatedUser(dbc, c.Params("username"))
+	if !ok {
+		return fiber.ErrNotFound
+	}
+	_, publicPEM, ok := dbc.UserKeys(user)
+	if !ok {
+		return fiber.ErrInternalServerError
+	}
+	id := actorID(user.Username)
+	return sendActivityJSON(c, activitypub.Actor{
+		Context:           activitypub.Context,
+		ID:                id,
+		Type:              "Person",
+		PreferredUsername: user.Username,
+		Name:              user.Username,
+		URL:               id,
+		Inbox:             id + "/inbox",
+		Outbox:            id + "/outbox",
+		Followers:         id + "/followers",
+		Endpoints:         &activitypub.Endpoints{SharedInbox: federationURL + "/inbox"},
+		PublicKey: activitypub.PublicKey{
+			ID:           keyID(user.Username),
+			Owner:        id,
+			PublicKeyPem: publicPEM,
+		},
+	})
+}
+
+// Outbox lists the Create activities of the user's newest posts
+func Outbox(c *fiber.Ctx) error {
+	dbc := getDB(c)
+	user, ok := federatedUser(dbc, c.Params("username"))
+	if !ok {
+		return fiber.ErrNotFound
+	}
+	posts, _ := dbc.GetSingleUsersPosts(user, nil, models.Page{})
+	items := make([]interface{}, 0, len(posts))
+	for _, p := range posts {
+		if a := postActivity(dbc, p, "Create"); a != nil {
+			items = append(items, a)
+		}
+	}
+	return sendActivityJSON(c, activitypub.NewOrderedCollection(actorID(user.Username)+"/outbox", dbc.PostCount(user.Username), items))
+}
+
+// FollowersCollection only shares how many followers a user has
+func FollowersCollection(c *fiber.Ctx) error {
+	if !wantsActivityJSON(c) {
+		return c.Next()
+	}
+	dbc := getDB(c)
+	user, ok := federatedUser(dbc, c.Params("username"))
+	if !ok {
+		return fiber.ErrNotFound
+	}
+	return sendActivityJSON(c, activitypub.NewOrderedCollection(actorID(user.Username)+"/followers", dbc.FollowerCount(user.Username), nil))
+}
+
+// NoteObject serves a local post as a Note, browsers get the thread
+func NoteObject(c *fiber.Ctx) error {
+	if !wantsActivityJSON(c) {
+		return c.Next()
+	}
+	id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+	dbc := getDB(c)
+	post, ok := dbc.GetPost(id)
+	if !ok || post.IsRemote() {
+		return fiber.ErrNotFound
+	}
+	if _, ok := federatedUser(dbc, post.Username); !ok {
+		return fiber.ErrNotFound
+	}
+	note := postNote(dbc, post)
+	note.Context = "https://www.w3.org/ns/activitystreams"
+	return sendActivityJSON(c, note)
+}
+
+func postNote(dbc *db.DB, p models.Post) *activitypub.Note {
+	actor := actorID(p.Username)
+	note := &activitypub.Note{
+		ID:           noteID(p.ID),
+		Type:         "Note",
+		AttributedTo: actor,
+		Content:      markup.AbsoluteLinks(string(p.MessageHTML()), federationURL),
+		Published:    p.CreatedAt.UTC().Format(time.RFC3339),
+		URL:          noteID(p.ID),
+		To:           []string{activitypub.PublicCollection},
+		Cc:           []string{actor + "/followers"},
+	}
+	if p.IsEdited() {
+		note.Updated = p.EditedAt.UTC().Format(time.RFC3339)
+	}
+	if p.IsReply() {
+		if parent, ok := dbc.GetPost(uint64(p.ReplyToID)); ok {
+			note.InReplyTo = noteID(parent.ID)
+			if parent.IsRemote() {
+				note.InReplyTo = parent.RemoteID
+			}
+		}
+	}
+	return note
+}
+
+// postActivity wraps the post in a Create or Update, or a Delete of its
+// Tombstone
+func postActivity(dbc *db.DB, p models.Post, typ string) *activitypub.Activity {
+	id := noteID(p.ID)
+	var object interface{}
+	switch typ {
+	case "Create":
+		object = postNote(dbc, p)
+		id += "#create"
+	case "Update":
+		object = postNote(dbc, p)
+		id += fmt.Sprintf("#update-%d", time.Now().Unix())
+	case "Delete":
+		object = fiber.Map{"id": noteID(p.ID), "type": "Tombstone"}
+		id += "#delete"
+	}
+	a, err := activitypub.NewActivity(id, typ, actorID(p.Username), object)
+	if err != nil {
+		log.Printf("postActivity: failed to build %s of post %d, error: %s", typ, p.ID, err.Error())
+		return nil
+	}
+	a.Published = p.CreatedAt.UTC().Format(time.RFC3339)
+	a.To = []string{activitypub.PublicCollection}
+	a.Cc = []string{actorID(p.Username) + "/followers"}
+	return a
+}
+
+// federatePost tells the author's followers on other servers about a post
+func federatePost(dbc *db.DB, user *models.User, p models.Post, typ string) {
+	if federationURL == "" || user.FeedsPrivate || p.IsRemote() {
+		return
+	}
+	inboxes := dbc.RemoteFollowerInboxes(user.Username)
+	// Replies also go to the author of the post they answer
+	if p.IsReply() {
+		if parent, ok := dbc.GetPost(uint64(p.ReplyToID)); ok && parent.IsRemote() {
+			if ra, ok := dbc.FindRemoteActor(parent.Username); ok && !containsString(inboxes, ra.DeliveryInbox()) {
+				inboxes = append(inboxes, ra.DeliveryInbox())
+			}
+		}
+	}
+	if len(inboxes) == 0 {
+		return
+	}
+	if a := postActivity(dbc, p, typ); a != nil {
+		deliver(dbc, user, a, inboxes...)
+	}
+}
+
+// deliver signs activity as user and sends it to each inbox in the
+// background, retrying failed deliveries a few times
+func deliver(dbc *db.DB, user *models.User, activity *activitypub.Activity, inboxes ...string) {
+	privatePEM, _, ok := dbc.UserKeys(user)
+	if !ok {
+		return
+	}
+	key, err := activitypub.ParsePrivateKey(privatePEM)
+	if err != nil {
+		log.Printf("deliver: invalid key for %s, error: %s", user.Username, err.Error())
+		return
+	}
+	kid := keyID(user.Username)
+	for _, inbox := range inboxes {
+		go func(inbox string) {
+			err := activitypub.Deliver(inbox, activity, kid, key)
+			for _, wait := range deliveryRetries {
+				if err == nil {
+					return
+				}
+				log.Printf("deliver: %s of %s to %s failed, retrying in %s, error: %s", activity.Type, activity.ID, inbox, wait, err.Error())
+				time.Sleep(wait)
+				err = activitypub.Deliver(inbox, activity, kid, key)
+			}
+			if err != nil {
+				log.Printf("deliver: giving up on %s of %s to %s, error: %s", activity.Type, activity.ID, inbox, err.Error())
+			}
+		}(inbox)
+	}
+}
+
+// remoteActor returns the stored actor, fetching it when it is unknown or
+// refresh is set, for example after its key stopped verifying
+func remoteActor(dbc *db.DB, id string, refresh bool) (*models.RemoteActor, error) {
+	if ra, ok := dbc.GetRemoteActor(id); ok && !refresh {
+		return ra, nil
+	}
+	a, err := activitypub.FetchActor(id)
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(a.ID)
+	if err != nil {
+		return nil, err
+	}
+	ra := &models.RemoteActor{
+		ActorID:      a.ID,
+		Handle:       a.PreferredUsername + "@" + strings.ToLower(u.Host),
+		URL:          a.URL,
+		Inbox:        a.Inbox,
+		PublicKeyID:  a.PublicKey.ID,
+		PublicKeyPEM: a.PublicKey.PublicKeyPem,
+	}
+	if ra.URL == "" {
+		ra.URL = a.ID
+	}
+	if a.Endpoints != nil {
+		ra.SharedInbox = a.Endpoints.SharedInbox
+	}
+	if !activitypub.IsHandle(ra.Handle) {
+		return nil, fmt.Errorf("actor %s has an invalid username", a.ID)
+	}
+	if !dbc.SaveRemoteActor(ra) {
+		return nil, fmt.Errorf("failed to save actor %s", a.ID)
+	}
+	stored, _ := dbc.GetRemoteActor(a.ID)
+	return stored, nil
+}
+
+// resolveHandle finds the actor of a user@host handle
+func resolveHandle(dbc *db.DB, handle string) (*models.RemoteActor, error) {
+	if ra, ok := dbc.FindRemoteActor(strings.TrimPrefix(handle, "@")); ok {
+		return ra, nil
+	}
+	id, err := activitypub.Lookup(handle)
+	if err != nil {
+		return nil, err
+	}
+	return remoteActor(dbc, id, false)
+}
+
+// verifyInbox checks the HTTP Signature of an inbox request and returns the
+// actor that signed it
+func verifyInbox(c *fiber.Ctx, dbc *db.DB) (*models.RemoteActor, error) {
+	sig, err := activitypub.ParseSignature(c.Get("Signature"))
+	if err != nil {
+		return nil, err
+	}
+	if err := activitypub.CheckDigest(c.Get("Digest"), c.Body()); err != nil {
+		return nil, err
+	}
+	id, _, _ := strings.Cut(sig.KeyID, "#")
+	header := func(name string) string {
+		if name == "host" {
+			return string(c.Request().Host())
+		}
+		return c.Get(name)
+	}
+	verify := func(ra *models.RemoteActor) error {
+		key, err := activitypub.ParsePublicKey(ra.PublicKeyPEM)
+		if err != nil {
+			return err
+		}
+		return sig.Verify(key, c.Method(), c.OriginalURL(), header)
+	}
+	ra, err := remoteActor(dbc, id, false)
+	if err != nil {
+		return nil, err
+	}
+	if err := verify(ra); err != nil {
+		// The actor may have a new key since we stored it
+		if ra, err = remoteActor(dbc, id, true); err != nil {
+			return nil, err
+		}
+		if err := verify(ra); err != nil {
+			return nil, err
+		}
+	}
+	return ra, nil
+}
+
+// Inbox receives activities from other servers for one user or, as the
+// shared inbox, for everyone here
+func Inbox(c *fiber.Ctx) error {
+	if federationURL == "" {
+		return fiber.ErrNotFound
+	}
+	dbc := getDB(c)
+	if un := c.Params("username"); un != "" {
+		if _, ok := federatedUser(dbc, un); !ok {
+			return fiber.ErrNotFound
+		}
+	}
+	var activity activitypub.Activity
+	if err := json.Unmarshal(c.Body(), &activity); err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+	actor, err := verifyInbox(c, dbc)
+	if err != nil {
+		log.Printf("Inbox: rejected %s %s, error: %s", activity.Type, activity.ID, err.Error())
+		return c.SendStatus(fiber.StatusUnauthorized)
+	}
+	if actor.ActorID != activity.Actor {
+		log.Printf("Inbox: %s signed an activity of %s", actor.ActorID, activity.Actor)
+		return c.SendStatus(fiber.StatusForbidden)
+	}
+	handleActivity(dbc, actor, &activity)
+	return c.SendStatus(fiber.StatusAccepted)
+}
+
+func handleActivity(dbc *db.DB, actor *models.RemoteActor, activity *activitypub.Activity) {
+	switch activity.Type {
+	case "Follow":
+		un, ok := localUsername(activity.ObjectID())
+		if !ok {
+			return
+		}
+		user, ok := federatedUser(dbc, un)
+		if !ok {
+			return
+		}
+		if dbc.FollowUser(user.Username, actor.Handle) {
+			publishNotifications(dbc.NotifyFollow(user.Username, actor.Handle))
+		}
+		accept, err := activitypub.NewActivity(fmt.Sprintf("%s#accepts/%d", actorID(user.Username), time.Now().UnixNano()), "Accept", actorID(user.Username), activity)
+		if err != nil {
+			log.Printf("handleActivity: failed to build Accept, error: %s", err.Error())
+			return
+		}
+		deliver(dbc, user, accept, actor.Inbox)
+	case "Undo":
+		if activity.ObjectType() != "Follow" {
+			return
+		}
+		var follow activitypub.Activity
+		if err := activity.DecodeObject(&follow); err != nil {
+			log.Printf("handleActivity: %s", err.Error())
+			return
+		}
+		if un, ok := localUsername(follow.ObjectID()); ok {
+			dbc.UnfollowUser(un, actor.Handle)
+		}
+	case "Reject":
+		// Our Follow ids start with the follower's actor id
+		if un, ok := localUsername(activity.ObjectID()); ok {
+			dbc.UnfollowUser(actor.Handle, un)
+		}
+	case "Create", "Update":
+		if activity.ObjectType() != "Note" {
+			return
+		}
+		var note activitypub.Note
+		if err := activity.DecodeObject(&note); err != nil {
+			log.Printf("handleActivity: %s", err.Error())
+			return
+		}
+		// Timelines here are seen by every member so only public notes are kept
+		if note.AttributedTo != actor.ActorID || !isPublic(&note) {
+			return
+		}
+		if activity.Type == "Create" {
+			saveRemoteNote(dbc, actor, &note)
+		} else if post, ok := dbc.FindRemotePost(note.ID); ok && post.Username == actor.Handle {
+			dbc.EditPost(uint64(post.ID), actor.Handle, activitypub.HTMLToText(note.Content))
+		}
+	case "Delete":
+		if post, ok := dbc.FindRemotePost(activity.ObjectID()); ok && post.Username == actor.Handle {
+			dbc.DeletePost(uint64(post.ID), actor.Handle)
+		}
+	}
+}
+
+func isPublic(note *activitypub.Note) bool {
+	for _, to := range append(note.To, note.Cc...) {
+		if to == activitypub.PublicCollection || to == "as:Public" || to == "Public" {
+			return true
+		}
+	}
+	return false
+}
+
+// saveRemoteNote stores a note from someone followed here, or one replying
+// to a local post
+func saveRemoteNote(dbc *db.DB, actor *models.RemoteActor, note *activitypub.Note) {
+	if _, ok := dbc.FindRemotePost(note.ID); ok {
+		return
+	}
+	post := &models.Post{
+		Username:  actor.Handle,
+		Message:   activitypub.HTMLToText(note.Content),
+		Timestamp: time.Now(),
+		RemoteID:  note.ID,
+		RemoteURL: note.Link(),
+	}
+	if published, err := time.Parse(time.RFC3339, note.Published); err == nil {
+		post.Timestamp = published
+	}
+	if note.InReplyTo != "" {
+		if strings.HasPrefix(note.InReplyTo, federationURL+"/post/") {
+			id, err := strconv.ParseUint(strings.TrimPrefix(note.InReplyTo, federationURL+"/post/"), 10, 64)
+			if parent, ok := dbc.GetPost(id); err == nil && ok {
+				post.ReplyToID = parent.ID
+			}
+		} else if parent, ok := dbc.FindRemotePost(note.InReplyTo); ok {
+			post.ReplyToID = parent.ID
+		}
+	}
+	if post.ReplyToID == 0 && !dbc.HasLocalFollowers(actor.Handle) {
+		return
+	}
+	dbc.NewPost(post)
+	publishNotifications(dbc.NotifyPost(post))
+}
+
+// followRemote follows the user@host handle sent with the follow form
+func followRemote(c *fiber.Ctx, user *models.User, handle string) error {
+	ra, err := followRemoteActor(getDB(c), user, handle)
+	if err == errFederationOff {
+		return c.SendString("Following people on other servers needs federation and public posts to be turned on")
+	}
+	if err != nil {
+		return c.SendString("User '" + handle + "' not found!")
+	}
+	return c.Redirect("/user/" + url.PathEscape(ra.Handle))
+}
+
+var errFederationOff = errors.New("federation is turned off or the user's posts are private")
+
+// followRemoteActor follows a user on another server, the follow is kept
+// right away and undone if their server rejects it
+func followRemoteActor(dbc *db.DB, user *models.User, handle string) (*models.RemoteActor, error) {
+	if federationURL == "" || user.FeedsPrivate {
+		return nil, errFederationOff
+	}
+	ra, err := resolveHandle(dbc, handle)
+	if err != nil {
+		log.Printf("followRemote: failed to find %s, error: %s", handle, err.Error())
+		return nil, err
+	}
+	if dbc.FollowUser(ra.Handle, user.Username) {
+		if follow := followActivity(user, ra); follow != nil {
+			deliver(dbc, user, follow, ra.Inbox)
+		}
+	}
+	return ra, nil
+}
+
+// unfollowRemote sends an Undo of the Follow to the remote user's server
+func unfollowRemote(dbc *db.DB, user *models.User, handle string) {
+	ra, ok := dbc.FindRemoteActor(handle)
+	if federationURL == "" || !ok {
+		return
+	}
+	follow := followActivity(user, ra)
+	if follow == nil {
+		return
+	}
+	undo, err := activitypub.NewActivity(follow.ID+"/undo", "Undo", follow.Actor, follow)
+	if err != nil {
+		log.Printf("unfollowRemote: failed to build Undo, error: %s", err.Error())
+		return
+	}
+	deliver(dbc, user, undo, ra.Inbox)
+}
+
+// followActivity has the same id every time so an Undo refers to it
+func followActivity(user *models.User, ra *models.RemoteActor) *activitypub.Activity {
+	follow, err := activitypub.NewActivity(actorID(user.Username)+"#follows/"+url.PathEscape(ra.Handle), "Follow", actorID(user.Username), ra.ActorID)
+	if err != nil {
+		log.Printf("followActivity: failed to build Follow, error: %s", err.Error())
+		return nil
+	}
+	return follow
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// isInbox is true for deliveries from other servers, which have no CSRF token
+// but are signed instead
+func isInbox(c *fiber.Ctx) bool {
+	p := c.Path()
+	return p == "/inbox" || (strings.HasPrefix(p, "/user/") && strings.HasSuffix(p, "/inbox"))
+}
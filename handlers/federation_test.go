@@ -0,0 +1,160 @@
+package handlers
+
+import (
+	"beeline/activitypub"
+	"beeline/db"
+	"beeline/outbound"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// newInboxApp serves the inboxes of a federating instance at
+// https://beeline.example with a fresh database
+func newInboxApp(t *testing.T) *fiber.App {
+	t.Helper()
+	dbc, err := db.NewAndMigrate(filepath.Join(t.TempDir(), "beeline.db"))
+	if err != nil {
+		t.Fatalf("NewAndMigrate: %v", err)
+	}
+	EnableFederation("https://beeline.example")
+	t.Cleanup(func() { federationURL = "" })
+	app := fiber.New()
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals("db", dbc)
+		return c.Next()
+	})
+	app.Post("/inbox", Inbox)
+	return app
+}
+
+func TestInboxVerifiesSigner(t *testing.T) {
+	outbound.AllowPrivateAddresses(true)
+	t.Cleanup(func() { outbound.AllowPrivateAddresses(false) })
+	privatePEM, publicPEM, err := activitypub.GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey() error: %v", err)
+	}
+	key, err := activitypub.ParsePrivateKey(privatePEM)
+	if err != nil {
+		t.Fatalf("ParsePrivateKey() error: %v", err)
+	}
+	// Every actor on the remote server shares the key, /users/eve claims to
+	// be alice
+	var remote *httptest.Server
+	remote = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/users/")
+		id := remote.URL + r.URL.Path
+		if name == "eve" {
+			id = remote.URL + "/users/alice"
+		}
+		w.Header().Set("Content-Type", activitypub.ContentType)
+		json.NewEncoder(w).Encode(activitypub.Actor{
+			ID:                id,
+			Type:              "Person",
+			PreferredUsername: name,
+			Inbox:             remote.URL + r.URL.Path + "/inbox",
+			PublicKey:         activitypub.PublicKey{ID: id + "#main-key", Owner: id, PublicKeyPem: publicPEM},
+		})
+	}))
+	defer remote.Close()
+	alice, mallory, eve := remote.URL+"/users/alice", remote.URL+"/users/mallory", remote.URL+"/users/eve"
+
+	tests := []struct {
+		name   string
+		signer string
+		actor  string
+		// tamper changes the request or its body after signing
+		tamper func(req *http.Request, body *[]byte)
+		want   int
+	}{
+		{
+			name:   "signed by the actor",
+			signer: alice,
+			actor:  alice,
+			want:   fiber.StatusAccepted,
+		},
+		{
+			name:   "signed by someone else",
+			signer: mallory,
+			actor:  alice,
+			want:   fiber.StatusForbidden,
+		},
+		{
+			name:   "actor document with another id",
+			signer: eve,
+			actor:  alice,
+			want:   fiber.StatusUnauthorized,
+		},
+		{
+			name:   "unsigned",
+			signer: alice,
+			actor:  alice,
+			tamper: func(req *http.Request, _ *[]byte) { req.Header.Del("Signature") },
+			want:   fiber.StatusUnauthorized,
+		},
+		{
+			name:   "tampered body",
+			signer: alice,
+			actor:  alice,
+			tamper: func(_ *http.Request, body *[]byte) {
+				*body = bytes.Replace(*body, []byte("Delete"), []byte("Update"), 1)
+			},
+			want: fiber.StatusUnauthorized,
+		},
+		{
+			name:   "tampered body and digest",
+			signer: alice,
+			actor:  alice,
+			tamper: func(req *http.Request, body *[]byte) {
+				*body = bytes.Replace(*body, []byte("Delete"), []byte("Update"), 1)
+				req.Header.Set("Digest", activitypub.Digest(*body))
+			},
+			want: fiber.StatusUnauthorized,
+		},
+		{
+			name:   "stale date",
+			signer: alice,
+			actor:  alice,
+			tamper: func(req *http.Request, _ *[]byte) {
+				req.Header.Set("Date", "Mon, 01 Jan 2024 00:00:00 GMT")
+			},
+			want: fiber.StatusUnauthorized,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newInboxApp(t)
+			body, _ := json.Marshal(activitypub.Activity{
+				ID:     tt.actor + "#delete",
+				Type:   "Delete",
+				Actor:  tt.actor,
+				Object: json.RawMessage(`"https://beeline.example/post/1"`),
+			})
+			req, _ := http.NewRequest(http.MethodPost, "https://beeline.example/inbox", nil)
+			req.Header.Set("Content-Type", activitypub.ContentType)
+			if err := activitypub.Sign(req, tt.signer+"#main-key", key, body); err != nil {
+				t.Fatalf("Sign() error: %v", err)
+			}
+			if tt.tamper != nil {
+				tt.tamper(req, &body)
+			}
+			req.Body = io.NopCloser(bytes.NewReader(body))
+			req.ContentLength = int64(len(body))
+			resp, err := app.Test(req, -1)
+			if err != nil {
+				t.Fatalf("app.Test() error: %v", err)
+			}
+			if resp.StatusCode != tt.want {
+				t.Errorf("POST /inbox = %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+}
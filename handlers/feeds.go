@@ -0,0 +1,146 @@
+package handlers
+
+import (
+	"beeline/feed"
+	"beeline/models"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	FeedAtom = "atom"
+	FeedRSS  = "rss"
+
+	feedTitleLength = 80
+)
+
+// UserFeed serves the public Atom or RSS feed of a user's posts, users that
+// made their feeds private are not found
+func UserFeed(format string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		un := c.Params("username")
+		dbc := getDB(c)
+		user, ok := dbc.FindUser(un)
+		if !ok || user.FeedsPrivate {
+			return fiber.ErrNotFound
+		}
+		posts, _ := dbc.GetSingleUsersPosts(user, nil, models.Page{})
+		updated := dbc.LastPostChange(un)
+		if updated.IsZero() {
+			updated = user.CreatedAt
+		}
+		base := siteURL(c)
+		f := feed.Feed{
+			ID:      base + "/user/" + un,
+			Title:   un + "'s posts",
+			Link:    base + "/user/" + un,
+			Self:    base + c.Path(),
+			Updated: updated,
+			Entries: feedEntries(c, posts),
+		}
+		return sendFeed(c, format, f)
+	}
+}
+
+// AllFeed serves the public Atom feed of everyone's posts
+func AllFeed(c *fiber.Ctx) error {
+	dbc := getDB(c)
+	base := siteURL(c)
+	f := feed.Feed{
+		ID:      base + "/all",
+		Title:   "All posts",
+		Link:    base + "/all",
+		Self:    base + c.Path(),
+		Updated: dbc.LastPublicPostChange(),
+		Entries: feedEntries(c, dbc.GetPublicPosts()),
+	}
+	return sendFeed(c, FeedAtom, f)
+}
+
+func feedEntries(c *fiber.Ctx, posts []models.Post) []feed.Entry {
+	base := siteURL(c)
+	host := feedHost(c)
+	entries := make([]feed.Entry, 0, len(posts))
+	for _, p := range posts {
+		updated := p.CreatedAt
+		if p.IsEdited() {
+			updated = *p.EditedAt
+		}
+		entries = append(entries, feed.Entry{
+			ID:        feed.TagURI(host, p.CreatedAt, fmt.Sprintf("post/%d", p.ID)),
+			Title:     feed.Title(p.Message, feedTitleLength),
+			Link:      fmt.Sprintf("%s/post/%d", base, p.ID),
+			Author:    p.Username,
+			AuthorURI: base + "/user/" + p.Username,
+			Content:   string(p.MessageHTML()),
+			Published: p.CreatedAt,
+			Updated:   updated,
+		})
+	}
+	return entries
+}
+
+// sendFeed renders f, answering conditional GETs with 304 Not Modified when
+// the reader already has the current version
+func sendFeed(c *fiber.Ctx, format string, f feed.Feed) error {
+	var body []byte
+	var err error
+	contentType := "application/atom+xml; charset=utf-8"
+	if format == FeedRSS {
+		body, err = feed.RSS(f, siteURL(c))
+		contentType = "application/rss+xml; charset=utf-8"
+	} else {
+		body, err = feed.Atom(f, siteURL(c))
+	}
+	if err != nil {
+		log.Printf("sendFeed: failed to render %s feed, error: %s", format, err.Error())
+		return fiber.ErrInternalServerError
+	}
+
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	c.Set(fiber.HeaderETag, etag)
+	c.Set(fiber.HeaderLastModified, f.Updated.UTC().Format(http.TimeFormat))
+	c.Set(fiber.HeaderCacheControl, "public, max-age=300")
+	if notModified(c, etag, f.Updated) {
+		return c.SendStatus(fiber.StatusNotModified)
+	}
+	c.Set(fiber.HeaderContentType, contentType)
+	return c.Send(body)
+}
+
+// notModified checks If-None-Match, falling back to If-Modified-Since only
+// when no ETag was sent as RFC 9110 asks
+func notModified(c *fiber.Ctx, etag string, lastModified time.Time) bool {
+	if inm := c.Get(fiber.HeaderIfNoneMatch); inm != "" {
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == etag || tag == "*" {
+				return true
+			}
+		}
+		return false
+	}
+	ims, err := http.ParseTime(c.Get(fiber.HeaderIfModifiedSince))
+	if err != nil {
+		return false
+	}
+	return !lastModified.Truncate(time.Second).After(ims)
+}
+
+// feedHost is the site's host without a port, for use in tag URIs
+func feedHost(c *fiber.Ctx) string {
+	u, err := url.Parse(siteURL(c))
+	if err != nil {
+		return c.Hostname()
+	}
+	return u.Hostname()
+}
@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"beeline/activitypub"
 	"beeline/models"
 	"beeline/pubsub"
 	"encoding/json"
@@ -8,13 +9,14 @@ import (
 	"log"
 	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gofiber/contrib/websocket"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/monitor"
-	"github.com/google/uuid"
 	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
 )
 
 const MaxFailedLoginAttempts = 3
@@ -22,38 +24,36 @@ const MaxFailedLoginAttempts = 3
 func Monitor() func(*fiber.Ctx) error {
 	return monitor.New(monitor.Config{
 		Next: func(c *fiber.Ctx) bool {
-			user, isValid := checkAndGetCurrentUser(c)
-			return !isValid || !user.IsAdmin()
+			user := currentUser(c)
+			return user == nil || !user.IsAdmin()
 		},
 	})
 }
 
 func Index(c *fiber.Ctx) error {
-	user, isValid := checkAndGetCurrentUser(c)
-	if !isValid {
-		return c.Redirect("/login")
-	}
-	posts := getDB(c).GetPosts(user)
-	return c.Render("views/home", fiber.Map{
-		"Username": user.Username,
-		"Posts":    posts,
-		"IsAdmin":  user.IsAdmin(),
-	})
+	return renderHome(c, currentUser(c), fiber.Map{})
+}
+
+// renderHome renders the timeline, m can carry an Error and the Message of a
+// post that could not be created
+func renderHome(c *fiber.Ctx, user *models.User, m fiber.Map) error {
+	posts, pageInfo := getDB(c).GetPosts(user, pageFromQuery(c))
+	m["Username"] = user.Username
+	m["CurrentUser"] = user
+	m["Posts"] = posts
+	m["Page"] = pageInfo
+	m["IsAdmin"] = user.IsAdmin()
+	if isHTMX(c) {
+		return c.Render("views/posts-page", m)
+	}
+	return c.Render("views/home", m)
 }
 
 func Signup(c *fiber.Ctx) error {
-	user, isValid := checkAndGetCurrentUser(c)
-	if !isValid || !user.IsAdmin() {
-		return c.SendStatus(fiber.StatusForbidden)
-	}
-	return c.Render("views/signup", "")
+	return c.Render("views/signup", fiber.Map{})
 }
 
 func NewUser(c *fiber.Ctx) error {
-	user, isValid := checkAndGetCurrentUser(c)
-	if !isValid || !user.IsAdmin() {
-		return c.SendStatus(fiber.StatusForbidden)
-	}
 	un := c.FormValue("username")
 	if un == "admin" {
 		return c.SendStatus(fiber.StatusBadRequest)
@@ -65,6 +65,9 @@ func NewUser(c *fiber.Ctx) error {
 		})
 	}
 	pw := c.FormValue("password")
+	if pw == "" {
+		pw = generateTempPassword()
+	}
 	err = validatePassword(pw)
 	if err != nil {
 		return c.Render("views/signup", fiber.Map{
@@ -78,23 +81,20 @@ func NewUser(c *fiber.Ctx) error {
 			"Error": errorString,
 		})
 	}
-	if dbc.TotalUserCount() > 100 {
-		return c.SendString("Max users of 100 reached")
+	if maxUsers := dbc.GetSiteSettings().MaxUsers; dbc.TotalUserCount() >= maxUsers {
+		return c.SendString(fmt.Sprintf("Max users of %d reached", maxUsers))
 	}
-	dbc.CreateUser(un, pw, false)
-	if user.IsAdmin() {
-		return c.Redirect("/")
-	}
-	// This path is only really applicable if we allow random signups
-	authId := uuid.New().String()
-	getDB(c).SetAuthId(un, authId)
-	setCookie(c, "username", un)
-	setCookie(c, "authId", authId)
-	return c.Redirect("/")
+	// Admins only ever hand out temporary passwords, the user picks their own on first login
+	dbc.CreateUserWithTempPassword(un, pw)
+	return c.Render("views/signup", fiber.Map{
+		"Success":      fmt.Sprintf("Created user '%s'! Share the temporary password below, it must be changed on first login.", un),
+		"TempUsername": un,
+		"TempPassword": pw,
+	})
 }
 
 func LoginUI(c *fiber.Ctx) error {
-	return c.Render("views/login", "")
+	return c.Render("views/login", fiber.Map{})
 }
 
 func Login(c *fiber.Ctx) error {
@@ -120,60 +120,114 @@ func Login(c *fiber.Ctx) error {
 		return c.Render("views/login", fiber.Map{
 			"Error": "Invalid Credentials!",
 		})
-	} else {
-		dbc.ResetFailedLoginAttempts(un)
 	}
-	authId := uuid.New().String()
-	getDB(c).SetAuthId(un, authId)
-	setCookie(c, "username", un)
-	setCookie(c, "authId", authId)
+	if user.TOTPEnabled {
+		// Failed login attempts are only reset once the second factor is accepted
+		lc := dbc.NewLoginChallenge(un)
+		setCookie(c, "loginChallenge", lc.Token)
+		return c.Redirect("/login/2fa")
+	}
+	dbc.ResetFailedLoginAttempts(un)
+	startSession(c, un)
+	if user.MustChangePassword {
+		return c.Redirect("/change-password")
+	}
 	return c.Redirect("/")
 }
 
 func User(c *fiber.Ctx) error {
 	// username were getting to
 	un := c.Params("username")
-	currentUser, isValid := checkAndGetCurrentUser(c)
-	if !isValid {
-		return c.Redirect("/login")
-	}
+	viewer := currentUser(c)
 	dbc := getDB(c)
 	user, ok := dbc.FindUser(un)
-	if !ok {
+	// People on other servers have a profile of the posts we received from them
+	remote, isRemote := dbc.FindRemoteActor(un)
+	if !ok && !isRemote {
 		return c.SendString("User '" + un + "' not found!")
 	}
-	posts := dbc.GetSingleUsersPosts(user)
-	return c.Render("views/user", fiber.Map{
+	if !ok {
+		user = &models.User{Username: remote.Handle}
+	}
+	posts, pageInfo := dbc.GetSingleUsersPosts(user, viewer, pageFromQuery(c))
+	m := fiber.Map{
 		"Username":           un,
-		"IsUsernameLoggedIn": un == currentUser.Username,
-		"FollowerUsername":   currentUser.Username,
+		"IsUsernameLoggedIn": un == viewer.Username,
+		"CurrentUser":        viewer,
+		"IsAdmin":            viewer.IsAdmin(),
 		"Posts":              posts,
-		"IsNotFollowing":     !dbc.IsUserFollowing(un, currentUser.Username),
-	})
+		"Page":               pageInfo,
+		"IsNotFollowing":     !dbc.IsUserFollowing(un, viewer.Username),
+		"FollowsYou":         un != viewer.Username && dbc.IsUserFollowing(viewer.Username, un),
+		"FollowerCount":      dbc.FollowerCount(un),
+		"FollowingCount":     dbc.FollowingCount(un),
+	}
+	if !ok {
+		m["RemoteURL"] = remote.URL
+	} else if !user.FeedsPrivate {
+		m["AtomFeed"] = "/user/" + un + "/feed.atom"
+		m["RSSFeed"] = "/user/" + un + "/feed.rss"
+	}
+	if un == viewer.Username {
+		m["RecentReactions"] = dbc.GetRecentReactionsTo(un, recentReactionsLength)
+	}
+	if isHTMX(c) {
+		return c.Render("views/posts-page", m)
+	}
+	return c.Render("views/user", m)
 }
 
 func Users(c *fiber.Ctx) error {
-	user, isValid := checkAndGetCurrentUser(c)
-	if !isValid {
-		return c.Redirect("/login")
-	}
-	if !user.IsAdmin() {
-		return c.SendStatus(fiber.StatusForbidden)
-	}
+	user := currentUser(c)
 
 	// Render Users Page where as admin I can reset failed login attempts or update passwords
 	allUsers := getDB(c).GetAllUsers()
 	return c.Render("views/users", fiber.Map{"IsAdmin": user.IsAdmin(), "Username": user.Username, "Users": allUsers})
 }
 
-func EditUser(c *fiber.Ctx) error {
-	user, isValid := checkAndGetCurrentUser(c)
-	if !isValid {
-		return c.Redirect("/login")
+func RevokeUserSessions(c *fiber.Ctx) error {
+	user := currentUser(c)
+	userId := c.Params("id")
+	id, err := strconv.ParseUint(userId, 10, 64)
+	dbc := getDB(c)
+	if err != nil {
+		allUsers := dbc.GetAllUsers()
+		return c.Render("views/users", fiber.Map{"IsAdmin": user.IsAdmin(), "Username": user.Username, "Users": allUsers, "Error": fmt.Sprintf("invalid user id %s", userId)})
 	}
-	if !user.IsAdmin() {
-		return c.SendStatus(fiber.StatusForbidden)
+	userToRevoke := dbc.GetUser(id)
+	dbc.DeleteUserSessions(userToRevoke.Username)
+	allUsers := dbc.GetAllUsers()
+	successStr := fmt.Sprintf("Successfully Revoked All Sessions for User ID %s", userId)
+	return c.Render("views/users", fiber.Map{"IsAdmin": user.IsAdmin(), "Username": user.Username, "Users": allUsers, "Success": successStr})
+}
+
+func Sessions(c *fiber.Ctx) error {
+	user := currentUser(c)
+	return c.Render("views/sessions", fiber.Map{
+		"Username":     user.Username,
+		"IsAdmin":      user.IsAdmin(),
+		"CurrentUser":  user,
+		"Sessions":     getDB(c).GetUserSessions(user.Username),
+		"CurrentToken": c.Cookies("authId"),
+	})
+}
+
+func RevokeSession(c *fiber.Ctx) error {
+	user := currentUser(c)
+	sid := c.Params("id")
+	id, err := strconv.ParseUint(sid, 10, 64)
+	if err != nil {
+		log.Printf("RevokeSession: Params(id) was not uint, error: %s", err.Error())
+		return c.Redirect("/sessions")
+	}
+	if !getDB(c).DeleteUserSession(user.Username, id) {
+		log.Printf("RevokeSession: Session not found")
 	}
+	return c.Redirect("/sessions")
+}
+
+func EditUser(c *fiber.Ctx) error {
+	user := currentUser(c)
 	userId := c.Params("id")
 	err := editUser(c)
 	if err != nil {
@@ -187,56 +241,175 @@ func EditUser(c *fiber.Ctx) error {
 }
 
 func NewPost(c *fiber.Ctx) error {
+	user := currentUser(c)
 	m := c.FormValue("message")
-	un := c.FormValue("username")
-	if !validateUser(c, un) {
-		return c.SendStatus(fiber.StatusBadRequest)
-	}
 	post := &models.Post{
 		Message:   m,
 		Timestamp: time.Now(),
-		Username:  un,
+		Username:  user.Username,
+	}
+	dbc := getDB(c)
+	if replyTo := c.FormValue("reply_to"); replyTo != "" {
+		id, err := strconv.ParseUint(replyTo, 10, 64)
+		if err != nil {
+			return c.SendStatus(fiber.StatusBadRequest)
+		}
+		parent, ok := dbc.GetPost(id)
+		if !ok {
+			return c.SendStatus(fiber.StatusNotFound)
+		}
+		post.ReplyToID = parent.ID
+	}
+	if err := post.Validate(); err != nil {
+		m := fiber.Map{"Error": err.Error(), "Message": post.Message}
+		if post.IsReply() {
+			return renderThread(c, uint64(post.ReplyToID), m)
+		}
+		return renderHome(c, user, m)
+	}
+	publishPost(c, dbc, user, post)
+	if post.IsReply() {
+		return c.Redirect(fmt.Sprintf("/post/%d", post.ReplyToID))
+	}
+	return c.Redirect("/")
+}
+
+// Thread can be viewed logged out, like All, unless the author keeps their
+// posts to members
+func Thread(c *fiber.Ctx) error {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+	return renderThread(c, id, fiber.Map{})
+}
+
+// renderThread renders the thread around post id, m can carry an Error and
+// the Message of a reply that could not be created
+func renderThread(c *fiber.Ctx, id uint64, m fiber.Map) error {
+	user := currentUser(c)
+	dbc := getDB(c)
+	ancestors, post, replies, ok := dbc.GetThread(id, user)
+	if !ok {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+	if user == nil {
+		if author, ok := dbc.FindUser(post.Username); ok && author.FeedsPrivate {
+			return c.Redirect("/login")
+		}
+	}
+	c.Set(fiber.HeaderLink, `</webmention>; rel="webmention"`)
+	m["CurrentUser"] = user
+	m["IsAdmin"] = user != nil && user.IsAdmin()
+	m["Ancestors"] = ancestors
+	m["Post"] = post
+	m["Replies"] = replies
+	m["Webmentions"] = dbc.GetWebmentions(post.ID)
+	if user != nil {
+		m["Username"] = user.Username
+	}
+	return c.Render("views/thread", m)
+}
+
+// ChangePasswordUI and ChangePassword are only for users that must replace a
+// temporary password, everyone else changes theirs on the settings page where
+// the current password is checked
+func ChangePasswordUI(c *fiber.Ctx) error {
+	user := currentUser(c)
+	if !user.MustChangePassword {
+		return c.Redirect("/settings")
+	}
+	return c.Render("views/change-password", fiber.Map{
+		"Username":           user.Username,
+		"MustChangePassword": user.MustChangePassword,
+	})
+}
+
+func ChangePassword(c *fiber.Ctx) error {
+	user := currentUser(c)
+	if !user.MustChangePassword {
+		return c.Redirect("/settings")
+	}
+	err := changePassword(c, user)
+	if err != nil {
+		return c.Render("views/change-password", fiber.Map{
+			"Username":           user.Username,
+			"MustChangePassword": user.MustChangePassword,
+			"Error":              err.Error(),
+		})
 	}
-	getDB(c).NewPost(post)
 	return c.Redirect("/")
 }
 
 func Logout(c *fiber.Ctx) error {
-	un := c.FormValue("username")
+	// Only the session used for this request is ended, other devices stay logged in
+	getDB(c).DeleteSessionByToken(c.Cookies("authId"))
 	c.ClearCookie("username", "authId")
-	getDB(c).DeleteAuthId(un)
 	return c.Redirect("/")
 }
 
-func GetLogout(c *fiber.Ctx) error {
-	return Logout(c)
+// LogoutUI asks for confirmation since GET requests must not change state
+func LogoutUI(c *fiber.Ctx) error {
+	return c.Render("views/logout", fiber.Map{})
 }
 
 func Follow(c *fiber.Ctx) error {
+	user := currentUser(c)
+	un := c.FormValue("username")
+	dbc := getDB(c)
+	if _, ok := dbc.FindUser(un); !ok {
+		if activitypub.IsHandle(un) {
+			return followRemote(c, user, un)
+		}
+		return c.SendString("User '" + un + "' not found!")
+	}
+	if dbc.FollowUser(un, user.Username) {
+		publishNotifications(dbc.NotifyFollow(un, user.Username))
+	}
+	return c.Redirect("/user/" + url.PathEscape(un))
+}
+
+func Unfollow(c *fiber.Ctx) error {
+	user := currentUser(c)
 	un := c.FormValue("username")
-	f := c.FormValue("follower")
-	getDB(c).FollowUser(un, f)
-	return c.Redirect("/user/" + un)
+	dbc := getDB(c)
+	dbc.UnfollowUser(un, user.Username)
+	if activitypub.IsHandle(un) {
+		unfollowRemote(dbc, user, un)
+	}
+	return c.RedirectBack("/user/" + url.PathEscape(un))
+}
+
+func Followers(c *fiber.Ctx) error {
+	return renderFollows(c, true)
+}
+
+func Following(c *fiber.Ctx) error {
+	return renderFollows(c, false)
 }
 
 func All(c *fiber.Ctx) error {
-	posts := getDB(c).GetAllPosts()
-	return c.Render("views/all", fiber.Map{
-		"Posts": posts,
-	})
+	// All can be viewed logged out in which case the default time format is used
+	user := currentUser(c)
+	posts, pageInfo := getDB(c).GetAllPosts(user, pageFromQuery(c))
+	m := fiber.Map{
+		"CurrentUser": user,
+		"IsAdmin":     user != nil && user.IsAdmin(),
+		"Posts":       posts,
+		"Page":        pageInfo,
+		"AtomFeed":    "/all/feed.atom",
+	}
+	if isHTMX(c) {
+		return c.Render("views/posts-page", m)
+	}
+	return c.Render("views/all", m)
 }
 
 func NewPaste(c *fiber.Ctx) error {
-	user, isValid := checkAndGetCurrentUser(c)
-	if !isValid {
-		return c.Redirect("/login")
-	}
+	user := currentUser(c)
 	title := c.FormValue("title")
 	text := c.FormValue("text")
-	un := c.FormValue("username")
-	if !validateUser(c, un) {
-		return c.SendStatus(fiber.StatusBadRequest)
-	}
+	un := user.Username
 	p := &models.Paste{
 		Title:    title,
 		Text:     text,
@@ -250,67 +423,79 @@ func NewPaste(c *fiber.Ctx) error {
 		})
 	}
 	getDB(c).NewPaste(p)
-	return c.Render("views/paste-ro", fiber.Map{
-		"Username": un,
-		"Title":    title,
-		"Text":     text,
-		"Id":       p.ID,
-		"IsAdmin":  user.IsAdmin(),
-	})
+	return renderPaste(c, user, *p)
 }
 
 func Paste(c *fiber.Ctx) error {
-	user, isValid := checkAndGetCurrentUser(c)
-	if !isValid {
-		return c.Redirect("/login")
-	}
+	user := currentUser(c)
 	return c.Render("views/paste", fiber.Map{"IsAdmin": user.IsAdmin(), "Username": user.Username})
 }
 
 func GetPaste(c *fiber.Ctx) error {
-	user, isValid := checkAndGetCurrentUser(c)
-	if !isValid {
-		return c.Redirect("/login")
-	}
+	user := currentUser(c)
 	sid := c.Params("id")
 	id, err := strconv.ParseUint(sid, 10, 64)
 	if err != nil {
 		log.Printf("GetPaste: Params(id) was not uint, error: %s", err.Error())
 		return c.Redirect("/my-pastes")
 	}
-	paste, ok := getDB(c).GetPaste(user, id)
+	var paste models.Paste
+	var ok bool
+	if user.IsAdmin() {
+		// Admins can open any paste so they can moderate it
+		paste, ok = getDB(c).GetAnyPaste(id)
+	} else {
+		paste, ok = getDB(c).GetPaste(user, id)
+	}
 	if !ok {
 		log.Printf("GetPaste: Paste not found")
 		return c.Redirect("/my-pastes")
 	}
+	return renderPaste(c, user, paste)
+}
+
+func renderPaste(c *fiber.Ctx, user *models.User, paste models.Paste) error {
 	return c.Render("views/paste-ro", fiber.Map{
-		"Username": user.Username,
-		"Title":    paste.Title,
-		"Text":     paste.Text,
-		"Id":       paste.ID,
-		"IsAdmin":  user.IsAdmin(),
+		"Username":    user.Username,
+		"CurrentUser": user,
+		"Owner":       paste.Username,
+		"Title":       paste.Title,
+		"Text":        paste.Text,
+		"TextHTML":    paste.TextHTML(),
+		"Markdown":    c.Query("render") == "markdown",
+		"Id":          paste.ID,
+		"CreatedAt":   paste.CreatedAt,
+		"IsAdmin":     user.IsAdmin(),
 	})
 }
 
 func MyPastes(c *fiber.Ctx) error {
-	user, isValid := checkAndGetCurrentUser(c)
-	if !isValid {
-		return c.Redirect("/login")
+	user := currentUser(c)
+
+	query := strings.TrimSpace(c.Query("q"))
+	if query != "" {
+		return c.Render("views/my-pastes", fiber.Map{
+			"Username": user.Username,
+			"Query":    query,
+			"Results":  getDB(c).SearchPastes(user, query),
+			"IsAdmin":  user.IsAdmin(),
+		})
 	}
-
-	pastes := getDB(c).GetAllPastes(user)
-	return c.Render("views/my-pastes", fiber.Map{
+	pastes, pageInfo := getDB(c).GetAllPastes(user, pageFromQuery(c))
+	m := fiber.Map{
 		"Username": user.Username,
 		"Pastes":   pastes,
+		"Page":     pageInfo,
 		"IsAdmin":  user.IsAdmin(),
-	})
+	}
+	if isHTMX(c) {
+		return c.Render("views/pastes-page", m)
+	}
+	return c.Render("views/my-pastes", m)
 }
 
 func Chat(c *fiber.Ctx) error {
-	user, isValid := checkAndGetCurrentUser(c)
-	if !isValid {
-		return c.Redirect("/login")
-	}
+	user := currentUser(c)
 	return c.Render("views/chat", fiber.Map{
 		"Username": user.Username,
 		"IsAdmin":  user.IsAdmin(),
@@ -318,10 +503,6 @@ func Chat(c *fiber.Ctx) error {
 }
 
 func ChatPost(c *fiber.Ctx) error {
-	_, isValid := checkAndGetCurrentUser(c)
-	if !isValid {
-		return c.Redirect("/login")
-	}
 	room := c.FormValue("room")
 	if room == "" {
 		return c.Redirect("/chat")
@@ -331,19 +512,43 @@ func ChatPost(c *fiber.Ctx) error {
 }
 
 func ChatRoom(c *fiber.Ctx) error {
-	user, isValid := checkAndGetCurrentUser(c)
-	if !isValid {
-		return c.Redirect("/login")
-	}
+	user := currentUser(c)
 	room := c.Params("room")
 	if room == "" {
 		return c.Redirect("/chat")
 	}
-	return c.Render("views/chatroom", fiber.Map{
+	m := fiber.Map{
 		"Room":     room,
+		"ChatRoom": getDB(c).GetChatRoom(room),
 		"Username": user.Username,
 		"IsAdmin":  user.IsAdmin(),
-	})
+	}
+	if user.IsAdmin() {
+		m["CurrentUser"] = user
+		m["ChatMessages"] = getDB(c).GetRecentChatMessages(room, models.ChatHistoryLength)
+	}
+	return c.Render("views/chatroom", m)
+}
+
+func ChatRoomRetention(c *fiber.Ctx) error {
+	user := currentUser(c)
+	room := c.Params("room")
+	if room == "" {
+		return c.Redirect("/chat")
+	}
+	dbc := getDB(c)
+	cr, err := chatRoomRetentionFromForm(c, room)
+	if err != nil {
+		return c.Render("views/chatroom", fiber.Map{
+			"Room":     room,
+			"ChatRoom": dbc.GetChatRoom(room),
+			"Username": user.Username,
+			"IsAdmin":  user.IsAdmin(),
+			"Error":    err.Error(),
+		})
+	}
+	dbc.UpdateChatRoomRetention(cr)
+	return c.Redirect("/chat/" + url.PathEscape(room))
 }
 
 var broker = pubsub.NewBroker()
@@ -356,11 +561,22 @@ func WSChatRoom() func(*fiber.Ctx) error {
 			return
 		}
 
-		user, isValid := checkAndGetCurrentUserWS(c)
-		if !isValid {
+		user := currentUserWS(c)
+		if user == nil {
 			c.Close()
 			return
 		}
+		dbc := getDBWS(c)
+		// Joining a room creates it with the default retention policy
+		dbc.GetChatRoom(room)
+		dbc.PruneChatMessages(room)
+		for _, cm := range dbc.GetRecentChatMessages(room, models.ChatHistoryLength) {
+			if err := c.WriteMessage(websocket.TextMessage, cm.ToTextMessage(user)); err != nil {
+				log.Println("write history:", err)
+				c.Close()
+				return
+			}
+		}
 		s := broker.AddSubscriber(c)
 		broker.Subscribe(s, room)
 		s.AddTopic(room)
@@ -372,7 +588,7 @@ func WSChatRoom() func(*fiber.Ctx) error {
 					return
 				}
 				cm := msg.GetMessage()
-				if err := c.WriteMessage(websocket.TextMessage, cm.ToTextMessage()); err != nil {
+				if err := c.WriteMessage(websocket.TextMessage, cm.ToTextMessage(user)); err != nil {
 					log.Println("write:", err)
 					break
 				}
@@ -397,14 +613,17 @@ func WSChatRoom() func(*fiber.Ctx) error {
 				log.Printf("json unmarshal: %s", err.Error())
 				break
 			}
-			if cm.Username != user.Username {
-				break
-			}
-			if len([]rune(cm.Message)) < 3 || len([]rune(cm.Message)) > 255 {
+			if err := cm.Validate(); err != nil {
 				continue
 			}
+			// Only the message itself comes from the client
+			cm.Model = gorm.Model{}
+			cm.Username = user.Username
+			cm.Room = room
 			cm.Timestamp = time.Now()
+			dbc.NewChatMessage(&cm)
 			broker.Publish(room, cm)
+			publishNotifications(dbc.NotifyChatMessage(&cm))
 			log.Printf("mt = %d, recv: %s, cm = %s", mt, msg, cm)
 		}
 		broker.RemoveSubscriber(s)
@@ -3,6 +3,7 @@ package handlers
 import (
 	"beeline/db"
 	"beeline/models"
+	"crypto/rand"
 	"fmt"
 	"log"
 	"regexp"
@@ -11,6 +12,7 @@ import (
 
 	"github.com/gofiber/contrib/websocket"
 	"github.com/gofiber/fiber/v2"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func getDB(c *fiber.Ctx) *db.DB {
@@ -28,38 +30,54 @@ func getDBWS(c *websocket.Conn) *db.DB {
 	return dbc
 }
 
+// currentUser returns the user Authenticate found for the request, nil if
+// nobody is logged in
+func currentUser(c *fiber.Ctx) *models.User {
+	user, _ := c.Locals(userLocalsKey).(*models.User)
+	return user
+}
+
+func currentUserWS(c *websocket.Conn) *models.User {
+	user, _ := c.Locals(userLocalsKey).(*models.User)
+	return user
+}
+
+// pageFromQuery reads the ?before= and ?after= pagination cursors
+func pageFromQuery(c *fiber.Ctx) models.Page {
+	return models.Page{
+		Before: uint(c.QueryInt("before")),
+		After:  uint(c.QueryInt("after")),
+	}
+}
+
+// isHTMX is true for requests made by htmx, like the infinite scroll loading
+// the next page, which only need the items rendered
+func isHTMX(c *fiber.Ctx) bool {
+	return c.Get("HX-Request") == "true"
+}
+
 func setCookie(c *fiber.Ctx, key, value string) {
 	cook := new(fiber.Cookie)
 	cook.Name = key
 	cook.Value = value
-	cook.Expires = time.Now().Add(time.Hour)
+	cook.Expires = time.Now().Add(models.SessionDuration)
 	c.Cookie(cook)
 }
 
-func validateUser(c *fiber.Ctx, expectedUsername string) bool {
-	currentUserAuthId := c.Cookies("authId")
-	currentUsername := c.Cookies("username")
-	if expectedUsername != currentUsername {
-		return false
-	}
-	authId, ok := getDB(c).GetAuthId(currentUsername)
-	if !ok {
-		return false
-	}
-	return authId == currentUserAuthId
+// startSession creates a new session for the user and sets the session cookies
+func startSession(c *fiber.Ctx, username string) {
+	s := getDB(c).NewSession(username, c.Get(fiber.HeaderUserAgent), c.IP())
+	setCookie(c, "username", username)
+	setCookie(c, "authId", s.Token)
 }
 
-func validateUserWS(c *websocket.Conn, expectedUsername string) bool {
-	currentUserAuthId := c.Cookies("authId")
+func validateUser(c *fiber.Ctx, expectedUsername string) bool {
 	currentUsername := c.Cookies("username")
 	if expectedUsername != currentUsername {
 		return false
 	}
-	authId, ok := getDBWS(c).GetAuthId(currentUsername)
-	if !ok {
-		return false
-	}
-	return authId == currentUserAuthId
+	_, ok := getDB(c).GetSession(currentUsername, c.Cookies("authId"))
+	return ok
 }
 
 func checkAndGetCurrentUser(c *fiber.Ctx) (*models.User, bool) {
@@ -77,21 +95,9 @@ func checkAndGetCurrentUser(c *fiber.Ctx) (*models.User, bool) {
 	return user, true
 }
 
-func checkAndGetCurrentUserWS(c *websocket.Conn) (*models.User, bool) {
-	unc := c.Cookies("username")
-	if unc == "" {
-		return nil, false
-	}
-	user, userFound := getDBWS(c).FindUser(unc)
-	if !userFound {
-		return nil, false
-	}
-	if !validateUserWS(c, unc) {
-		return nil, false
-	}
-	return user, true
-}
-
+// validateUsername checks names for new accounts and renames only, so users
+// created before the pattern was anchored keep their names until they change
+// them, see WarnInvalidUsernames
 func validateUsername(username string) error {
 	unLen := len([]rune(username))
 	if unLen < 3 || unLen > 255 {
@@ -100,7 +106,7 @@ func validateUsername(username string) error {
 	if username == "admin" {
 		return fmt.Errorf("invalid name")
 	}
-	reStr := `([a-zA-Z0-9]){3,255}`
+	reStr := `^[a-zA-Z0-9]{3,255}$`
 	matched, err := regexp.MatchString(reStr, username)
 	if err != nil {
 		log.Fatal("Invalid Regex")
@@ -111,6 +117,19 @@ func validateUsername(username string) error {
 	return nil
 }
 
+// WarnInvalidUsernames logs the existing users whose names no longer pass
+// validateUsername so an admin can rename them
+func WarnInvalidUsernames(dbc *db.DB) {
+	for _, u := range dbc.GetAllUsers() {
+		if u.Username == "admin" {
+			continue
+		}
+		if err := validateUsername(u.Username); err != nil {
+			log.Printf("user %d has a name that is no longer allowed: %s", u.ID, err)
+		}
+	}
+}
+
 func validatePassword(password string) error {
 	pwLen := len(password)
 	if pwLen < 8 || pwLen > 255 {
@@ -146,11 +165,11 @@ func editUser(c *fiber.Ctx) error {
 	if err != nil {
 		return fmt.Errorf("invalid admin value %s", newIsAdmin)
 	}
-	// Get Current User so we can check if things changed
+	// Get the user being edited so we can check if things changed
 	dbc := getDB(c)
-	currentUser := dbc.GetUser(id)
+	editedUser := dbc.GetUser(id)
 
-	if newUn != currentUser.Username {
+	if newUn != editedUser.Username {
 		err = validateUsername(newUn)
 		if err != nil {
 			return fmt.Errorf("user id %s, %w", userId, err)
@@ -163,15 +182,145 @@ func editUser(c *fiber.Ctx) error {
 			return fmt.Errorf("user id %s, %w", userId, err)
 		}
 		dbc.UpdateUserPassword(id, newPw)
+		// A password set by an admin for someone else is temporary
+		if uint64(currentUser(c).ID) != id {
+			dbc.UpdateUserMustChangePassword(id, true)
+		}
 	}
 
-	if newFailedLoginAttemptsNum != currentUser.FailedLoginAttempts {
+	if newFailedLoginAttemptsNum != editedUser.FailedLoginAttempts {
 		dbc.UpdateUserFailedLoginAttempts(id, newFailedLoginAttemptsNum)
 	}
 
-	if newIsAdminBool != currentUser.Admin {
+	if newIsAdminBool != editedUser.Admin {
 		dbc.UpdateUserAdmin(id, newIsAdminBool)
 	}
 
 	return nil
 }
+
+// Return valid error for printing to the screen
+func chatRoomRetentionFromForm(c *fiber.Ctx, room string) (*models.ChatRoom, error) {
+	maxAgeHours := c.FormValue("max_age_hours")
+	maxMessages := c.FormValue("max_messages")
+	maxBytes := c.FormValue("max_bytes")
+	maxAgeHoursNum, err := strconv.Atoi(maxAgeHours)
+	if err != nil {
+		return nil, fmt.Errorf("invalid max age hours %s", maxAgeHours)
+	}
+	maxMessagesNum, err := strconv.Atoi(maxMessages)
+	if err != nil {
+		return nil, fmt.Errorf("invalid max messages %s", maxMessages)
+	}
+	maxBytesNum, err := strconv.Atoi(maxBytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid max bytes %s", maxBytes)
+	}
+	cr := &models.ChatRoom{
+		Name:        room,
+		MaxAge:      time.Duration(maxAgeHoursNum) * time.Hour,
+		MaxMessages: maxMessagesNum,
+		MaxBytes:    maxBytesNum,
+	}
+	if err := cr.Validate(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+const tempPasswordAlphabet = "abcdefghjkmnpqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+func generateTempPassword() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		// TODO: Properly handle error
+		log.Fatal(err)
+	}
+	for i, v := range b {
+		b[i] = tempPasswordAlphabet[int(v)%len(tempPasswordAlphabet)]
+	}
+	return string(b)
+}
+
+// Return valid error for printing to the screen
+func changePassword(c *fiber.Ctx, user *models.User) error {
+	newPw := c.FormValue("new_password")
+	confirmPw := c.FormValue("confirm_password")
+	if newPw != confirmPw {
+		return fmt.Errorf("passwords do not match")
+	}
+	err := validatePassword(newPw)
+	if err != nil {
+		return err
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(newPw)) == nil {
+		return fmt.Errorf("new password must be different from the current one")
+	}
+	dbc := getDB(c)
+	dbc.UpdateUserPassword(uint64(user.ID), newPw)
+	dbc.UpdateUserMustChangePassword(uint64(user.ID), false)
+	dbc.DeleteOtherUserSessions(user.Username, c.Cookies("authId"))
+	dbc.RevokeAccessTokens(user.Username)
+	return nil
+}
+
+// Return valid error for printing to the screen
+func siteSettingsFromForm(c *fiber.Ctx) (models.SiteSettings, error) {
+	maxUsers := c.FormValue("max_users")
+	invitesPerUser := c.FormValue("invites_per_user")
+	maxUsersNum, err := strconv.Atoi(maxUsers)
+	if err != nil {
+		return models.SiteSettings{}, fmt.Errorf("invalid max users %s", maxUsers)
+	}
+	invitesPerUserNum, err := strconv.Atoi(invitesPerUser)
+	if err != nil {
+		return models.SiteSettings{}, fmt.Errorf("invalid invites per user %s", invitesPerUser)
+	}
+	ss := models.SiteSettings{
+		MaxUsers:         maxUsersNum,
+		AllowUserInvites: c.FormValue("allow_user_invites") == "on",
+		InvitesPerUser:   invitesPerUserNum,
+	}
+	if err := ss.Validate(); err != nil {
+		return models.SiteSettings{}, err
+	}
+	return ss, nil
+}
+
+// renderFollows lists the followers of a user or who they follow, marking
+// the people who follow the viewer
+func renderFollows(c *fiber.Ctx, followers bool) error {
+	un := c.Params("username")
+	viewer := currentUser(c)
+	dbc := getDB(c)
+	if _, ok := dbc.FindUser(un); !ok {
+		return c.SendString("User '" + un + "' not found!")
+	}
+	var follows []models.Following
+	var pageInfo models.PageInfo
+	usernames := []string{}
+	if followers {
+		follows, pageInfo = dbc.GetFollowers(un, pageFromQuery(c))
+		for _, f := range follows {
+			usernames = append(usernames, f.Follower)
+		}
+	} else {
+		follows, pageInfo = dbc.GetFollowing(un, pageFromQuery(c))
+		for _, f := range follows {
+			usernames = append(usernames, f.Username)
+		}
+	}
+	m := fiber.Map{
+		"Username":    viewer.Username,
+		"IsAdmin":     viewer.IsAdmin(),
+		"ProfileUser": un,
+		"Followers":   followers,
+		"Usernames":   usernames,
+		"FollowsYou":  dbc.FollowersAmong(viewer.Username, usernames),
+		"Page":        pageInfo,
+	}
+	if isHTMX(c) {
+		return c.Render("views/follows-page", m)
+	}
+	return c.Render("views/follows", m)
+}
@@ -0,0 +1,27 @@
+package handlers
+
+import "testing"
+
+func TestValidateUsername(t *testing.T) {
+	tests := []struct {
+		name     string
+		username string
+		valid    bool
+	}{
+		{name: "letters and digits", username: "alice99", valid: true},
+		{name: "too short", username: "al"},
+		{name: "admin is reserved", username: "admin"},
+		{name: "remote handle", username: "alice@example.com"},
+		{name: "valid prefix", username: "bob<script>"},
+		{name: "valid suffix", username: "../bob"},
+		{name: "space", username: "bob smith"},
+		{name: "non ascii letters", username: "bøbbob"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateUsername(tt.username); (err == nil) != tt.valid {
+				t.Errorf("validateUsername(%q) error = %v, want valid %v", tt.username, err, tt.valid)
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+package handlers
+
+import (
+	"beeline/models"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func Invites(c *fiber.Ctx) error {
+	user := currentUser(c)
+	return renderInvites(c, user, fiber.Map{})
+}
+
+func NewInvite(c *fiber.Ctx) error {
+	user := currentUser(c)
+	dbc := getDB(c)
+	if !user.IsAdmin() && remainingInvites(c, user) < 1 {
+		return renderInvites(c, user, fiber.Map{"Error": "You have no invites left!"})
+	}
+	expiresHours := c.FormValue("expires_hours")
+	maxUses := c.FormValue("max_uses")
+	expiresHoursNum, err := strconv.Atoi(expiresHours)
+	if err != nil {
+		return renderInvites(c, user, fiber.Map{"Error": fmt.Sprintf("invalid expires hours %s", expiresHours)})
+	}
+	maxUsesNum, err := strconv.Atoi(maxUses)
+	if err != nil {
+		return renderInvites(c, user, fiber.Map{"Error": fmt.Sprintf("invalid max uses %s", maxUses)})
+	}
+	// Regular users can only invite one person per invite so the quota means something
+	if !user.IsAdmin() {
+		maxUsesNum = 1
+	}
+	i := &models.Invite{
+		ExpiresAt: time.Now().Add(time.Duration(expiresHoursNum) * time.Hour),
+		MaxUses:   maxUsesNum,
+	}
+	if err := i.Validate(); err != nil {
+		return renderInvites(c, user, fiber.Map{"Error": err.Error()})
+	}
+	i = dbc.NewInvite(user.Username, i.ExpiresAt, i.MaxUses)
+	return renderInvites(c, user, fiber.Map{
+		"Success":    "Invite created! Share the link below.",
+		"InviteLink": inviteLink(c, i),
+	})
+}
+
+func RevokeInvite(c *fiber.Ctx) error {
+	user := currentUser(c)
+	sid := c.Params("id")
+	id, err := strconv.ParseUint(sid, 10, 64)
+	if err != nil {
+		log.Printf("RevokeInvite: Params(id) was not uint, error: %s", err.Error())
+		return c.Redirect("/invites")
+	}
+	createdBy := user.Username
+	if user.IsAdmin() {
+		createdBy = ""
+	}
+	if !getDB(c).RevokeInvite(createdBy, id) {
+		return renderInvites(c, user, fiber.Map{"Error": fmt.Sprintf("could not revoke invite %d", id)})
+	}
+	return renderInvites(c, user, fiber.Map{"Success": fmt.Sprintf("Revoked invite %d", id)})
+}
+
+func InviteSignup(c *fiber.Ctx) error {
+	i, ok := getDB(c).GetInvite(c.Params("token"))
+	if !ok || !i.IsUsable() {
+		return c.Status(fiber.StatusNotFound).Render("views/invite-signup", fiber.Map{
+			"Error": "This invite is invalid or has expired!",
+		})
+	}
+	return c.Render("views/invite-signup", fiber.Map{"Invite": i})
+}
+
+func InviteNewUser(c *fiber.Ctx) error {
+	dbc := getDB(c)
+	token := c.Params("token")
+	i, ok := dbc.GetInvite(token)
+	if !ok || !i.IsUsable() {
+		return c.Status(fiber.StatusNotFound).Render("views/invite-signup", fiber.Map{
+			"Error": "This invite is invalid or has expired!",
+		})
+	}
+	un := c.FormValue("username")
+	err := validateUsername(un)
+	if err != nil {
+		return c.Render("views/invite-signup", fiber.Map{"Invite": i, "Error": err.Error()})
+	}
+	pw := c.FormValue("password")
+	err = validatePassword(pw)
+	if err != nil {
+		return c.Render("views/invite-signup", fiber.Map{"Invite": i, "Error": err.Error()})
+	}
+	if _, ok := dbc.FindUser(un); ok {
+		errorString := fmt.Sprintf("Username '%s' already exists!", un)
+		return c.Render("views/invite-signup", fiber.Map{"Invite": i, "Error": errorString})
+	}
+	if maxUsers := dbc.GetSiteSettings().MaxUsers; dbc.TotalUserCount() >= maxUsers {
+		return c.SendString(fmt.Sprintf("Max users of %d reached", maxUsers))
+	}
+	if !dbc.UseInvite(token) {
+		return c.Render("views/invite-signup", fiber.Map{"Error": "This invite is invalid or has expired!"})
+	}
+	dbc.CreateInvitedUser(un, pw, i)
+	startSession(c, un)
+	return c.Redirect("/")
+}
+
+func SiteSettings(c *fiber.Ctx) error {
+	user := currentUser(c)
+	return c.Render("views/site-settings", fiber.Map{
+		"Username":     user.Username,
+		"IsAdmin":      user.IsAdmin(),
+		"SiteSettings": getDB(c).GetSiteSettings(),
+	})
+}
+
+func EditSiteSettings(c *fiber.Ctx) error {
+	user := currentUser(c)
+	dbc := getDB(c)
+	ss, err := siteSettingsFromForm(c)
+	if err != nil {
+		return c.Render("views/site-settings", fiber.Map{
+			"Username":     user.Username,
+			"IsAdmin":      user.IsAdmin(),
+			"SiteSettings": dbc.GetSiteSettings(),
+			"Error":        err.Error(),
+		})
+	}
+	dbc.UpdateSiteSettings(ss)
+	return c.Render("views/site-settings", fiber.Map{
+		"Username":     user.Username,
+		"IsAdmin":      user.IsAdmin(),
+		"SiteSettings": ss,
+		"Success":      "Site settings saved!",
+	})
+}
+
+func renderInvites(c *fiber.Ctx, user *models.User, m fiber.Map) error {
+	dbc := getDB(c)
+	createdBy := user.Username
+	if user.IsAdmin() {
+		// Admins see every invite so they know who invited whom
+		createdBy = ""
+	}
+	invites := dbc.GetInvites(createdBy)
+	ids := make([]uint, 0, len(invites))
+	for _, i := range invites {
+		ids = append(ids, i.ID)
+	}
+	m["Username"] = user.Username
+	m["IsAdmin"] = user.IsAdmin()
+	m["CurrentUser"] = user
+	m["Invites"] = invites
+	m["Invitees"] = dbc.GetInvitees(ids)
+	m["CanInvite"] = user.IsAdmin() || remainingInvites(c, user) > 0
+	m["RemainingInvites"] = remainingInvites(c, user)
+	return c.Render("views/invites", m)
+}
+
+// remainingInvites is how many more invites a non admin user can create
+func remainingInvites(c *fiber.Ctx, user *models.User) int {
+	dbc := getDB(c)
+	ss := dbc.GetSiteSettings()
+	if !ss.AllowUserInvites {
+		return 0
+	}
+	remaining := ss.InvitesPerUser - dbc.InviteCount(user.Username)
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+func inviteLink(c *fiber.Ctx, i *models.Invite) string {
+	return siteURL(c) + "/invite/" + i.Token
+}
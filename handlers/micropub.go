@@ -0,0 +1,267 @@
+package handlers
+
+import (
+	"beeline/activitypub"
+	"beeline/models"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// micropubRequest is a Micropub create, update or delete, sent as a form or
+// as JSON, see https://www.w3.org/TR/micropub/
+type micropubRequest struct {
+	Type       []string                 `json:"type"`
+	Properties map[string][]interface{} `json:"properties"`
+	Action     string                   `json:"action"`
+	URL        string                   `json:"url"`
+	Replace    map[string][]interface{} `json:"replace"`
+	Add        map[string][]interface{} `json:"add"`
+	Delete     interface{}              `json:"delete"`
+}
+
+func postURL(c *fiber.Ctx, id uint) string {
+	return siteURL(c) + fmt.Sprintf("/post/%d", id)
+}
+
+// MicropubQuery answers a client's q=config, q=syndicate-to and q=source
+func MicropubQuery(c *fiber.Ctx) error {
+	user, err := authenticateToken(c, "")
+	if user == nil {
+		return err
+	}
+	switch c.Query("q") {
+	case "config":
+		return c.JSON(fiber.Map{"q": []string{"config", "source", "syndicate-to"}, "syndicate-to": []string{}})
+	case "syndicate-to":
+		return c.JSON(fiber.Map{"syndicate-to": []string{}})
+	case "source":
+		return micropubSource(c, user)
+	}
+	return jsonError(c, fiber.StatusBadRequest, "invalid_request", "unsupported query")
+}
+
+// micropubSource returns the properties of one of the user's posts, only the
+// ones asked for with properties[] if any were
+func micropubSource(c *fiber.Ctx, user *models.User) error {
+	id, ok := localPostID(c, c.Query("url"))
+	if !ok {
+		return jsonError(c, fiber.StatusBadRequest, "invalid_request", "url must be a post on this site")
+	}
+	post, ok := getDB(c).GetPost(id)
+	if !ok {
+		return jsonError(c, fiber.StatusBadRequest, "invalid_request", "post not found")
+	}
+	if !user.Owns(post.Username) {
+		return jsonError(c, fiber.StatusForbidden, "forbidden", "you can only read the source of your own posts")
+	}
+	props := fiber.Map{
+		"content":   []string{post.Message},
+		"published": []string{post.Timestamp.Format(time.RFC3339)},
+		"url":       []string{postURL(c, post.ID)},
+	}
+	if post.IsReply() {
+		props["in-reply-to"] = []string{postURL(c, post.ReplyToID)}
+	}
+	var wanted []string
+	for _, p := range c.Context().QueryArgs().PeekMulti("properties[]") {
+		wanted = append(wanted, string(p))
+	}
+	if p := c.Query("properties"); p != "" {
+		wanted = append(wanted, p)
+	}
+	if len(wanted) == 0 {
+		return c.JSON(fiber.Map{"type": []string{"h-entry"}, "properties": props})
+	}
+	filtered := fiber.Map{}
+	for _, p := range wanted {
+		if v, ok := props[p]; ok {
+			filtered[p] = v
+		}
+	}
+	return c.JSON(fiber.Map{"properties": filtered})
+}
+
+// Micropub creates, updates and deletes posts for Micropub clients
+func Micropub(c *fiber.Ctx) error {
+	req, err := parseMicropubRequest(c)
+	if err != nil {
+		return jsonError(c, fiber.StatusBadRequest, "invalid_request", err.Error())
+	}
+	switch req.Action {
+	case "", "create":
+		return micropubCreate(c, req)
+	case "update":
+		return micropubUpdate(c, req)
+	case "delete":
+		return micropubDelete(c, req)
+	}
+	return jsonError(c, fiber.StatusBadRequest, "invalid_request", fmt.Sprintf("unsupported action %s", req.Action))
+}
+
+func parseMicropubRequest(c *fiber.Ctx) (*micropubRequest, error) {
+	req := &micropubRequest{Properties: map[string][]interface{}{}}
+	contentType := c.Get(fiber.HeaderContentType)
+	if strings.HasPrefix(contentType, fiber.MIMEApplicationJSON) {
+		if err := json.Unmarshal(c.Body(), req); err != nil {
+			return nil, fmt.Errorf("invalid JSON: %w", err)
+		}
+		return req, nil
+	}
+	add := func(key, value string) {
+		switch key {
+		case "h":
+			req.Type = []string{"h-" + value}
+		case "action":
+			req.Action = value
+		case "url":
+			req.URL = value
+		case "access_token":
+		default:
+			key = strings.TrimSuffix(key, "[]")
+			req.Properties[key] = append(req.Properties[key], value)
+		}
+	}
+	if strings.HasPrefix(contentType, fiber.MIMEMultipartForm) {
+		form, err := c.MultipartForm()
+		if err != nil {
+			return nil, fmt.Errorf("invalid form: %w", err)
+		}
+		for key, values := range form.Value {
+			for _, v := range values {
+				add(key, v)
+			}
+		}
+		return req, nil
+	}
+	if !strings.HasPrefix(contentType, fiber.MIMEApplicationForm) {
+		return nil, fmt.Errorf("send a form or JSON")
+	}
+	c.Request().PostArgs().VisitAll(func(key, value []byte) {
+		add(string(key), string(value))
+	})
+	return req, nil
+}
+
+// micropubContent is the plain text of a content property, html content is
+// turned into text like remote posts are
+func micropubContent(props map[string][]interface{}) (string, bool) {
+	values := props["content"]
+	if len(values) == 0 {
+		return "", false
+	}
+	switch v := values[0].(type) {
+	case string:
+		return strings.TrimSpace(v), true
+	case map[string]interface{}:
+		if h, ok := v["html"].(string); ok {
+			return activitypub.HTMLToText(h), true
+		}
+		if s, ok := v["value"].(string); ok {
+			return strings.TrimSpace(s), true
+		}
+	}
+	return "", false
+}
+
+func micropubCreate(c *fiber.Ctx, req *micropubRequest) error {
+	user, err := authenticateToken(c, models.ScopeCreate)
+	if user == nil {
+		return err
+	}
+	if len(req.Type) != 1 || req.Type[0] != "h-entry" {
+		return jsonError(c, fiber.StatusBadRequest, "invalid_request", "only h-entry posts are supported")
+	}
+	message, ok := micropubContent(req.Properties)
+	if !ok {
+		return jsonError(c, fiber.StatusBadRequest, "invalid_request", "content is required")
+	}
+	post := &models.Post{
+		Message:   message,
+		Timestamp: time.Now(),
+		Username:  user.Username,
+	}
+	dbc := getDB(c)
+	if values := req.Properties["in-reply-to"]; len(values) > 0 {
+		replyTo, _ := values[0].(string)
+		id, ok := localPostID(c, replyTo)
+		if !ok {
+			return jsonError(c, fiber.StatusBadRequest, "invalid_request", "in-reply-to must be a post on this site")
+		}
+		parent, ok := dbc.GetPost(id)
+		if !ok {
+			return jsonError(c, fiber.StatusBadRequest, "invalid_request", "in-reply-to post not found")
+		}
+		post.ReplyToID = parent.ID
+	}
+	if err := post.Validate(); err != nil {
+		return jsonError(c, fiber.StatusBadRequest, "invalid_request", err.Error())
+	}
+	publishPost(c, dbc, user, post)
+	c.Location(postURL(c, post.ID))
+	return c.SendStatus(fiber.StatusCreated)
+}
+
+// micropubPost finds the post a request's url points at, it must be one of
+// user's
+func micropubPost(c *fiber.Ctx, user *models.User, req *micropubRequest) (*models.Post, error) {
+	id, ok := localPostID(c, req.URL)
+	if !ok {
+		return nil, jsonError(c, fiber.StatusBadRequest, "invalid_request", "url must be a post on this site")
+	}
+	post, ok := getDB(c).GetPost(id)
+	if !ok {
+		return nil, jsonError(c, fiber.StatusBadRequest, "invalid_request", "post not found")
+	}
+	if !user.Owns(post.Username) {
+		return nil, jsonError(c, fiber.StatusForbidden, "forbidden", "you can only change your own posts")
+	}
+	return &post, nil
+}
+
+// micropubUpdate only replaces the content, posts have no other properties
+// that can change
+func micropubUpdate(c *fiber.Ctx, req *micropubRequest) error {
+	user, err := authenticateToken(c, models.ScopeUpdate)
+	if user == nil {
+		return err
+	}
+	if len(req.Add) > 0 || req.Delete != nil || len(req.Replace) != 1 {
+		return jsonError(c, fiber.StatusBadRequest, "invalid_request", "only replacing the content is supported")
+	}
+	message, ok := micropubContent(req.Replace)
+	if !ok {
+		return jsonError(c, fiber.StatusBadRequest, "invalid_request", "only replacing the content is supported")
+	}
+	post, err := micropubPost(c, user, req)
+	if post == nil {
+		return err
+	}
+	oldMessage := post.Message
+	post.Message = message
+	if err := post.Validate(); err != nil {
+		return jsonError(c, fiber.StatusBadRequest, "invalid_request", err.Error())
+	}
+	if !updatePost(c, getDB(c), user, *post, oldMessage) {
+		return jsonError(c, fiber.StatusForbidden, "forbidden", "you can only change your own posts")
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func micropubDelete(c *fiber.Ctx, req *micropubRequest) error {
+	user, err := authenticateToken(c, models.ScopeDelete)
+	if user == nil {
+		return err
+	}
+	post, err := micropubPost(c, user, req)
+	if post == nil {
+		return err
+	}
+	if !removePost(getDB(c), user, *post) {
+		return jsonError(c, fiber.StatusForbidden, "forbidden", "you can only delete your own posts")
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
@@ -0,0 +1,127 @@
+package handlers
+
+import (
+	"log"
+	"net/url"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/csrf"
+)
+
+const (
+	// csrfFormKey is the hidden form field every form posts the CSRF token in
+	csrfFormKey = "_csrf"
+	// csrfLocalsKey is where the CSRF middleware stores the token for the request
+	csrfLocalsKey = "csrf"
+	// userLocalsKey is where Authenticate stores the logged in user
+	userLocalsKey = "user"
+	// tokenLocalsKey is where authenticateToken stores the access token
+	tokenLocalsKey = "token"
+)
+
+// Authenticate stores the user of the request's session in c.Locals("user"),
+// it does not reject anything, routes declare what they need with RequireUser
+// or RequireAdmin
+func Authenticate(c *fiber.Ctx) error {
+	if user, isValid := checkAndGetCurrentUser(c); isValid {
+		c.Locals(userLocalsKey, user)
+	}
+	return c.Next()
+}
+
+// RequireUser only lets logged in users through
+func RequireUser(c *fiber.Ctx) error {
+	if currentUser(c) == nil {
+		return c.Redirect("/login")
+	}
+	return c.Next()
+}
+
+// RequireAdmin only lets logged in admins through
+func RequireAdmin(c *fiber.Ctx) error {
+	user := currentUser(c)
+	if user == nil {
+		return c.Redirect("/login")
+	}
+	if !user.IsAdmin() {
+		return c.SendStatus(fiber.StatusForbidden)
+	}
+	return c.Next()
+}
+
+// RequirePasswordChange keeps users with a temporary password on the change
+// password page until they have picked a new one
+func RequirePasswordChange(c *fiber.Ctx) error {
+	user := currentUser(c)
+	if user == nil || !user.MustChangePassword {
+		return c.Next()
+	}
+	switch c.Path() {
+	case "/change-password", "/logout":
+		return c.Next()
+	}
+	return c.Redirect("/change-password")
+}
+
+// CSRF protects every state changing request with a synchronizer token that
+// is also double submitted in a cookie. Forms send it in the _csrf field and
+// htmx requests in the X-Csrf-Token header.
+func CSRF() func(*fiber.Ctx) error {
+	return csrf.New(csrf.Config{
+		Next:              skipCSRF,
+		CookieName:        "csrf_",
+		CookieSameSite:    fiber.CookieSameSiteStrictMode,
+		CookieHTTPOnly:    true,
+		CookieSessionOnly: true,
+		ContextKey:        csrfLocalsKey,
+		Extractor: func(c *fiber.Ctx) (string, error) {
+			if token := c.Get(csrf.HeaderName); token != "" {
+				return token, nil
+			}
+			return csrf.CsrfFromForm(csrfFormKey)(c)
+		},
+		ErrorHandler: func(c *fiber.Ctx, err error) error {
+			log.Printf("csrf: %s %s rejected: %s", c.Method(), c.Path(), err.Error())
+			return c.Status(fiber.StatusForbidden).Render("views/forbidden", fiber.Map{
+				"Error": "Your form has expired or was not sent from beeline, go back, refresh the page and try again.",
+			})
+		},
+	})
+}
+
+// skipCSRF is true for requests other sites send on purpose, they carry no
+// CSRF token and don't act as a logged in user. The API only acts for access
+// tokens, never for the session cookies.
+func skipCSRF(c *fiber.Ctx) bool {
+	if strings.HasPrefix(c.Path(), "/api/") {
+		return true
+	}
+	if c.Method() != fiber.MethodPost {
+		return false
+	}
+	return isInbox(c) || c.Path() == "/webmention" || c.Path() == "/micropub"
+}
+
+// BindCSRFToken makes the CSRF token of the request available to every view as .CSRFToken
+func BindCSRFToken(c *fiber.Ctx) error {
+	token, _ := c.Locals(csrfLocalsKey).(string)
+	if err := c.Bind(fiber.Map{"CSRFToken": token}); err != nil {
+		return err
+	}
+	return c.Next()
+}
+
+// IsSameOrigin reports whether the request's Origin header matches the host
+// it was sent to, browsers always send it for websocket upgrades
+func IsSameOrigin(c *fiber.Ctx) bool {
+	origin := c.Get(fiber.HeaderOrigin)
+	if origin == "" {
+		return false
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return u.Host == c.Hostname()
+}
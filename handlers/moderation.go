@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"beeline/models"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const moderationLogLength = 100
+
+func Trash(c *fiber.Ctx) error {
+	user := currentUser(c)
+	return renderTrash(c, user, fiber.Map{})
+}
+
+// Moderate returns a handler applying the moderation action to the content
+// in the :type and :id params
+func Moderate(action string) func(*fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		user := currentUser(c)
+		contentType := c.Params("type")
+		if !models.IsValidContentType(contentType) {
+			return renderTrash(c, user, fiber.Map{"Error": fmt.Sprintf("unknown content type `%s`", contentType)})
+		}
+		sid := c.Params("id")
+		id, err := strconv.ParseUint(sid, 10, 64)
+		if err != nil {
+			return renderTrash(c, user, fiber.Map{"Error": fmt.Sprintf("invalid id %s", sid)})
+		}
+		reason := strings.TrimSpace(c.FormValue("reason"))
+		if reason == "" && action != models.ModerationRestore {
+			return renderTrash(c, user, fiber.Map{"Error": fmt.Sprintf("a reason is required to %s content", action)})
+		}
+		if err := getDB(c).ModerateContent(user.Username, action, contentType, id, reason); err != nil {
+			return renderTrash(c, user, fiber.Map{"Error": err.Error()})
+		}
+		log.Printf("moderation: %s did %s on %s %d, reason: %q", user.Username, action, contentType, id, reason)
+		if action == models.ModerationDelete {
+			return c.RedirectBack("/trash")
+		}
+		return renderTrash(c, user, fiber.Map{"Success": fmt.Sprintf("%s %s %d done", action, contentType, id)})
+	}
+}
+
+func renderTrash(c *fiber.Ctx, user *models.User, m fiber.Map) error {
+	dbc := getDB(c)
+	m["Username"] = user.Username
+	m["IsAdmin"] = user.IsAdmin()
+	m["CurrentUser"] = user
+	m["Posts"] = dbc.GetDeletedPosts()
+	m["Pastes"] = dbc.GetDeletedPastes()
+	m["ChatMessages"] = dbc.GetDeletedChatMessages()
+	m["ModerationLogs"] = dbc.GetModerationLogs(moderationLogLength)
+	return c.Render("views/trash", m)
+}
@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"beeline/models"
+	"beeline/pubsub"
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// notificationKeepAlive is how often an idle notification stream sends a
+// comment so proxies don't close it
+const notificationKeepAlive = 30 * time.Second
+
+var notifier = pubsub.NewNotifier()
+
+// CloseNotificationStreams ends all open notification streams so the server
+// can shut down
+func CloseNotificationStreams() {
+	notifier.Close()
+}
+
+// publishNotifications pushes new notifications to their recipients' open pages
+func publishNotifications(ns []models.Notification) {
+	for _, n := range ns {
+		notifier.Publish(n)
+	}
+}
+
+// BindNotifications makes the unread notification count available to the
+// navbar of every page
+func BindNotifications(c *fiber.Ctx) error {
+	if user := currentUser(c); user != nil && c.Method() == fiber.MethodGet {
+		if err := c.Bind(fiber.Map{"UnreadNotifications": getDB(c).UnreadNotificationCount(user.Username)}); err != nil {
+			return err
+		}
+	}
+	return c.Next()
+}
+
+func Notifications(c *fiber.Ctx) error {
+	user := currentUser(c)
+	notifications, pageInfo := getDB(c).GetNotifications(user.Username, pageFromQuery(c))
+	m := fiber.Map{
+		"Username":      user.Username,
+		"IsAdmin":       user.IsAdmin(),
+		"CurrentUser":   user,
+		"Notifications": notifications,
+		"Page":          pageInfo,
+	}
+	if isHTMX(c) {
+		return c.Render("views/notifications-page", m)
+	}
+	return c.Render("views/notifications", m)
+}
+
+// ReadNotification marks the notification read and goes to where it happened
+func ReadNotification(c *fiber.Ctx) error {
+	user := currentUser(c)
+	id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+	n, ok := getDB(c).ReadNotification(user.Username, id)
+	if !ok {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+	return c.Redirect(n.Link)
+}
+
+func ReadAllNotifications(c *fiber.Ctx) error {
+	user := currentUser(c)
+	getDB(c).ReadAllNotifications(user.Username)
+	return c.Redirect("/notifications")
+}
+
+// NotificationStream pushes the user's new notifications as server sent events
+func NotificationStream(c *fiber.Ctx) error {
+	user := currentUser(c)
+	dbc := getDB(c)
+	username := user.Username
+	c.Set(fiber.HeaderContentType, "text/event-stream")
+	c.Set(fiber.HeaderCacheControl, "no-cache")
+	c.Set(fiber.HeaderConnection, "keep-alive")
+	c.Set("X-Accel-Buffering", "no")
+
+	ch := notifier.Subscribe(username)
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer notifier.Unsubscribe(username, ch)
+		ticker := time.NewTicker(notificationKeepAlive)
+		defer ticker.Stop()
+		// Sent right away so the browser knows the stream is open
+		fmt.Fprint(w, ": connected\n\n")
+		for {
+			if err := w.Flush(); err != nil {
+				return
+			}
+			select {
+			case n, ok := <-ch:
+				if !ok {
+					return
+				}
+				data, err := json.Marshal(fiber.Map{
+					"unread":  dbc.UnreadNotificationCount(username),
+					"text":    n.Text(),
+					"excerpt": n.Excerpt,
+					"link":    n.Link,
+				})
+				if err != nil {
+					log.Printf("notification stream json marshal: %s", err.Error())
+					continue
+				}
+				fmt.Fprintf(w, "event: notification\ndata: %s\n\n", data)
+			case <-ticker.C:
+				fmt.Fprint(w, ": keepalive\n\n")
+			}
+		}
+	})
+	return nil
+}
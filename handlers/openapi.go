@@ -0,0 +1,274 @@
+package handlers
+
+import (
+	"beeline/models"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+var pathParamRe = regexp.MustCompile(`:([a-z]+)`)
+
+// OpenAPI serves the OpenAPI 3 document of the API, generated from apiRoutes
+func OpenAPI(c *fiber.Ctx) error {
+	return c.JSON(openAPIDocument(siteURL(c) + APIPrefix))
+}
+
+func schemaRef(name string) fiber.Map {
+	return fiber.Map{"$ref": "#/components/schemas/" + name}
+}
+
+func object(required []string, properties fiber.Map) fiber.Map {
+	return fiber.Map{"type": "object", "required": required, "properties": properties}
+}
+
+func typed(typ, description string) fiber.Map {
+	m := fiber.Map{"type": typ}
+	if description != "" {
+		m["description"] = description
+	}
+	return m
+}
+
+func nullable(typ, description string) fiber.Map {
+	m := typed(typ, description)
+	m["nullable"] = true
+	return m
+}
+
+func dateTime(description string) fiber.Map {
+	m := typed("string", description)
+	m["format"] = "date-time"
+	return m
+}
+
+func nullableDateTime(description string) fiber.Map {
+	m := dateTime(description)
+	m["nullable"] = true
+	return m
+}
+
+var openAPISchemas = fiber.Map{
+	"Error": object([]string{"error", "error_description"}, fiber.Map{
+		"error":             typed("string", "unauthorized, insufficient_scope, forbidden, invalid_request or not_found"),
+		"error_description": typed("string", "what went wrong, for people"),
+	}),
+	"Post": object([]string{"id", "username", "message", "html", "timestamp", "url"}, fiber.Map{
+		"id":          typed("integer", ""),
+		"username":    typed("string", "user@host for posts from other servers"),
+		"message":     typed("string", "the Markdown the author wrote"),
+		"html":        typed("string", "the message rendered to sanitized HTML"),
+		"timestamp":   dateTime(""),
+		"edited_at":   nullableDateTime("when the author last edited the post"),
+		"reply_to_id": nullable("integer", "the post this one answers"),
+		"reply_count": typed("integer", ""),
+		"reactions": fiber.Map{"type": "array", "items": object([]string{"name", "emoji", "count", "mine"}, fiber.Map{
+			"name":  typed("string", ""),
+			"emoji": typed("string", ""),
+			"count": typed("integer", ""),
+			"mine":  typed("boolean", "whether the token's user reacted with it"),
+		})},
+		"url":        typed("string", ""),
+		"remote_url": nullable("string", "the original of posts from other servers"),
+		"depth":      typed("integer", "how deep a reply is in a thread, only in threads"),
+	}),
+	"Thread": object([]string{"ancestors", "post", "replies"}, fiber.Map{
+		"ancestors": fiber.Map{"type": "array", "items": schemaRef("Post"), "description": "the posts this one answers, oldest first"},
+		"post":      schemaRef("Post"),
+		"replies":   fiber.Map{"type": "array", "items": schemaRef("Post"), "description": "every reply below the post, depth first"},
+	}),
+	"NewPost": object([]string{"message"}, fiber.Map{
+		"message":     typed("string", "3 to 255 characters of Markdown"),
+		"reply_to_id": typed("integer", "the post to reply to"),
+	}),
+	"EditPost": object([]string{"message"}, fiber.Map{
+		"message": typed("string", "3 to 255 characters of Markdown"),
+	}),
+	"Profile": object([]string{"username", "url", "follower_count", "following_count", "following", "follows_you"}, fiber.Map{
+		"username":        typed("string", ""),
+		"url":             typed("string", ""),
+		"admin":           typed("boolean", ""),
+		"remote_url":      nullable("string", "the profile of users on other servers"),
+		"follower_count":  typed("integer", ""),
+		"following_count": typed("integer", ""),
+		"following":       typed("boolean", "whether the token's user follows them"),
+		"follows_you":     typed("boolean", "whether they follow the token's user"),
+	}),
+	"Follow": object([]string{"username", "follower", "since"}, fiber.Map{
+		"username": typed("string", "who is followed"),
+		"follower": typed("string", "who follows"),
+		"since":    dateTime(""),
+	}),
+	"Paste": object([]string{"id", "username", "title", "text", "created_at", "url"}, fiber.Map{
+		"id":         typed("integer", ""),
+		"username":   typed("string", ""),
+		"title":      typed("string", ""),
+		"text":       typed("string", ""),
+		"created_at": dateTime(""),
+		"url":        typed("string", ""),
+	}),
+	"NewPaste": object([]string{"title", "text"}, fiber.Map{
+		"title": typed("string", ""),
+		"text":  typed("string", ""),
+	}),
+	"ChatRoom": object([]string{"name", "max_age_seconds", "max_messages", "max_bytes"}, fiber.Map{
+		"name":            typed("string", ""),
+		"max_age_seconds": typed("integer", "0 keeps messages forever"),
+		"max_messages":    typed("integer", "0 for no limit"),
+		"max_bytes":       typed("integer", "0 for no limit"),
+	}),
+	"ChatMessage": object([]string{"id", "room", "username", "message", "timestamp"}, fiber.Map{
+		"id":        typed("integer", ""),
+		"room":      typed("string", ""),
+		"username":  typed("string", ""),
+		"message":   typed("string", ""),
+		"timestamp": dateTime(""),
+	}),
+	"NewChatMessage": object([]string{"message"}, fiber.Map{
+		"message": typed("string", "3 to 255 characters"),
+	}),
+	"User": object([]string{"id", "username", "admin", "created_at"}, fiber.Map{
+		"id":                    typed("integer", ""),
+		"username":              typed("string", ""),
+		"admin":                 typed("boolean", ""),
+		"created_at":            dateTime(""),
+		"failed_login_attempts": typed("integer", ""),
+		"must_change_password":  typed("boolean", ""),
+		"totp_enabled":          typed("boolean", ""),
+		"invited_by":            typed("string", ""),
+		"feeds_private":         typed("boolean", ""),
+	}),
+}
+
+// pageSchema is a page of items, older and newer are the urls of the pages
+// around it
+func pageSchema(item string) fiber.Map {
+	return object([]string{"items", "older", "newer"}, fiber.Map{
+		"items": fiber.Map{"type": "array", "items": schemaRef(item)},
+		"older": nullable("string", "the next page of older items"),
+		"newer": nullable("string", "the next page of newer items"),
+	})
+}
+
+func errorResponse(description string) fiber.Map {
+	return fiber.Map{
+		"description": description,
+		"content":     fiber.Map{fiber.MIMEApplicationJSON: fiber.Map{"schema": schemaRef("Error")}},
+	}
+}
+
+func openAPIOperation(r apiRoute) fiber.Map {
+	var params []fiber.Map
+	pathParams := pathParamRe.FindAllStringSubmatch(r.Path, -1)
+	for _, m := range pathParams {
+		params = append(params, fiber.Map{"name": m[1], "in": "path", "required": true, "schema": typed("string", "")})
+	}
+	if r.List && !r.Unpaged {
+		for _, cursor := range []string{"before", "after"} {
+			params = append(params, fiber.Map{
+				"name":        cursor,
+				"in":          "query",
+				"description": "pagination cursor, follow the older and newer urls instead of setting it",
+				"schema":      typed("integer", ""),
+			})
+		}
+	}
+	status := r.Status
+	if status == 0 {
+		status = fiber.StatusOK
+	}
+	success := fiber.Map{"description": http.StatusText(status)}
+	if r.Response != "" {
+		schema := schemaRef(r.Response)
+		if r.List {
+			schema = pageSchema(r.Response)
+		}
+		success["content"] = fiber.Map{fiber.MIMEApplicationJSON: fiber.Map{"schema": schema}}
+	}
+	responses := fiber.Map{
+		"401": errorResponse("the access token is missing or invalid"),
+		"403": errorResponse("the access token lacks the scope or the user is not allowed"),
+	}
+	responses[strconv.Itoa(status)] = success
+	description := "Any access token can be used."
+	if r.Scope != "" {
+		description = "Needs the `" + r.Scope + "` scope: " + models.ScopeDescriptions[r.Scope] + "."
+	}
+	if r.AdminOnly {
+		description += " Only for admins."
+	}
+	op := fiber.Map{
+		"summary":     r.Summary,
+		"description": description,
+		"operationId": operationID(r),
+		"security":    []fiber.Map{{"token": []string{}}},
+		"responses":   responses,
+	}
+	if len(params) > 0 {
+		op["parameters"] = params
+	}
+	if r.Body != "" {
+		op["requestBody"] = fiber.Map{
+			"required": true,
+			"content":  fiber.Map{fiber.MIMEApplicationJSON: fiber.Map{"schema": schemaRef(r.Body)}},
+		}
+		responses["400"] = errorResponse("the request body is invalid")
+	}
+	if len(pathParams) > 0 {
+		responses["404"] = errorResponse("there is no such item")
+	}
+	return op
+}
+
+// operationID turns GET /users/:username/posts into getUsersUsernamePosts
+func operationID(r apiRoute) string {
+	id := strings.ToLower(r.Method)
+	for _, part := range strings.Split(r.Path, "/") {
+		part = strings.TrimPrefix(part, ":")
+		if part == "" {
+			continue
+		}
+		id += strings.ToUpper(part[:1]) + part[1:]
+	}
+	return id
+}
+
+func openAPIDocument(serverURL string) fiber.Map {
+	paths := fiber.Map{}
+	for _, r := range apiRoutes {
+		path := pathParamRe.ReplaceAllString(r.Path, "{$1}")
+		item, ok := paths[path].(fiber.Map)
+		if !ok {
+			item = fiber.Map{}
+			paths[path] = item
+		}
+		item[strings.ToLower(r.Method)] = openAPIOperation(r)
+	}
+	scopes := make([]string, 0, len(models.AccessTokenScopes))
+	for _, s := range models.AccessTokenScopes {
+		scopes = append(scopes, "`"+s+"` to "+models.ScopeDescriptions[s])
+	}
+	return fiber.Map{
+		"openapi": "3.0.3",
+		"info": fiber.Map{
+			"title":       "beeline API",
+			"version":     "1",
+			"description": "Create personal access tokens on the Access Tokens page of your settings and send them as `Authorization: Bearer <token>`. Errors are JSON with an error code and description.",
+		},
+		"servers": []fiber.Map{{"url": serverURL}},
+		"paths":   paths,
+		"components": fiber.Map{
+			"schemas": openAPISchemas,
+			"securitySchemes": fiber.Map{
+				"token": fiber.Map{
+					"type":        "http",
+					"scheme":      "bearer",
+					"description": "A personal access token, its scopes limit what it can do: " + strings.Join(scopes, ", ") + ".",
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,131 @@
+package handlers
+
+import (
+	"beeline/models"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// defaultPasteTitle is used for uploads that don't name themselves
+const defaultPasteTitle = "untitled"
+
+// UploadPaste creates a paste from the raw request body or a multipart upload
+// and answers with its url, so pasting from a terminal is just
+//
+//	curl -H "Authorization: Bearer $TOKEN" --data-binary @file.go /api/paste
+func UploadPaste(c *fiber.Ctx) error {
+	user, err := authenticateToken(c, models.ScopePastes)
+	if user == nil {
+		return err
+	}
+	title := c.Query("title")
+	var text []byte
+	if strings.HasPrefix(c.Get(fiber.HeaderContentType), fiber.MIMEMultipartForm) {
+		form, err := c.MultipartForm()
+		if err != nil {
+			return apiInvalid(c, "invalid multipart form")
+		}
+		if t := form.Value["title"]; len(t) > 0 && t[0] != "" {
+			title = t[0]
+		}
+		if files := form.File["file"]; len(files) > 0 {
+			if title == "" {
+				title = files[0].Filename
+			}
+			f, err := files[0].Open()
+			if err != nil {
+				log.Printf("UploadPaste: failed to open upload, error: %s", err.Error())
+				return apiInvalid(c, "could not read the uploaded file")
+			}
+			defer f.Close()
+			if text, err = io.ReadAll(f); err != nil {
+				return apiInvalid(c, "could not read the uploaded file")
+			}
+		} else if t := form.Value["text"]; len(t) > 0 {
+			text = []byte(t[0])
+		}
+	} else {
+		text = c.Body()
+	}
+	if len(text) == 0 {
+		return apiInvalid(c, "send the paste as the request body or as the file field of a multipart form")
+	}
+	if !utf8.Valid(text) {
+		return apiInvalid(c, "pastes must be UTF-8 text")
+	}
+	if title == "" {
+		title = defaultPasteTitle
+	}
+	p := &models.Paste{Title: title, Text: string(text), Username: user.Username}
+	if err := p.Validate(); err != nil {
+		return apiInvalid(c, err.Error())
+	}
+	getDB(c).NewPaste(p)
+	link := siteURL(c) + "/paste/" + strconv.FormatUint(uint64(p.ID), 10)
+	c.Location(link)
+	c.Status(fiber.StatusCreated)
+	if wantsJSON(c) {
+		return c.JSON(apiPasteJSON(c, *p))
+	}
+	return c.SendString(link + "\n")
+}
+
+// RawPaste serves just the text of a paste, ?download saves it as a file,
+// named by its value or after the paste. Apps can use an access token with
+// the pastes scope instead of a session.
+func RawPaste(c *fiber.Ctx) error {
+	user := currentUser(c)
+	byToken := c.Get(fiber.HeaderAuthorization) != ""
+	if byToken {
+		var err error
+		if user, err = authenticateToken(c, models.ScopePastes); user == nil {
+			return err
+		}
+	}
+	if user == nil {
+		return c.Redirect("/login")
+	}
+	id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+	var paste models.Paste
+	var ok bool
+	// Like the API, a token needs the admin scope to read other users' pastes
+	if user.IsAdmin() && (!byToken || tokenHasScope(c, models.ScopeAdmin)) {
+		paste, ok = getDB(c).GetAnyPaste(id)
+	} else {
+		paste, ok = getDB(c).GetPaste(user, id)
+	}
+	if !ok {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+	if c.Context().QueryArgs().Has("download") {
+		c.Attachment(downloadFilename(c.Query("download"), paste))
+	}
+	c.Set(fiber.HeaderContentType, fiber.MIMETextPlainCharsetUTF8)
+	return c.SendString(paste.Text)
+}
+
+// downloadFilename is the name asked for or one made from the paste's title,
+// without any directories
+func downloadFilename(name string, p models.Paste) string {
+	name = strings.TrimSpace(filepath.Base(strings.ReplaceAll(name, "\\", "/")))
+	if name == "" || name == "." || name == "/" {
+		name = filepath.Base(strings.ReplaceAll(strings.TrimSpace(p.Title), "\\", "/"))
+	}
+	if name == "" || name == "." || name == "/" || name == defaultPasteTitle {
+		name = fmt.Sprintf("paste-%d", p.ID)
+	}
+	if filepath.Ext(name) == "" {
+		name += ".txt"
+	}
+	return name
+}
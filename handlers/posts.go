@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"beeline/db"
+	"beeline/models"
+	"fmt"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// EditPostUI shows the edit form, only to the post's author
+func EditPostUI(c *fiber.Ctx) error {
+	user := currentUser(c)
+	id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+	post, ok := getDB(c).GetPost(id)
+	if !ok {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+	if !user.Owns(post.Username) {
+		return c.SendStatus(fiber.StatusForbidden)
+	}
+	return c.Render("views/edit-post", fiber.Map{
+		"Username": user.Username,
+		"IsAdmin":  user.IsAdmin(),
+		"Post":     post,
+	})
+}
+
+func EditPost(c *fiber.Ctx) error {
+	user := currentUser(c)
+	id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+	dbc := getDB(c)
+	post, ok := dbc.GetPost(id)
+	if !ok {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+	if !user.Owns(post.Username) {
+		return c.SendStatus(fiber.StatusForbidden)
+	}
+	oldMessage := post.Message
+	post.Message = c.FormValue("message")
+	if err := post.Validate(); err != nil {
+		return c.Render("views/edit-post", fiber.Map{
+			"Username": user.Username,
+			"IsAdmin":  user.IsAdmin(),
+			"Post":     post,
+			"Error":    err.Error(),
+		})
+	}
+	if !updatePost(c, dbc, user, post, oldMessage) {
+		return c.SendStatus(fiber.StatusForbidden)
+	}
+	return c.Redirect(fmt.Sprintf("/post/%d", id))
+}
+
+func DeletePost(c *fiber.Ctx) error {
+	user := currentUser(c)
+	id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+	dbc := getDB(c)
+	post, ok := dbc.GetPost(id)
+	if !ok {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+	if !removePost(dbc, user, post) {
+		return c.SendStatus(fiber.StatusForbidden)
+	}
+	if post.IsReply() {
+		return c.Redirect(fmt.Sprintf("/post/%d", post.ReplyToID))
+	}
+	return c.Redirect("/user/" + user.Username)
+}
+
+// PostHistory shows the earlier versions of an edited post to its author and
+// admins, an edit can take back something that shouldn't stay readable
+func PostHistory(c *fiber.Ctx) error {
+	user := currentUser(c)
+	id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+	dbc := getDB(c)
+	post, ok := dbc.GetPost(id)
+	if !ok {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+	if !user.Owns(post.Username) && !user.IsAdmin() {
+		return c.SendStatus(fiber.StatusForbidden)
+	}
+	return c.Render("views/post-history", fiber.Map{
+		"Username":    user.Username,
+		"IsAdmin":     user.IsAdmin(),
+		"CurrentUser": user,
+		"Post":        post,
+		"Revisions":   dbc.GetPostRevisions(post.ID),
+	})
+}
+
+// publishPost saves a new post and lets everyone who should know about it
+// know, here and on other sites
+func publishPost(c *fiber.Ctx, dbc *db.DB, user *models.User, post *models.Post) {
+	dbc.NewPost(post)
+	publishNotifications(dbc.NotifyPost(post))
+	federatePost(dbc, user, *post, "Create")
+	queueWebmentions(c, dbc, user, *post, "")
+}
+
+// updatePost saves the edited message of post, which was oldMessage before
+func updatePost(c *fiber.Ctx, dbc *db.DB, user *models.User, post models.Post, oldMessage string) bool {
+	// The author is checked again by the query itself
+	if !dbc.EditPost(uint64(post.ID), user.Username, post.Message) {
+		return false
+	}
+	if edited, ok := dbc.GetPost(uint64(post.ID)); ok {
+		federatePost(dbc, user, edited, "Update")
+		queueWebmentions(c, dbc, user, edited, oldMessage)
+	}
+	return true
+}
+
+func removePost(dbc *db.DB, user *models.User, post models.Post) bool {
+	if !user.Owns(post.Username) || !dbc.DeletePost(uint64(post.ID), user.Username) {
+		return false
+	}
+	federatePost(dbc, user, post, "Delete")
+	return true
+}
@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"beeline/models"
+	"fmt"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// recentReactionsLength is how many reactions to their posts a user sees on
+// their own page
+const recentReactionsLength = 10
+
+// React toggles the user's reaction on a post, htmx requests get back the
+// post's updated reactions
+func React(c *fiber.Ctx) error {
+	user := currentUser(c)
+	id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+	kind := c.FormValue("kind")
+	if !models.IsValidReactionKind(kind) {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+	dbc := getDB(c)
+	post, ok := dbc.GetPost(id)
+	if !ok {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+	dbc.ToggleReaction(post.ID, user.Username, kind)
+	if isHTMX(c) {
+		return c.Render("views/reactions", dbc.GetPostReactions(post, user))
+	}
+	return c.RedirectBack(fmt.Sprintf("/post/%d", post.ID))
+}
+
+// Reactions lists who reacted to a post
+func Reactions(c *fiber.Ctx) error {
+	user := currentUser(c)
+	id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+	dbc := getDB(c)
+	post, ok := dbc.GetPost(id)
+	if !ok {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+	return c.Render("views/reactions-list", fiber.Map{
+		"Username":    user.Username,
+		"IsAdmin":     user.IsAdmin(),
+		"CurrentUser": user,
+		"Post":        post,
+		"Reactions":   dbc.GetReactions(post.ID),
+	})
+}
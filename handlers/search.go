@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"beeline/activitypub"
+	"beeline/models"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const searchDateLayout = "2006-01-02"
+
+// Search finds posts and users, it responds with JSON when asked for with
+// ?format=json or an Accept header preferring application/json
+func Search(c *fiber.Ctx) error {
+	user := currentUser(c)
+	ps, err := postSearchFromQuery(c, user)
+	var posts []models.PostSearchResult
+	var users []models.User
+	if err == nil {
+		posts = getDB(c).SearchPosts(ps)
+		users = getDB(c).SearchUsers(ps.Query)
+	}
+
+	if wantsJSON(c) {
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.JSON(searchJSON(ps, posts, users))
+	}
+	// Searching for user@host offers to follow someone on another server
+	remoteHandle := ""
+	if federationURL != "" && activitypub.IsHandle(ps.Query) {
+		remoteHandle = strings.TrimPrefix(ps.Query, "@")
+	}
+	return c.Render("views/search", fiber.Map{
+		"RemoteHandle": remoteHandle,
+		"Username":     user.Username,
+		"IsAdmin":      user.IsAdmin(),
+		"CurrentUser":  user,
+		"Search":       ps,
+		"From":         c.Query("from"),
+		"To":           c.Query("to"),
+		"Posts":        posts,
+		"Users":        users,
+		"Error":        err,
+	})
+}
+
+// postSearchFromQuery reads the search filters, dates are whole days in the
+// user's timezone and the to date is inclusive
+func postSearchFromQuery(c *fiber.Ctx, user *models.User) (models.PostSearch, error) {
+	ps := models.PostSearch{
+		Query:     strings.TrimSpace(c.Query("q")),
+		Author:    strings.TrimPrefix(strings.TrimSpace(c.Query("author")), "@"),
+		Following: c.QueryBool("following"),
+		Viewer:    user,
+	}
+	if from := c.Query("from"); from != "" {
+		t, err := time.ParseInLocation(searchDateLayout, from, user.Location())
+		if err != nil {
+			return ps, fmt.Errorf("from date `%s` must look like %s", from, searchDateLayout)
+		}
+		ps.From = t
+	}
+	if to := c.Query("to"); to != "" {
+		t, err := time.ParseInLocation(searchDateLayout, to, user.Location())
+		if err != nil {
+			return ps, fmt.Errorf("to date `%s` must look like %s", to, searchDateLayout)
+		}
+		ps.To = t.AddDate(0, 0, 1)
+	}
+	if !ps.From.IsZero() && !ps.To.IsZero() && !ps.From.Before(ps.To) {
+		return ps, fmt.Errorf("from date must not be after the to date")
+	}
+	return ps, nil
+}
+
+func wantsJSON(c *fiber.Ctx) bool {
+	if c.Query("format") == "json" {
+		return true
+	}
+	return c.Accepts(fiber.MIMETextHTML, fiber.MIMEApplicationJSON) == fiber.MIMEApplicationJSON
+}
+
+func searchJSON(ps models.PostSearch, posts []models.PostSearchResult, users []models.User) fiber.Map {
+	jsonPosts := make([]fiber.Map, 0, len(posts))
+	for _, p := range posts {
+		jsonPosts = append(jsonPosts, fiber.Map{
+			"id":        p.ID,
+			"username":  p.Username,
+			"message":   p.Message,
+			"highlight": string(p.SnippetHTML()),
+			"timestamp": p.Timestamp,
+			"url":       fmt.Sprintf("/post/%d", p.ID),
+		})
+	}
+	jsonUsers := make([]fiber.Map, 0, len(users))
+	for _, u := range users {
+		jsonUsers = append(jsonUsers, fiber.Map{
+			"username": u.Username,
+			"url":      "/user/" + u.Username,
+		})
+	}
+	return fiber.Map{
+		"query":     ps.Query,
+		"author":    ps.Author,
+		"following": ps.Following,
+		"posts":     jsonPosts,
+		"users":     jsonUsers,
+	}
+}
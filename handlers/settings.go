@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"beeline/models"
+	"fmt"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func Settings(c *fiber.Ctx) error {
+	user := currentUser(c)
+	return renderSettings(c, user, fiber.Map{})
+}
+
+func SettingsPassword(c *fiber.Ctx) error {
+	user := currentUser(c)
+	currentPw := c.FormValue("current_password")
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(currentPw)); err != nil {
+		getDB(c).IncrementFailedLoginAttempts(user.Username)
+		return renderSettings(c, user, fiber.Map{"Error": "Current password is incorrect!"})
+	}
+	if err := changePassword(c, user); err != nil {
+		return renderSettings(c, user, fiber.Map{"Error": err.Error()})
+	}
+	return renderSettings(c, user, fiber.Map{"Success": "Password changed, all of your other sessions have been logged out!"})
+}
+
+func SettingsPreferences(c *fiber.Ctx) error {
+	user := currentUser(c)
+	tz := c.FormValue("timezone")
+	if tz != "" {
+		if _, err := time.LoadLocation(tz); err != nil {
+			return renderSettings(c, user, fiber.Map{"Error": fmt.Sprintf("unknown timezone `%s`", tz)})
+		}
+	}
+	df := c.FormValue("date_format")
+	if !models.IsValidDateFormat(df) {
+		return renderSettings(c, user, fiber.Map{"Error": fmt.Sprintf("unknown date format `%s`", df)})
+	}
+	feedsPrivate := c.FormValue("feeds_private") == "on"
+	getDB(c).UpdateUserPreferences(uint64(user.ID), tz, df, feedsPrivate)
+	user.Timezone = tz
+	user.DateFormat = df
+	user.FeedsPrivate = feedsPrivate
+	return renderSettings(c, user, fiber.Map{"Success": "Preferences saved!"})
+}
+
+func renderSettings(c *fiber.Ctx, user *models.User, m fiber.Map) error {
+	m["Username"] = user.Username
+	m["IsAdmin"] = user.IsAdmin()
+	m["CurrentUser"] = user
+	m["DateFormats"] = models.DateFormats
+	m["Now"] = time.Now()
+	return c.Render("views/settings", m)
+}
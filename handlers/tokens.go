@@ -0,0 +1,128 @@
+package handlers
+
+import (
+	"beeline/models"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func Tokens(c *fiber.Ctx) error {
+	return renderTokens(c, currentUser(c), fiber.Map{})
+}
+
+func NewToken(c *fiber.Ctx) error {
+	user := currentUser(c)
+	var scopes []string
+	for _, s := range models.AccessTokenScopes {
+		if c.FormValue("scope_"+s) == "on" {
+			scopes = append(scopes, s)
+		}
+	}
+	t := &models.AccessToken{
+		Username: user.Username,
+		Name:     strings.TrimSpace(c.FormValue("name")),
+		Scopes:   strings.Join(scopes, " "),
+	}
+	if err := t.Validate(); err != nil {
+		return renderTokens(c, user, fiber.Map{"Error": err.Error()})
+	}
+	token, ok := getDB(c).NewAccessToken(t)
+	if !ok {
+		return renderTokens(c, user, fiber.Map{"Error": "could not create the token"})
+	}
+	return renderTokens(c, user, fiber.Map{
+		"Success": "Token created! Copy it now, it will not be shown again.",
+		"Token":   token,
+	})
+}
+
+func RevokeToken(c *fiber.Ctx) error {
+	user := currentUser(c)
+	id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+	if err != nil {
+		log.Printf("RevokeToken: Params(id) was not uint, error: %s", err.Error())
+		return c.Redirect("/tokens")
+	}
+	if !getDB(c).RevokeAccessToken(user.Username, id) {
+		return renderTokens(c, user, fiber.Map{"Error": fmt.Sprintf("could not revoke token %d", id)})
+	}
+	return renderTokens(c, user, fiber.Map{"Success": fmt.Sprintf("Revoked token %d", id)})
+}
+
+func renderTokens(c *fiber.Ctx, user *models.User, m fiber.Map) error {
+	m["Username"] = user.Username
+	m["IsAdmin"] = user.IsAdmin()
+	m["CurrentUser"] = user
+	m["Tokens"] = getDB(c).GetAccessTokens(user.Username)
+	m["Scopes"] = models.AccessTokenScopes
+	m["ScopeDescriptions"] = models.ScopeDescriptions
+	return c.Render("views/tokens", m)
+}
+
+// bearerToken is the access token of a request sent by an app, from the
+// Authorization header or, for forms, the access_token field
+func bearerToken(c *fiber.Ctx) string {
+	if auth := c.Get(fiber.HeaderAuthorization); auth != "" {
+		scheme, token, ok := strings.Cut(auth, " ")
+		if !ok || !strings.EqualFold(scheme, "Bearer") {
+			return ""
+		}
+		return strings.TrimSpace(token)
+	}
+	if strings.HasPrefix(c.Get(fiber.HeaderContentType), fiber.MIMEApplicationForm) || strings.HasPrefix(c.Get(fiber.HeaderContentType), fiber.MIMEMultipartForm) {
+		return c.FormValue("access_token")
+	}
+	return ""
+}
+
+// tokenUser finds the user a request's access token belongs to
+func tokenUser(c *fiber.Ctx) (*models.User, *models.AccessToken, bool) {
+	dbc := getDB(c)
+	t, ok := dbc.GetAccessToken(bearerToken(c))
+	if !ok {
+		return nil, nil, false
+	}
+	user, ok := dbc.FindUser(t.Username)
+	if !ok {
+		return nil, nil, false
+	}
+	return user, t, true
+}
+
+// authenticateToken is the user of the request's access token, which must
+// have scope unless scope is empty. When there is no such user the JSON error
+// has already been sent.
+func authenticateToken(c *fiber.Ctx, scope string) (*models.User, error) {
+	user, t, ok := tokenUser(c)
+	if !ok {
+		return nil, jsonError(c, fiber.StatusUnauthorized, "unauthorized", "a valid access token is required")
+	}
+	if scope != "" && !t.HasScope(scope) {
+		return nil, jsonError(c, fiber.StatusForbidden, "insufficient_scope", fmt.Sprintf("the access token needs the %s scope", scope))
+	}
+	if user.MustChangePassword {
+		return nil, jsonError(c, fiber.StatusForbidden, "forbidden", "change your password before using this token")
+	}
+	c.Locals(tokenLocalsKey, t)
+	return user, nil
+}
+
+// tokenHasScope is true when the request was authenticated with an access
+// token that has scope
+func tokenHasScope(c *fiber.Ctx, scope string) bool {
+	t, _ := c.Locals(tokenLocalsKey).(*models.AccessToken)
+	return t != nil && t.HasScope(scope)
+}
+
+// jsonError is the error body of the API and Micropub, the code is one of
+// the OAuth 2.0 style codes like invalid_request or not_found
+func jsonError(c *fiber.Ctx, status int, code, description string) error {
+	if status == fiber.StatusUnauthorized {
+		c.Set(fiber.HeaderWWWAuthenticate, fmt.Sprintf(`Bearer error="%s"`, code))
+	}
+	return c.Status(status).JSON(fiber.Map{"error": code, "error_description": description})
+}
@@ -0,0 +1,192 @@
+package handlers
+
+import (
+	"beeline/models"
+	"beeline/totp"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const totpIssuer = "beeline"
+
+func LoginTOTPUI(c *fiber.Ctx) error {
+	if _, ok := getDB(c).GetLoginChallenge(c.Cookies("loginChallenge")); !ok {
+		return c.Redirect("/login")
+	}
+	return c.Render("views/login-2fa", fiber.Map{})
+}
+
+func LoginTOTP(c *fiber.Ctx) error {
+	dbc := getDB(c)
+	token := c.Cookies("loginChallenge")
+	lc, ok := dbc.GetLoginChallenge(token)
+	if !ok {
+		return c.Render("views/login", fiber.Map{
+			"Error": "Login expired, please try again!",
+		})
+	}
+	user, ok := dbc.FindUser(lc.Username)
+	if !ok {
+		dbc.DeleteLoginChallenge(token)
+		return c.Redirect("/login")
+	}
+	if user.FailedLoginAttempts > MaxFailedLoginAttempts {
+		log.Printf("user `%s` attempting 2fa with failed login attempts > MaxFailedLoginAttempts", user)
+		dbc.DeleteLoginChallenge(token)
+		c.ClearCookie("loginChallenge")
+		return c.Render("views/login", fiber.Map{
+			"Error": "Too many failed logins! Please contact server admin.",
+		})
+	}
+	if !checkSecondFactor(c, user) {
+		dbc.IncrementFailedLoginAttempts(user.Username)
+		return c.Render("views/login-2fa", fiber.Map{
+			"Error": "Invalid Code!",
+		})
+	}
+	dbc.DeleteLoginChallenge(token)
+	c.ClearCookie("loginChallenge")
+	dbc.ResetFailedLoginAttempts(user.Username)
+	startSession(c, user.Username)
+	if user.MustChangePassword {
+		return c.Redirect("/change-password")
+	}
+	return c.Redirect("/")
+}
+
+func TwoFactor(c *fiber.Ctx) error {
+	user := currentUser(c)
+	return c.Render("views/2fa", fiber.Map{
+		"Username":               user.Username,
+		"IsAdmin":                user.IsAdmin(),
+		"TOTPEnabled":            user.TOTPEnabled,
+		"RemainingRecoveryCodes": getDB(c).RemainingRecoveryCodes(user.Username),
+	})
+}
+
+func TwoFactorEnroll(c *fiber.Ctx) error {
+	user := currentUser(c)
+	if user.TOTPEnabled {
+		return c.Redirect("/2fa")
+	}
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		log.Printf("TwoFactorEnroll: error generating secret: %s", err.Error())
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	getDB(c).SetPendingTOTPSecret(user.Username, secret)
+	return renderTOTPEnroll(c, user, secret, "")
+}
+
+func TwoFactorConfirm(c *fiber.Ctx) error {
+	user := currentUser(c)
+	if user.TOTPEnabled || user.TOTPSecret == "" {
+		return c.Redirect("/2fa")
+	}
+	step, ok := totp.Validate(user.TOTPSecret, c.FormValue("code"), time.Now())
+	if !ok {
+		return renderTOTPEnroll(c, user, user.TOTPSecret, "Invalid Code! Check the time on your device and try again.")
+	}
+	dbc := getDB(c)
+	dbc.EnableTOTP(user.Username, step)
+	return c.Render("views/2fa", fiber.Map{
+		"Username":      user.Username,
+		"IsAdmin":       user.IsAdmin(),
+		"TOTPEnabled":   true,
+		"RecoveryCodes": dbc.NewRecoveryCodes(user.Username),
+		"Success":       "Two-factor authentication is now enabled!",
+	})
+}
+
+func TwoFactorRecoveryCodes(c *fiber.Ctx) error {
+	user := currentUser(c)
+	if !user.TOTPEnabled {
+		return c.Redirect("/2fa")
+	}
+	dbc := getDB(c)
+	if !checkSecondFactor(c, user) {
+		return c.Render("views/2fa", fiber.Map{
+			"Username":               user.Username,
+			"IsAdmin":                user.IsAdmin(),
+			"TOTPEnabled":            true,
+			"RemainingRecoveryCodes": dbc.RemainingRecoveryCodes(user.Username),
+			"Error":                  "Invalid Code!",
+		})
+	}
+	return c.Render("views/2fa", fiber.Map{
+		"Username":      user.Username,
+		"IsAdmin":       user.IsAdmin(),
+		"TOTPEnabled":   true,
+		"RecoveryCodes": dbc.NewRecoveryCodes(user.Username),
+		"Success":       "New recovery codes generated, the old ones no longer work!",
+	})
+}
+
+func TwoFactorDisable(c *fiber.Ctx) error {
+	user := currentUser(c)
+	if !user.TOTPEnabled {
+		return c.Redirect("/2fa")
+	}
+	dbc := getDB(c)
+	if !checkSecondFactor(c, user) {
+		return c.Render("views/2fa", fiber.Map{
+			"Username":               user.Username,
+			"IsAdmin":                user.IsAdmin(),
+			"TOTPEnabled":            true,
+			"RemainingRecoveryCodes": dbc.RemainingRecoveryCodes(user.Username),
+			"Error":                  "Invalid Code!",
+		})
+	}
+	dbc.DisableTOTP(user.Username)
+	return c.Render("views/2fa", fiber.Map{
+		"Username": user.Username,
+		"IsAdmin":  user.IsAdmin(),
+		"Success":  "Two-factor authentication is now disabled!",
+	})
+}
+
+func ResetUserTOTP(c *fiber.Ctx) error {
+	user := currentUser(c)
+	userId := c.Params("id")
+	dbc := getDB(c)
+	id, err := strconv.ParseUint(userId, 10, 64)
+	if err != nil {
+		allUsers := dbc.GetAllUsers()
+		return c.Render("views/users", fiber.Map{"IsAdmin": user.IsAdmin(), "Username": user.Username, "Users": allUsers, "Error": fmt.Sprintf("invalid user id %s", userId)})
+	}
+	userToReset := dbc.GetUser(id)
+	dbc.DisableTOTP(userToReset.Username)
+	allUsers := dbc.GetAllUsers()
+	successStr := fmt.Sprintf("Successfully Reset 2FA for User ID %s", userId)
+	return c.Render("views/users", fiber.Map{"IsAdmin": user.IsAdmin(), "Username": user.Username, "Users": allUsers, "Success": successStr})
+}
+
+func renderTOTPEnroll(c *fiber.Ctx, user *models.User, secret, errorString string) error {
+	return c.Render("views/2fa", fiber.Map{
+		"Username":   user.Username,
+		"IsAdmin":    user.IsAdmin(),
+		"Enrolling":  true,
+		"TOTPSecret": secret,
+		"TOTPURI":    totp.URI(totpIssuer, user.Username, secret),
+		"Error":      errorString,
+	})
+}
+
+// checkSecondFactor accepts either a TOTP code or an unused recovery code from
+// the "code" form value, each of them can only be used once
+func checkSecondFactor(c *fiber.Ctx, user *models.User) bool {
+	code := strings.TrimSpace(c.FormValue("code"))
+	if code == "" {
+		return false
+	}
+	dbc := getDB(c)
+	if step, ok := totp.Validate(user.TOTPSecret, code, time.Now()); ok {
+		return dbc.UseTOTPStep(user.Username, step)
+	}
+	return dbc.UseRecoveryCode(user.Username, code)
+}
@@ -0,0 +1,184 @@
+package handlers
+
+import (
+	"beeline/db"
+	"beeline/markup"
+	"beeline/models"
+	"beeline/webmention"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// webmentionPollInterval is how often the queue is checked for retries that
+// became due, new Webmentions wake the worker right away
+const webmentionPollInterval = 30 * time.Second
+
+var (
+	webmentionWake = make(chan struct{}, 1)
+	webmentionStop = make(chan struct{})
+	webmentionDone = make(chan struct{})
+)
+
+// StartWebmentions runs the worker that verifies received Webmentions and
+// sends ours, retrying the ones that fail
+func StartWebmentions(dbc *db.DB) {
+	go func() {
+		defer close(webmentionDone)
+		ticker := time.NewTicker(webmentionPollInterval)
+		defer ticker.Stop()
+		for {
+			processWebmentions(dbc)
+			select {
+			case <-webmentionWake:
+			case <-ticker.C:
+			case <-webmentionStop:
+				return
+			}
+		}
+	}()
+}
+
+// StopWebmentions waits for the worker to finish what it is doing, anything
+// left stays queued for the next start
+func StopWebmentions() {
+	close(webmentionStop)
+	<-webmentionDone
+}
+
+func wakeWebmentions() {
+	select {
+	case webmentionWake <- struct{}{}:
+	default:
+	}
+}
+
+func processWebmentions(dbc *db.DB) {
+	for _, w := range dbc.DueWebmentions() {
+		verifyWebmention(dbc, w)
+	}
+	for _, wd := range dbc.DueWebmentionDeliveries() {
+		sendWebmention(dbc, wd)
+	}
+}
+
+func verifyWebmention(dbc *db.DB, w models.Webmention) {
+	source, err := webmention.Verify(w.Source, w.Target)
+	if errors.Is(err, webmention.ErrGone) || errors.Is(err, webmention.ErrNoLink) {
+		dbc.RemoveWebmention(w.ID)
+		return
+	}
+	if err != nil {
+		dbc.RetryWebmention(w, err.Error())
+		return
+	}
+	dbc.VerifyWebmention(w.ID, source.Title)
+	w.Title = source.Title
+	if post, ok := dbc.GetPost(uint64(w.PostID)); ok {
+		publishNotifications(dbc.NotifyWebmention(&post, &w))
+	}
+}
+
+func sendWebmention(dbc *db.DB, wd models.WebmentionDelivery) {
+	endpoint, err := webmention.Discover(wd.Target)
+	if errors.Is(err, webmention.ErrNoEndpoint) {
+		dbc.FailWebmentionDelivery(wd.ID, err.Error())
+		return
+	}
+	if err == nil {
+		err = webmention.Send(endpoint, wd.Source, wd.Target)
+	}
+	if err != nil {
+		dbc.RetryWebmentionDelivery(wd, err.Error())
+		return
+	}
+	dbc.MarkWebmentionSent(wd.ID)
+}
+
+// siteURL is the public url of the site, the configured one when federating
+func siteURL(c *fiber.Ctx) string {
+	if federationURL != "" {
+		return federationURL
+	}
+	return c.BaseURL()
+}
+
+// ReceiveWebmention accepts a Webmention for one of our posts and queues it
+// to be verified
+func ReceiveWebmention(c *fiber.Ctx) error {
+	source := c.FormValue("source")
+	target := c.FormValue("target")
+	if !webmention.ValidURL(source) || !webmention.ValidURL(target) || source == target {
+		return c.Status(fiber.StatusBadRequest).SendString("source and target must be different http(s) urls")
+	}
+	post, ok := webmentionTarget(c, target)
+	if !ok {
+		return c.Status(fiber.StatusBadRequest).SendString("target is not a post on this site")
+	}
+	if !getDB(c).ReceiveWebmention(source, target, post.ID) {
+		return fiber.ErrInternalServerError
+	}
+	wakeWebmentions()
+	return c.Status(fiber.StatusAccepted).SendString("Webmention accepted, it shows up once verified")
+}
+
+// localPostID is the id of the post a url on this site points at
+func localPostID(c *fiber.Ctx, rawURL string) (uint64, bool) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return 0, false
+	}
+	site, err := url.Parse(siteURL(c))
+	if err != nil || !strings.EqualFold(u.Host, site.Host) || !strings.HasPrefix(u.Path, "/post/") {
+		return 0, false
+	}
+	id, err := strconv.ParseUint(strings.TrimPrefix(u.Path, "/post/"), 10, 64)
+	return id, err == nil
+}
+
+// webmentionTarget finds the public post a target url points at
+func webmentionTarget(c *fiber.Ctx, target string) (models.Post, bool) {
+	id, ok := localPostID(c, target)
+	if !ok {
+		return models.Post{}, false
+	}
+	dbc := getDB(c)
+	post, ok := dbc.GetPost(id)
+	if !ok || post.IsRemote() {
+		return models.Post{}, false
+	}
+	author, ok := dbc.FindUser(post.Username)
+	return post, ok && !author.FeedsPrivate
+}
+
+// queueWebmentions sends Webmentions to the external pages a post links to,
+// after an edit the pages only the old message linked to are told too
+func queueWebmentions(c *fiber.Ctx, dbc *db.DB, user *models.User, p models.Post, oldMessage string) {
+	if user.FeedsPrivate || p.IsRemote() {
+		return
+	}
+	site, err := url.Parse(siteURL(c))
+	if err != nil {
+		return
+	}
+	seen := map[string]bool{}
+	targets := []string{}
+	for _, link := range append(markup.ExternalLinks(p.Message), markup.ExternalLinks(oldMessage)...) {
+		u, err := url.Parse(link)
+		if err != nil || seen[link] || strings.EqualFold(u.Host, site.Host) {
+			continue
+		}
+		seen[link] = true
+		targets = append(targets, link)
+	}
+	if len(targets) == 0 {
+		return
+	}
+	dbc.QueueWebmentions(p.ID, fmt.Sprintf("%s/post/%d", site, p.ID), targets)
+	wakeWebmentions()
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"beeline/db"
 	"beeline/handlers"
+	"beeline/models"
+	"beeline/outbound"
 	"embed"
 	"fmt"
 	"log"
@@ -11,6 +13,8 @@ import (
 	"os/signal"
 	"syscall"
 	"time"
+	// embed timezone data so user timezones work on any host
+	_ "time/tzdata"
 
 	"github.com/gofiber/contrib/websocket"
 	"github.com/gofiber/fiber/v2"
@@ -31,6 +35,9 @@ var publicStaticDir embed.FS
 
 const DB_NAME = "beeline.db?_pragma=journal_mode(WAL)"
 
+// DEFAULT_ADDR is listened on unless BEELINE_ADDR is set
+const DEFAULT_ADDR = ":5961"
+
 type App struct {
 	app *fiber.App
 	dbc *db.DB
@@ -44,29 +51,45 @@ func NewApp() *App {
 	a := &App{
 		app: app,
 	}
+	// only for testing, lets local instances contact each other
+	if os.Getenv("BEELINE_ALLOW_PRIVATE_ADDRESSES") != "" {
+		outbound.AllowPrivateAddresses(true)
+	}
+	// federation needs to know the public url other servers reach us at
+	if u := os.Getenv("BEELINE_URL"); u != "" {
+		handlers.EnableFederation(u)
+	}
 	a.setupMiddlewareAndDbc()
 	a.setupRoutes()
 	return a
 }
 
 func (a *App) Run() {
+	addr := os.Getenv("BEELINE_ADDR")
+	if addr == "" {
+		addr = DEFAULT_ADDR
+	}
 	go func() {
-		if err := a.app.Listen(":5961"); err != nil {
+		if err := a.app.Listen(addr); err != nil {
 			log.Panic("error while listening: " + err.Error())
 		}
 	}()
 
+	handlers.StartWebmentions(a.dbc)
+
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 
 	<-c
 	fmt.Println("gracefully shutting down...")
+	handlers.CloseNotificationStreams()
 	if err := a.app.Shutdown(); err != nil {
 		log.Printf("FAILED to shutdown app, error: %s", err.Error())
 	}
+	handlers.StopWebmentions()
 
 	fmt.Println("running cleanup tasks...")
-	a.dbc.DeleteAllAuthIds()
+	a.dbc.DeleteAllSessions()
 	fmt.Println("shutdown complete!")
 }
 
@@ -75,7 +98,12 @@ func (a *App) setupMiddlewareAndDbc() {
 	a.app.Use(encryptcookie.New(encryptcookie.Config{
 		Key: encryptcookie.GenerateKey(),
 	}))
-	a.app.Use(compress.New())
+	a.app.Use(compress.New(compress.Config{
+		// Compressing would hold back the events of the notification stream
+		Next: func(c *fiber.Ctx) bool {
+			return c.Path() == "/notifications/stream"
+		},
+	}))
 	// use embedded public directory
 	a.app.Use("/public", filesystem.New(filesystem.Config{
 		Root:       http.FS(publicStaticDir),
@@ -88,23 +116,33 @@ func (a *App) setupMiddlewareAndDbc() {
 	}))
 
 	a.app.Use("/ws", func(c *fiber.Ctx) error {
-		if websocket.IsWebSocketUpgrade(c) {
-			return c.Next()
+		if !websocket.IsWebSocketUpgrade(c) {
+			return fiber.ErrUpgradeRequired
 		}
-		return fiber.ErrUpgradeRequired
+		// websockets are not covered by CSRF tokens so other sites must not be able to open them
+		if !handlers.IsSameOrigin(c) {
+			return fiber.ErrForbidden
+		}
+		return c.Next()
 	})
+	a.app.Use(handlers.CSRF())
+	a.app.Use(handlers.BindCSRFToken)
 
 	dbc, err := db.NewAndMigrate(DB_NAME)
 	if err != nil {
 		log.Fatal(err)
 	}
 	dbc.CreateAdmin()
+	handlers.WarnInvalidUsernames(dbc)
 	a.dbc = dbc
 	// store db connection in locals to be accessible by all reqs
 	a.app.Use(func(c *fiber.Ctx) error {
 		c.Locals("db", dbc)
 		return c.Next()
 	})
+	a.app.Use(handlers.Authenticate)
+	a.app.Use(handlers.RequirePasswordChange)
+	a.app.Use(handlers.BindNotifications)
 	// 1 req/s
 	a.app.Use(limiter.New(limiter.Config{
 		Expiration: time.Second,
@@ -112,31 +150,95 @@ func (a *App) setupMiddlewareAndDbc() {
 }
 
 func (a *App) setupRoutes() {
-	a.app.Get("/", handlers.Index)
-	a.app.Get("/signup", handlers.Signup)
+	user := handlers.RequireUser
+	admin := handlers.RequireAdmin
+
+	a.app.Get("/", user, handlers.Index)
+	a.app.Get("/signup", admin, handlers.Signup)
 	a.app.Get("/login", handlers.LoginUI)
-	a.app.Get("/logout", handlers.GetLogout)
-	a.app.Get("/user/:username", handlers.User)
-	a.app.Get("/users", handlers.Users)
-	a.app.Get("/monitor", handlers.Monitor())
+	a.app.Get("/logout", handlers.LogoutUI)
+	a.app.Get("/.well-known/webfinger", handlers.WebFinger)
+	// ActivityPub requests for users and posts are answered before logging in is required
+	a.app.Get("/user/:username", handlers.Actor, user, handlers.User)
+	a.app.Get("/user/:username/outbox", handlers.Outbox)
+	a.app.Get("/post/:id", handlers.NoteObject, handlers.Thread)
+	a.app.Get("/post/:id/reactions", user, handlers.Reactions)
+	a.app.Get("/post/:id/edit", user, handlers.EditPostUI)
+	a.app.Get("/post/:id/history", user, handlers.PostHistory)
+	a.app.Get("/user/:username/followers", handlers.FollowersCollection, user, handlers.Followers)
+	a.app.Get("/user/:username/following", user, handlers.Following)
+	a.app.Get("/users", admin, handlers.Users)
+	a.app.Get("/monitor", admin, handlers.Monitor())
 	a.app.Get("/all", handlers.All)
-	a.app.Get("/paste", handlers.Paste)
-	a.app.Get("/my-pastes", handlers.MyPastes)
-	a.app.Get("/paste/:id", handlers.GetPaste)
-
-	a.app.Post("/paste", handlers.NewPaste)
-	a.app.Post("/new-user", handlers.NewUser)
+	a.app.Get("/all/feed.atom", handlers.AllFeed)
+	a.app.Get("/user/:username/feed.atom", handlers.UserFeed(handlers.FeedAtom))
+	a.app.Get("/user/:username/feed.rss", handlers.UserFeed(handlers.FeedRSS))
+	a.app.Get("/search", user, handlers.Search)
+	a.app.Get("/notifications", user, handlers.Notifications)
+	a.app.Get("/notifications/stream", user, handlers.NotificationStream)
+	a.app.Get("/paste", user, handlers.Paste)
+	a.app.Get("/my-pastes", user, handlers.MyPastes)
+	a.app.Get("/paste/:id", user, handlers.GetPaste)
+	a.app.Get("/paste/:id/raw", handlers.RawPaste)
+	a.app.Get("/sessions", user, handlers.Sessions)
+	a.app.Get("/login/2fa", handlers.LoginTOTPUI)
+	a.app.Get("/2fa", user, handlers.TwoFactor)
+	a.app.Get("/change-password", user, handlers.ChangePasswordUI)
+	a.app.Get("/settings", user, handlers.Settings)
+	a.app.Get("/invites", user, handlers.Invites)
+	a.app.Get("/tokens", user, handlers.Tokens)
+	a.app.Get("/micropub", handlers.MicropubQuery)
+	a.app.Get("/invite/:token", handlers.InviteSignup)
+	a.app.Get("/site-settings", admin, handlers.SiteSettings)
+	a.app.Get("/trash", admin, handlers.Trash)
+
+	a.app.Post("/inbox", handlers.Inbox)
+	a.app.Post("/webmention", handlers.ReceiveWebmention)
+	a.app.Post("/user/:username/inbox", handlers.Inbox)
+	a.app.Post("/paste", user, handlers.NewPaste)
+	a.app.Post("/api/paste", handlers.UploadPaste)
+	a.app.Post("/new-user", admin, handlers.NewUser)
 	a.app.Post("/login", handlers.Login)
-	a.app.Post("/new-post", handlers.NewPost)
+	a.app.Post("/new-post", user, handlers.NewPost)
 	a.app.Post("/logout", handlers.Logout)
-	a.app.Post("/follow", handlers.Follow)
-	a.app.Post("/users/edit/:id", handlers.EditUser)
-
-	a.app.Get("/chat", handlers.Chat)
-	a.app.Post("/chat", handlers.ChatPost)
-	a.app.Get("/chat/:room", handlers.ChatRoom)
-
-	a.app.Get("/ws/chat/:room", handlers.WSChatRoom())
+	a.app.Post("/follow", user, handlers.Follow)
+	a.app.Post("/unfollow", user, handlers.Unfollow)
+	a.app.Post("/post/:id/react", user, handlers.React)
+	a.app.Post("/post/:id/edit", user, handlers.EditPost)
+	a.app.Post("/post/:id/delete", user, handlers.DeletePost)
+	a.app.Post("/notifications/read", user, handlers.ReadAllNotifications)
+	a.app.Post("/notifications/read/:id", user, handlers.ReadNotification)
+	a.app.Post("/users/edit/:id", admin, handlers.EditUser)
+	a.app.Post("/users/sessions/revoke/:id", admin, handlers.RevokeUserSessions)
+	a.app.Post("/sessions/revoke/:id", user, handlers.RevokeSession)
+	a.app.Post("/login/2fa", handlers.LoginTOTP)
+	a.app.Post("/change-password", user, handlers.ChangePassword)
+	a.app.Post("/settings/password", user, handlers.SettingsPassword)
+	a.app.Post("/settings/preferences", user, handlers.SettingsPreferences)
+	a.app.Post("/invites", user, handlers.NewInvite)
+	a.app.Post("/invites/revoke/:id", user, handlers.RevokeInvite)
+	a.app.Post("/tokens", user, handlers.NewToken)
+	a.app.Post("/tokens/revoke/:id", user, handlers.RevokeToken)
+	a.app.Post("/micropub", handlers.Micropub)
+	a.app.Post("/invite/:token", handlers.InviteNewUser)
+	a.app.Post("/site-settings", admin, handlers.EditSiteSettings)
+	a.app.Post("/moderation/:type/:id/delete", admin, handlers.Moderate(models.ModerationDelete))
+	a.app.Post("/moderation/:type/:id/restore", admin, handlers.Moderate(models.ModerationRestore))
+	a.app.Post("/moderation/:type/:id/purge", admin, handlers.Moderate(models.ModerationPurge))
+	a.app.Post("/2fa/enroll", user, handlers.TwoFactorEnroll)
+	a.app.Post("/2fa/confirm", user, handlers.TwoFactorConfirm)
+	a.app.Post("/2fa/recovery-codes", user, handlers.TwoFactorRecoveryCodes)
+	a.app.Post("/2fa/disable", user, handlers.TwoFactorDisable)
+	a.app.Post("/users/2fa/reset/:id", admin, handlers.ResetUserTOTP)
+
+	a.app.Get("/chat", user, handlers.Chat)
+	a.app.Post("/chat", user, handlers.ChatPost)
+	a.app.Get("/chat/:room", user, handlers.ChatRoom)
+	a.app.Post("/chat/:room/retention", admin, handlers.ChatRoomRetention)
+
+	a.app.Get("/ws/chat/:room", user, handlers.WSChatRoom())
+
+	handlers.RegisterAPI(a.app.Group(handlers.APIPrefix))
 }
 
 func main() {
@@ -0,0 +1,122 @@
+package markup
+
+import (
+	"html/template"
+	"regexp"
+	"strings"
+)
+
+var (
+	fenceRe       = regexp.MustCompile("^ {0,3}(```|~~~)\\s*([a-zA-Z0-9_+-]*)")
+	headingRe     = regexp.MustCompile(`^ {0,3}(#{1,6})\s+(.*?)\s*#*\s*$`)
+	ruleRe        = regexp.MustCompile(`^ {0,3}([-*_])(\s*[-*_]){2,}\s*$`)
+	quoteRe       = regexp.MustCompile(`^ {0,3}> ?(.*)$`)
+	bulletRe      = regexp.MustCompile(`^ {0,3}[-*+]\s+(.*)$`)
+	orderedItemRe = regexp.MustCompile(`^ {0,3}[0-9]{1,9}[.)]\s+(.*)$`)
+)
+
+// maxQuoteDepth stops deeply nested quotes from recursing forever
+const maxQuoteDepth = 8
+
+// renderBlocks renders the Markdown block structure of s: paragraphs,
+// headings, fenced code, quotes, lists and rules. Only tags written here are
+// ever output, the text inside them goes through renderInline.
+func renderBlocks(s string, opts options) string {
+	return renderLines(strings.Split(s, "\n"), opts, 0)
+}
+
+func renderLines(lines []string, opts options, depth int) string {
+	var sb strings.Builder
+	var paragraph []string
+	flush := func() {
+		if len(paragraph) == 0 {
+			return
+		}
+		rendered := make([]string, len(paragraph))
+		for i, line := range paragraph {
+			rendered[i] = renderInline(strings.TrimSpace(line), opts)
+		}
+		// Single line breaks are kept since posts are written like messages
+		sb.WriteString("<p>" + strings.Join(rendered, "<br>\n") + "</p>\n")
+		paragraph = nil
+	}
+
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		switch {
+		case strings.TrimSpace(line) == "":
+			flush()
+		case fenceRe.MatchString(line):
+			flush()
+			m := fenceRe.FindStringSubmatch(line)
+			var code []string
+			for i++; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), m[1]); i++ {
+				code = append(code, lines[i])
+			}
+			sb.WriteString("<pre><code")
+			if m[2] != "" {
+				sb.WriteString(` class="language-` + template.HTMLEscapeString(m[2]) + `"`)
+			}
+			sb.WriteString(">" + template.HTMLEscapeString(strings.Join(code, "\n")) + "</code></pre>\n")
+		case ruleRe.MatchString(line):
+			flush()
+			sb.WriteString("<hr>\n")
+		case headingRe.MatchString(line):
+			flush()
+			m := headingRe.FindStringSubmatch(line)
+			tag := "h" + string(rune('0'+len(m[1])))
+			sb.WriteString("<" + tag + ">" + renderInline(m[2], opts) + "</" + tag + ">\n")
+		case quoteRe.MatchString(line) && depth < maxQuoteDepth:
+			flush()
+			var quoted []string
+			for ; i < len(lines) && quoteRe.MatchString(lines[i]); i++ {
+				quoted = append(quoted, quoteRe.FindStringSubmatch(lines[i])[1])
+			}
+			i--
+			sb.WriteString("<blockquote>\n" + renderLines(quoted, opts, depth+1) + "</blockquote>\n")
+		case bulletRe.MatchString(line):
+			flush()
+			i = renderList(&sb, lines, i, bulletRe, "ul", opts)
+		case orderedItemRe.MatchString(line):
+			flush()
+			i = renderList(&sb, lines, i, orderedItemRe, "ol", opts)
+		default:
+			paragraph = append(paragraph, line)
+		}
+	}
+	flush()
+	return sb.String()
+}
+
+// renderList renders the list starting at lines[i] and returns the index of
+// its last line. Lines following an item without a marker continue it.
+func renderList(sb *strings.Builder, lines []string, i int, itemRe *regexp.Regexp, tag string, opts options) int {
+	var items [][]string
+	for ; i < len(lines); i++ {
+		line := lines[i]
+		if m := itemRe.FindStringSubmatch(line); m != nil {
+			items = append(items, []string{m[1]})
+			continue
+		}
+		if strings.TrimSpace(line) == "" || startsBlock(line) {
+			break
+		}
+		last := len(items) - 1
+		items[last] = append(items[last], strings.TrimSpace(line))
+	}
+	sb.WriteString("<" + tag + ">\n")
+	for _, item := range items {
+		rendered := make([]string, len(item))
+		for j, line := range item {
+			rendered[j] = renderInline(line, opts)
+		}
+		sb.WriteString("<li>" + strings.Join(rendered, "<br>\n") + "</li>\n")
+	}
+	sb.WriteString("</" + tag + ">\n")
+	return i - 1
+}
+
+func startsBlock(line string) bool {
+	return fenceRe.MatchString(line) || headingRe.MatchString(line) || ruleRe.MatchString(line) ||
+		quoteRe.MatchString(line) || bulletRe.MatchString(line) || orderedItemRe.MatchString(line)
+}
@@ -0,0 +1,171 @@
+package markup
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDocument(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			name: "paragraphs and line breaks",
+			in:   "one\ntwo\n\nthree",
+			want: "<p>one<br>\ntwo</p>\n<p>three</p>\n",
+		},
+		{
+			name: "raw html",
+			in:   "<div onclick=\"alert(1)\">hi</div>\n<script>alert(1)</script>",
+			want: "<p>&lt;div onclick=&#34;alert(1)&#34;&gt;hi&lt;/div&gt;<br>\n&lt;script&gt;alert(1)&lt;/script&gt;</p>\n",
+		},
+		{
+			name: "fenced code",
+			in:   "```\n<b>x</b>\n**y**\n```",
+			want: "<pre><code>&lt;b&gt;x&lt;/b&gt;\n**y**</code></pre>\n",
+		},
+		{
+			name: "fenced code with info string",
+			in:   "```go\nfunc main() {}\n```",
+			want: "<pre><code class=\"language-go\">func main() {}</code></pre>\n",
+		},
+		{
+			name: "tilde fence with info string",
+			in:   "~~~c++\nint x;\n~~~",
+			want: "<pre><code class=\"language-c++\">int x;</code></pre>\n",
+		},
+		{
+			name: "info string can't break out of the class",
+			in:   "```js\" onmouseover=\"alert(1)\nx\n```",
+			want: "<pre><code class=\"language-js\">x</code></pre>\n",
+		},
+		{
+			name: "info string with markup",
+			in:   "```<script>\nx\n```",
+			want: "<pre><code>x</code></pre>\n",
+		},
+		{
+			name: "unclosed fence runs to the end",
+			in:   "```\na\n\nb",
+			want: "<pre><code>a\n\nb</code></pre>\n",
+		},
+		{
+			name: "headings",
+			in:   "# One\n## Two ##\n###### Six\n####### Seven",
+			want: "<h1>One</h1>\n<h2>Two</h2>\n<h6>Six</h6>\n<p>####### Seven</p>\n",
+		},
+		{
+			name: "heading needs a space",
+			in:   "#nospace",
+			want: "<p>#nospace</p>\n",
+		},
+		{
+			name: "html in heading",
+			in:   "# <img src=x onerror=alert(1)>",
+			want: "<h1>&lt;img src=x onerror=alert(1)&gt;</h1>\n",
+		},
+		{
+			name: "rule",
+			in:   "a\n\n---\n\nb",
+			want: "<p>a</p>\n<hr>\n<p>b</p>\n",
+		},
+		{
+			name: "blockquote",
+			in:   "> quoted\n> more",
+			want: "<blockquote>\n<p>quoted<br>\nmore</p>\n</blockquote>\n",
+		},
+		{
+			name: "nested blockquotes",
+			in:   "> outer\n>> inner\n> > also inner",
+			want: "<blockquote>\n<p>outer</p>\n<blockquote>\n<p>inner<br>\nalso inner</p>\n</blockquote>\n</blockquote>\n",
+		},
+		{
+			name: "blocks inside a blockquote",
+			in:   "> # Title\n> - item",
+			want: "<blockquote>\n<h1>Title</h1>\n<ul>\n<li>item</li>\n</ul>\n</blockquote>\n",
+		},
+		{
+			name: "html in a blockquote",
+			in:   "> <script>alert(1)</script>",
+			want: "<blockquote>\n<p>&lt;script&gt;alert(1)&lt;/script&gt;</p>\n</blockquote>\n",
+		},
+		{
+			name: "bullet list",
+			in:   "- one\n* two\n+ three",
+			want: "<ul>\n<li>one</li>\n<li>two</li>\n<li>three</li>\n</ul>\n",
+		},
+		{
+			name: "ordered list",
+			in:   "1. one\n2) two",
+			want: "<ol>\n<li>one</li>\n<li>two</li>\n</ol>\n",
+		},
+		{
+			name: "list item continues on the next line",
+			in:   "- one\n  still one\n- two\n\nafter",
+			want: "<ul>\n<li>one<br>\nstill one</li>\n<li>two</li>\n</ul>\n<p>after</p>\n",
+		},
+		{
+			name: "list ends at another block",
+			in:   "- item\n# Heading",
+			want: "<ul>\n<li>item</li>\n</ul>\n<h1>Heading</h1>\n",
+		},
+		{
+			name: "html in list items",
+			in:   "- <b>bold</b>\n1. </li></ul><script>",
+			want: "<ul>\n<li>&lt;b&gt;bold&lt;/b&gt;</li>\n</ul>\n<ol>\n<li>&lt;/li&gt;&lt;/ul&gt;&lt;script&gt;</li>\n</ol>\n",
+		},
+		{
+			name: "html in link text",
+			in:   "[<script>alert(1)</script>](https://example.com)",
+			want: "<p><a href=\"https://example.com\" rel=\"nofollow noopener noreferrer\" target=\"_blank\">&lt;script&gt;alert(1)&lt;/script&gt;</a></p>\n",
+		},
+		{
+			name: "html in code span",
+			in:   "use `<br>` here",
+			want: "<p>use <code>&lt;br&gt;</code> here</p>\n",
+		},
+		{
+			name: "javascript link in a list",
+			in:   "- [x](javascript:alert%281%29)",
+			want: "<ul>\n<li>[x](javascript:alert%281%29)</li>\n</ul>\n",
+		},
+		{
+			name: "no hashtags or mentions in documents",
+			in:   "#tag @alice",
+			want: "<p>#tag @alice</p>\n",
+		},
+		{
+			name: "windows line endings",
+			in:   "# Title\r\n\r\ntext",
+			want: "<h1>Title</h1>\n<p>text</p>\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(Document(tt.in)); got != tt.want {
+				t.Errorf("Document(%q)\n got: %q\nwant: %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPostLinksHashtagsAndMentions(t *testing.T) {
+	got := string(Post("# Hi #beeline\n- ping @alice"))
+	want := "<h1>Hi <a href=\"/search?q=%23beeline\">#beeline</a></h1>\n<ul>\n<li>ping <a href=\"/user/alice\">@alice</a></li>\n</ul>\n"
+	if got != want {
+		t.Errorf("Post()\n got: %q\nwant: %q", got, want)
+	}
+}
+
+func TestDeeplyNestedQuotes(t *testing.T) {
+	in := strings.Repeat(">", 1000) + " deep"
+	got := string(Document(in))
+	if n := strings.Count(got, "<blockquote>"); n != maxQuoteDepth {
+		t.Errorf("Document() nested %d blockquotes, want %d", n, maxQuoteDepth)
+	}
+	if strings.Count(got, "<blockquote>") != strings.Count(got, "</blockquote>") {
+		t.Errorf("Document() left blockquotes open: %s", got)
+	}
+}
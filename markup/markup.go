@@ -0,0 +1,274 @@
+// Package markup turns user written text into safe HTML. Everything is HTML
+// escaped first and only a small set of formatting is turned back into tags,
+// so no markup from the user ever reaches the page. Posts and pastes support
+// a Markdown subset, chat messages only the inline formatting.
+package markup
+
+import (
+	"html"
+	"html/template"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	codeSpanRe = regexp.MustCompile("``([^\n]+?)``|`([^`\n]+)`")
+	mdLinkRe   = regexp.MustCompile(`\[([^\[\]\n]+)\]\(([^()\s]+)\)`)
+	autoLinkRe = regexp.MustCompile(`<(https?://[^\s<>]+)>`)
+	linkRe     = regexp.MustCompile(`https?://[^\s<>"'\x01` + "`" + `]+`)
+	strongRe   = regexp.MustCompile(`\*\*([^*\s](?:[^*]*[^*\s])?)\*\*`)
+	emRe       = regexp.MustCompile(`\*([^*\s](?:[^*]*[^*\s])?)\*`)
+	underEmRe  = regexp.MustCompile(`(^|[^\p{L}\p{N}_])_([^_\s](?:[^_]*[^_\s])?)_($|[^\p{L}\p{N}_])`)
+	delRe      = regexp.MustCompile(`~~([^~\s](?:[^~]*[^~\s])?)~~`)
+	// Neither & nor ; may come before a hashtag or mention so escaped text
+	// like &#39; matches the same as the raw text it came from
+	hashtagRe = regexp.MustCompile(`(^|[^\p{L}\p{N}_&;/#@])#([\p{L}\p{N}_]{1,64})`)
+	mentionRe = regexp.MustCompile(`(^|[^\p{L}\p{N}_&;/#@])@([a-zA-Z0-9]{3,255})`)
+	// placeholderRe finds the already rendered pieces stashed by renderInline
+	placeholderRe = regexp.MustCompile("\x01([0-9]+)\x01")
+)
+
+// options picks which extras are linked besides the formatting every text gets
+type options struct {
+	hashtags bool
+	mentions bool
+}
+
+var (
+	chatOptions     = options{mentions: true}
+	postOptions     = options{hashtags: true, mentions: true}
+	documentOptions = options{}
+)
+
+// Inline formats a single line of text such as a chat message. It supports
+// `code spans`, links, **strong**, *emphasis*, ~~strikethrough~~ and @mentions.
+func Inline(s string) template.HTML {
+	return template.HTML(renderInline(sanitize(s), chatOptions))
+}
+
+// Post formats the Markdown message of a post, linking its #hashtags to
+// search and its @mentions to the mentioned user
+func Post(s string) template.HTML {
+	return template.HTML(renderBlocks(sanitize(s), postOptions))
+}
+
+// Document formats Markdown such as a paste, without hashtags or mentions
+func Document(s string) template.HTML {
+	return template.HTML(renderBlocks(sanitize(s), documentOptions))
+}
+
+// sanitize drops the control character renderInline uses for its
+// placeholders and normalizes line endings
+func sanitize(s string) string {
+	s = strings.ReplaceAll(s, "\x01", "")
+	return strings.ReplaceAll(s, "\r\n", "\n")
+}
+
+// renderInline escapes s and formats it. Code spans and links are rendered
+// first and stashed behind placeholders, then the rest is escaped so the
+// emphasis, hashtag and mention patterns only ever see escaped text.
+func renderInline(s string, opts options) string {
+	var stash []string
+	put := func(html string) string {
+		stash = append(stash, html)
+		return "\x01" + strconv.Itoa(len(stash)-1) + "\x01"
+	}
+	s = codeSpanRe.ReplaceAllStringFunc(s, func(m string) string {
+		sub := codeSpanRe.FindStringSubmatch(m)
+		return put("<code>" + template.HTMLEscapeString(strings.TrimSpace(sub[1]+sub[2])) + "</code>")
+	})
+	s = mdLinkRe.ReplaceAllStringFunc(s, func(m string) string {
+		sub := mdLinkRe.FindStringSubmatch(m)
+		href, ok := safeURL(sub[2])
+		if !ok {
+			return m
+		}
+		// Link text gets formatting but never another link
+		text := formatText(sub[1], options{})
+		return put(anchor(href, text))
+	})
+	s = autoLinkRe.ReplaceAllStringFunc(s, func(m string) string {
+		return put(Link(m[1 : len(m)-1]))
+	})
+	s = linkRe.ReplaceAllStringFunc(s, func(m string) string {
+		link := trimLinkPunctuation(m)
+		return put(Link(link)) + m[len(link):]
+	})
+	s = formatText(s, opts)
+	// Stashed pieces never contain placeholders so one pass restores them all
+	return placeholderRe.ReplaceAllStringFunc(s, func(m string) string {
+		i, err := strconv.Atoi(m[1 : len(m)-1])
+		if err != nil || i >= len(stash) {
+			return ""
+		}
+		return stash[i]
+	})
+}
+
+// formatText escapes s and adds emphasis, hashtags and mentions
+func formatText(s string, opts options) string {
+	escaped := template.HTMLEscapeString(s)
+	escaped = strongRe.ReplaceAllString(escaped, "<strong>$1</strong>")
+	escaped = emRe.ReplaceAllString(escaped, "<em>$1</em>")
+	escaped = underEmRe.ReplaceAllString(escaped, "$1<em>$2</em>$3")
+	escaped = delRe.ReplaceAllString(escaped, "<del>$1</del>")
+	if opts.hashtags {
+		escaped = hashtagRe.ReplaceAllStringFunc(escaped, func(m string) string {
+			i := strings.LastIndexByte(m, '#')
+			return m[:i] + hashtagLink(m[i+1:])
+		})
+	}
+	if opts.mentions {
+		escaped = mentionRe.ReplaceAllStringFunc(escaped, func(m string) string {
+			i := strings.LastIndexByte(m, '@')
+			return m[:i] + mentionLink(m[i+1:])
+		})
+	}
+	return escaped
+}
+
+// Mentions returns the distinct @usernames mentioned in s
+func Mentions(s string) []string {
+	var usernames []string
+	seen := make(map[string]bool)
+	for _, m := range mentionRe.FindAllStringSubmatch(s, -1) {
+		if !seen[m[2]] {
+			seen[m[2]] = true
+			usernames = append(usernames, m[2])
+		}
+	}
+	return usernames
+}
+
+// mentionLink links to the profile of username, which is always alphanumeric
+func mentionLink(username string) string {
+	return `<a href="/user/` + username + `">@` + username + `</a>`
+}
+
+// hashtagLink links to the search for tag, tag is already escaped
+func hashtagLink(tag string) string {
+	return `<a href="/search?q=` + url.QueryEscape("#"+strings.ToLower(tag)) + `">#` + tag + `</a>`
+}
+
+// Hashtags returns the distinct lowercased #hashtags in s
+func Hashtags(s string) []string {
+	var tags []string
+	seen := make(map[string]bool)
+	for _, m := range hashtagRe.FindAllStringSubmatch(s, -1) {
+		tag := strings.ToLower(m[2])
+		if !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// Link returns an escaped anchor for rawURL, anything that is not an absolute
+// http(s) url is returned as escaped text instead
+func Link(rawURL string) string {
+	href, ok := safeURL(rawURL)
+	if !ok || !strings.HasPrefix(href, "http") {
+		return template.HTMLEscapeString(rawURL)
+	}
+	return anchor(href, template.HTMLEscapeString(rawURL))
+}
+
+// safeURL allows absolute http(s) urls and paths on this site, nothing else
+// such as javascript: can end up in a href
+func safeURL(rawURL string) (string, bool) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", false
+	}
+	if u.Scheme == "http" || u.Scheme == "https" {
+		return u.String(), u.Host != ""
+	}
+	if u.Scheme == "" && u.Host == "" && strings.HasPrefix(rawURL, "/") && !strings.HasPrefix(rawURL, "//") {
+		return u.String(), true
+	}
+	return "", false
+}
+
+// anchor links to href with the already escaped html as its text, external
+// links don't pass on the page or ranking
+func anchor(href, html string) string {
+	if strings.HasPrefix(href, "/") {
+		return `<a href="` + template.HTMLEscapeString(href) + `">` + html + `</a>`
+	}
+	return `<a href="` + template.HTMLEscapeString(href) + `" rel="nofollow noopener noreferrer" target="_blank">` + html + `</a>`
+}
+
+// trimLinkPunctuation drops punctuation that usually ends a sentence rather
+// than the link, like the period after "see https://example.com."
+func trimLinkPunctuation(link string) string {
+	for len(link) > 0 {
+		last := link[len(link)-1]
+		if strings.IndexByte(".,;:!?*~", last) >= 0 {
+			link = link[:len(link)-1]
+			continue
+		}
+		if last == ')' && strings.Count(link, "(") < strings.Count(link, ")") {
+			link = link[:len(link)-1]
+			continue
+		}
+		break
+	}
+	return link
+}
+
+// Markers wrapped around matched terms by search queries, they are control
+// characters so they can't be typed into a form and survive escaping as is.
+const (
+	HighlightStart = "\x02"
+	HighlightEnd   = "\x03"
+)
+
+// Highlight escapes s and turns the search markers into <mark> tags
+func Highlight(s string) template.HTML {
+	escaped := template.HTMLEscapeString(s)
+	var sb strings.Builder
+	open := false
+	for _, r := range escaped {
+		switch {
+		case string(r) == HighlightStart && !open:
+			sb.WriteString("<mark>")
+			open = true
+		case string(r) == HighlightEnd && open:
+			sb.WriteString("</mark>")
+			open = false
+		case string(r) == HighlightStart || string(r) == HighlightEnd:
+		default:
+			sb.WriteRune(r)
+		}
+	}
+	if open {
+		sb.WriteString("</mark>")
+	}
+	return template.HTML(sb.String())
+}
+
+var externalHrefRe = regexp.MustCompile(`<a href="(https?://[^"]+)" rel="nofollow`)
+
+// ExternalLinks lists the distinct external urls a post links to, exactly
+// the ones Post turns into links
+func ExternalLinks(s string) []string {
+	seen := map[string]bool{}
+	links := []string{}
+	for _, m := range externalHrefRe.FindAllStringSubmatch(string(Post(s)), -1) {
+		link := html.UnescapeString(m[1])
+		if !seen[link] {
+			seen[link] = true
+			links = append(links, link)
+		}
+	}
+	return links
+}
+
+// AbsoluteLinks points the site relative links in rendered html at base, for
+// html read somewhere else like feed readers and other servers
+func AbsoluteLinks(rendered, base string) string {
+	return strings.ReplaceAll(rendered, `href="/`, `href="`+base+`/`)
+}
@@ -0,0 +1,205 @@
+package markup
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestInline(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			name: "plain text",
+			in:   "hello there",
+			want: "hello there",
+		},
+		{
+			name: "script tag",
+			in:   "<script>alert(1)</script>",
+			want: "&lt;script&gt;alert(1)&lt;/script&gt;",
+		},
+		{
+			name: "event handler attribute",
+			in:   `<img src=x onerror="alert(1)">`,
+			want: "&lt;img src=x onerror=&#34;alert(1)&#34;&gt;",
+		},
+		{
+			name: "formatting",
+			in:   "**bold** *em* _em_ ~~gone~~",
+			want: "<strong>bold</strong> <em>em</em> <em>em</em> <del>gone</del>",
+		},
+		{
+			name: "formatting around html",
+			in:   "**<b>x</b>**",
+			want: "<strong>&lt;b&gt;x&lt;/b&gt;</strong>",
+		},
+		{
+			name: "bare link",
+			in:   "see https://example.com/a?b=1&c=2.",
+			want: `see <a href="https://example.com/a?b=1&amp;c=2" rel="nofollow noopener noreferrer" target="_blank">https://example.com/a?b=1&amp;c=2</a>.`,
+		},
+		{
+			name: "markdown link",
+			in:   "[docs](https://example.com/docs)",
+			want: `<a href="https://example.com/docs" rel="nofollow noopener noreferrer" target="_blank">docs</a>`,
+		},
+		{
+			name: "site relative link",
+			in:   "[me](/user/alice)",
+			want: `<a href="/user/alice">me</a>`,
+		},
+		{
+			name: "javascript link",
+			in:   "[click](javascript:alert%281%29)",
+			want: "[click](javascript:alert%281%29)",
+		},
+		{
+			name: "javascript link with mixed case",
+			in:   "[click](JaVaScRiPt:alert%281%29)",
+			want: "[click](JaVaScRiPt:alert%281%29)",
+		},
+		{
+			name: "data link",
+			in:   "[click](data:text/html;base64,PHNjcmlwdD4=)",
+			want: "[click](data:text/html;base64,PHNjcmlwdD4=)",
+		},
+		{
+			name: "protocol relative link",
+			in:   "[click](//evil.example/x)",
+			want: "[click](//evil.example/x)",
+		},
+		{
+			name: "javascript autolink",
+			in:   "<javascript:alert(1)>",
+			want: "&lt;javascript:alert(1)&gt;",
+		},
+		{
+			name: "double quote ends a bare link",
+			in:   `https://example.com/"onmouseover="alert(1)`,
+			want: `<a href="https://example.com/" rel="nofollow noopener noreferrer" target="_blank">https://example.com/</a>&#34;onmouseover=&#34;alert(1)`,
+		},
+		{
+			name: "single quote ends a bare link",
+			in:   `https://example.com/'onmouseover='alert(1)`,
+			want: `<a href="https://example.com/" rel="nofollow noopener noreferrer" target="_blank">https://example.com/</a>&#39;onmouseover=&#39;alert(1)`,
+		},
+		{
+			name: "double quote in a markdown link",
+			in:   `[x](https://example.com/a"onclick="b)`,
+			want: `<a href="https://example.com/a%22onclick=%22b" rel="nofollow noopener noreferrer" target="_blank">x</a>`,
+		},
+		{
+			name: "angle brackets in a markdown link",
+			in:   `[x](https://example.com/"><script>)`,
+			want: `<a href="https://example.com/%22%3E%3Cscript%3E" rel="nofollow noopener noreferrer" target="_blank">x</a>`,
+		},
+		{
+			name: "html in link text",
+			in:   "[<img src=x onerror=alert(1)>](https://example.com)",
+			want: `<a href="https://example.com" rel="nofollow noopener noreferrer" target="_blank">&lt;img src=x onerror=alert(1)&gt;</a>`,
+		},
+		{
+			name: "formatting in link text",
+			in:   "[**big**](https://example.com)",
+			want: `<a href="https://example.com" rel="nofollow noopener noreferrer" target="_blank"><strong>big</strong></a>`,
+		},
+		{
+			name: "html in code span",
+			in:   "`<script>alert(1)</script>`",
+			want: "<code>&lt;script&gt;alert(1)&lt;/script&gt;</code>",
+		},
+		{
+			name: "no formatting or links in code span",
+			in:   "`**x** https://example.com`",
+			want: "<code>**x** https://example.com</code>",
+		},
+		{
+			name: "double backtick code span",
+			in:   "``a ` b``",
+			want: "<code>a ` b</code>",
+		},
+		{
+			name: "mention",
+			in:   "hi @alice",
+			want: `hi <a href="/user/alice">@alice</a>`,
+		},
+		{
+			name: "mention with html after it",
+			in:   "@alice<script>",
+			want: `<a href="/user/alice">@alice</a>&lt;script&gt;`,
+		},
+		{
+			name: "no hashtags in chat",
+			in:   "#beeline",
+			want: "#beeline",
+		},
+		{
+			name: "escaped quote is not a hashtag or mention",
+			in:   "it's",
+			want: "it&#39;s",
+		},
+		{
+			name: "placeholder character is dropped",
+			in:   "a\x010\x01b",
+			want: "a0b",
+		},
+		{
+			name: "placeholder character can't pull in stashed html",
+			in:   "`code` \x010\x01 \x011\x01",
+			want: "<code>code</code> 0 1",
+		},
+		{
+			name: "placeholder character next to a link",
+			in:   "https://example.com/\x010\x01",
+			want: `<a href="https://example.com/0" rel="nofollow noopener noreferrer" target="_blank">https://example.com/0</a>`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(Inline(tt.in)); got != tt.want {
+				t.Errorf("Inline(%q)\n got: %s\nwant: %s", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestInlineNeverLeaksTags checks that none of the markup in the payloads
+// survives as a tag, whatever formatting surrounds it
+func TestInlineNeverLeaksTags(t *testing.T) {
+	payloads := []string{
+		"<script>alert(1)</script>",
+		"<svg onload=alert(1)>",
+		`"><script>alert(1)</script>`,
+		`'><img src=x onerror=alert(1)>`,
+		"</p><p>",
+	}
+	wrappers := []string{
+		"%s",
+		"**%s**",
+		"*%s*",
+		"~~%s~~",
+		"`%s`",
+		"[%s](https://example.com)",
+		"https://example.com/%s",
+		"<https://example.com/%s>",
+		"@alice%s",
+		"\x010\x01%s\x010\x01",
+	}
+	for _, p := range payloads {
+		for _, w := range wrappers {
+			in := strings.ReplaceAll(w, "%s", p)
+			got := string(Inline(in))
+			for _, tag := range []string{"<script", "<svg", "<img", "<p>", "</p>"} {
+				if strings.Contains(got, tag) {
+					t.Errorf("Inline(%q) = %s, contains the tag %s", in, got, tag)
+				}
+			}
+			if strings.Contains(got, "\x01") {
+				t.Errorf("Inline(%q) = %q, contains a placeholder", in, got)
+			}
+		}
+	}
+}
@@ -1,8 +1,14 @@
 package models
 
 import (
+	"beeline/markup"
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"html/template"
+	"log"
+	"net/url"
+	"strings"
 	"time"
 
 	"gorm.io/gorm"
@@ -15,6 +21,29 @@ type User struct {
 	Admin    bool
 
 	FailedLoginAttempts int
+	// InvitedBy and InviteID are set for users that signed up with an invite
+	InvitedBy string
+	InviteID  uint
+	// MustChangePassword is set for temporary passwords, the user cannot do
+	// anything else until they pick a new one
+	MustChangePassword bool
+
+	// Timezone is an IANA name, empty means the server's timezone
+	Timezone string
+	// DateFormat is the Name of one of the DateFormats
+	DateFormat string
+	// FeedsPrivate keeps the user's posts out of the public Atom and RSS feeds
+	FeedsPrivate bool
+
+	// TOTPSecret is set during enrollment but only used once TOTPEnabled
+	TOTPSecret   string
+	TOTPEnabled  bool
+	TOTPLastStep int64
+
+	// The key pair the user's ActivityPub requests are signed with, created
+	// the first time it is needed
+	PrivateKeyPEM string `gorm:"default:''"`
+	PublicKeyPEM  string
 }
 
 func (u User) String() string {
@@ -25,36 +54,417 @@ func (u *User) IsAdmin() bool {
 	return u.Username == "admin" || u.Admin
 }
 
+type DateFormat struct {
+	Name   string
+	Layout string
+}
+
+// DateFormats are the formats a user can choose from for displaying times,
+// the first one is the default
+var DateFormats = []DateFormat{
+	{Name: "default", Layout: "Jan 02, 2006 3:04:05PM MST"},
+	{Name: "24h", Layout: "Jan 02, 2006 15:04:05 MST"},
+	{Name: "iso", Layout: "2006-01-02 15:04:05 MST"},
+	{Name: "rfc1123", Layout: time.RFC1123},
+	{Name: "day-month", Layout: "02/01/2006 15:04"},
+	{Name: "month-day", Layout: "01/02/2006 3:04PM"},
+}
+
+// Format formats t with the layout of the date format
+func (df DateFormat) Format(t time.Time) string {
+	return t.Format(df.Layout)
+}
+
+func IsValidDateFormat(name string) bool {
+	for _, df := range DateFormats {
+		if df.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Location returns the user's timezone, falling back to the server's
+func (u *User) Location() *time.Location {
+	if u == nil || u.Timezone == "" {
+		return time.Local
+	}
+	loc, err := time.LoadLocation(u.Timezone)
+	if err != nil {
+		return time.Local
+	}
+	return loc
+}
+
+// FormatTime formats t with the user's timezone and date format preferences,
+// it is safe to call on a nil user for pages that can be viewed logged out
+func (u *User) FormatTime(t time.Time) string {
+	layout := DateFormats[0].Layout
+	if u != nil {
+		for _, df := range DateFormats {
+			if df.Name == u.DateFormat {
+				layout = df.Layout
+			}
+		}
+	}
+	return t.In(u.Location()).Format(layout)
+}
+
+// Owns is true when username is this user, it is safe to call on a nil user
+func (u *User) Owns(username string) bool {
+	return u != nil && u.Username == username
+}
+
 type Post struct {
 	gorm.Model
 	Username  string
 	Message   string
 	Timestamp time.Time
+	// ReplyToID is the post this one answers, 0 when it starts a thread
+	ReplyToID uint `gorm:"index"`
+	// EditedAt is when the author last changed the message, nil if never
+	EditedAt *time.Time
+	// RemoteID is the ActivityPub id of posts from other servers, their
+	// Username is the author's user@host handle
+	RemoteID  string `gorm:"index;default:''"`
+	RemoteURL string
+
+	// Filled in when listing posts, not stored
+	ReplyCount     int64           `gorm:"-"`
+	Parent         *Post           `gorm:"-"`
+	GroupedReplies []Post          `gorm:"-"`
+	Depth          int             `gorm:"-"`
+	Reactions      []ReactionCount `gorm:"-"`
 }
 
 func (p Post) String() string {
-	return fmt.Sprintf("Post{Username: %s, Message: %s, Timestamp: %d}",
-		p.Username, p.Message, p.Timestamp.Unix())
+	return fmt.Sprintf("Post{Username: %s, Message: %s, Timestamp: %d, ReplyToID: %d}",
+		p.Username, p.Message, p.Timestamp.Unix(), p.ReplyToID)
+}
+
+// Limits on the length of a post's message
+const (
+	MinPostLength = 3
+	MaxPostLength = 255
+)
+
+func (p *Post) Validate() error {
+	n := len([]rune(p.Message))
+	if n < MinPostLength || n > MaxPostLength {
+		return fmt.Errorf("post must be between %d and %d characters", MinPostLength, MaxPostLength)
+	}
+	return nil
+}
+
+func (p Post) IsRemote() bool {
+	return p.RemoteID != ""
+}
+
+func (p Post) IsEdited() bool {
+	return p.EditedAt != nil
+}
+
+// PostRevision is an earlier version of a post's message, kept when it is edited
+type PostRevision struct {
+	gorm.Model
+	PostID  uint `gorm:"index"`
+	Message string
+}
+
+func (pr PostRevision) String() string {
+	return fmt.Sprintf("PostRevision{PostID: %d, Message: %s}", pr.PostID, pr.Message)
+}
+
+func (pr PostRevision) MessageHTML() template.HTML {
+	return markup.Post(pr.Message)
+}
+
+// MaxThreadDepth is how deep replies are indented in a thread view
+const MaxThreadDepth = 8
+
+func (p Post) IsReply() bool {
+	return p.ReplyToID != 0
+}
+
+// Indent is how far the post is indented in a thread view, in em
+func (p Post) Indent() int {
+	if p.Depth > MaxThreadDepth {
+		return MaxThreadDepth * 2
+	}
+	return p.Depth * 2
+}
+
+func (p Post) MessageHTML() template.HTML {
+	return markup.Post(p.Message)
+}
+
+// PostTag is a #hashtag used in a post, stored lowercased
+type PostTag struct {
+	ID     uint   `gorm:"primarykey"`
+	PostID uint   `gorm:"index"`
+	Tag    string `gorm:"index"`
+}
+
+func (pt PostTag) String() string {
+	return fmt.Sprintf("PostTag{PostID: %d, Tag: %s}", pt.PostID, pt.Tag)
+}
+
+// PostSearch is a search over posts, any zero field is not filtered on
+type PostSearch struct {
+	Query     string
+	Author    string
+	From      time.Time
+	To        time.Time
+	Following bool
+	Viewer    *User
+}
+
+func (ps PostSearch) String() string {
+	return fmt.Sprintf("PostSearch{Query: %q, Author: %s, From: %s, To: %s, Following: %t}",
+		ps.Query, ps.Author, ps.From, ps.To, ps.Following)
+}
+
+func (ps PostSearch) IsEmpty() bool {
+	return ps.Query == "" && ps.Author == "" && ps.From.IsZero() && ps.To.IsZero() && !ps.Following
+}
+
+// PostSearchResult is a post matching a search, Snippet contains markers
+// around the matched terms
+type PostSearchResult struct {
+	ID        uint
+	Username  string
+	Message   string
+	Snippet   string
+	Timestamp time.Time
+}
+
+func (r PostSearchResult) String() string {
+	return fmt.Sprintf("PostSearchResult{ID: %d, Username: %s, Snippet: %q}", r.ID, r.Username, r.Snippet)
 }
 
+func (r PostSearchResult) SnippetHTML() template.HTML {
+	return markup.Highlight(r.Snippet)
+}
+
+// PageSize is how many items a paginated listing loads at once
+const PageSize = 20
+
+// Page is a keyset pagination cursor over ids. Before loads the items older
+// than that id, After the items newer than it and neither the newest items.
+type Page struct {
+	Before uint
+	After  uint
+}
+
+func (p Page) String() string {
+	return fmt.Sprintf("Page{Before: %d, After: %d}", p.Before, p.After)
+}
+
+// PageInfo holds the cursors to the pages around a loaded page, a zero cursor
+// means there is no such page
+type PageInfo struct {
+	Older uint
+	Newer uint
+}
+
+func (pi PageInfo) String() string {
+	return fmt.Sprintf("PageInfo{Older: %d, Newer: %d}", pi.Older, pi.Newer)
+}
+
+// RemoteActor is a user on another ActivityPub server
+type RemoteActor struct {
+	gorm.Model
+	ActorID string `gorm:"uniqueIndex"`
+	// Handle is user@host, it stands in for the username in posts and follows
+	Handle       string `gorm:"uniqueIndex"`
+	URL          string
+	Inbox        string
+	SharedInbox  string
+	PublicKeyID  string
+	PublicKeyPEM string
+}
+
+func (ra RemoteActor) String() string {
+	return fmt.Sprintf("RemoteActor{ActorID: %s, Handle: %s, Inbox: %s}", ra.ActorID, ra.Handle, ra.Inbox)
+}
+
+// DeliveryInbox prefers the shared inbox so a server gets each activity once
+func (ra RemoteActor) DeliveryInbox() string {
+	if ra.SharedInbox != "" {
+		return ra.SharedInbox
+	}
+	return ra.Inbox
+}
+
+// Following is Follower following Username, each pair exists only once
 type Following struct {
 	gorm.Model
-	Username string
-	Follower string
+	Username string `gorm:"uniqueIndex:idx_following_pair"`
+	Follower string `gorm:"uniqueIndex:idx_following_pair;index"`
 }
 
 func (f Following) String() string {
 	return fmt.Sprintf("Following{Username: %s, Follower: %s}", f.Username, f.Follower)
 }
 
-type Auth struct {
+// SessionDuration is how long a session (and its cookies) stay valid after login
+const SessionDuration = time.Hour
+
+type Session struct {
 	gorm.Model
-	Username string `gorm:"primaryKey"`
-	AuthId   string
+	Username   string `gorm:"index"`
+	Token      string `gorm:"uniqueIndex"`
+	UserAgent  string
+	IP         string
+	LastSeenAt time.Time
+	ExpiresAt  time.Time
+}
+
+func (s Session) String() string {
+	return fmt.Sprintf("Session{Username: %s, Token: N/A, UserAgent: %s, IP: %s, LastSeenAt: %s, ExpiresAt: %s}",
+		s.Username, s.UserAgent, s.IP, s.LastSeenAt.Format(time.DateTime), s.ExpiresAt.Format(time.DateTime))
+}
+
+func (s *Session) IsExpired() bool {
+	return time.Now().After(s.ExpiresAt)
+}
+
+// RecoveryCode is a single use code that can be used instead of a TOTP code
+type RecoveryCode struct {
+	gorm.Model
+	Username string `gorm:"index"`
+	CodeHash string `gorm:"index"`
+	UsedAt   *time.Time
+}
+
+func (rc RecoveryCode) String() string {
+	return fmt.Sprintf("RecoveryCode{Username: %s, CodeHash: N/A, Used: %t}", rc.Username, rc.UsedAt != nil)
+}
+
+// LoginChallengeDuration is how long a user has to enter their TOTP code after
+// their password was accepted
+const LoginChallengeDuration = 5 * time.Minute
+
+// LoginChallenge tracks a login where the password was accepted but the second
+// factor has not been provided yet
+type LoginChallenge struct {
+	gorm.Model
+	Username  string
+	Token     string `gorm:"uniqueIndex"`
+	ExpiresAt time.Time
+}
+
+func (lc LoginChallenge) String() string {
+	return fmt.Sprintf("LoginChallenge{Username: %s, Token: N/A, ExpiresAt: %s}", lc.Username, lc.ExpiresAt.Format(time.DateTime))
+}
+
+type Invite struct {
+	gorm.Model
+	Token     string `gorm:"uniqueIndex"`
+	CreatedBy string `gorm:"index"`
+	ExpiresAt time.Time
+	MaxUses   int
+	Uses      int
+	RevokedAt *time.Time
+}
+
+func (i Invite) String() string {
+	return fmt.Sprintf("Invite{CreatedBy: %s, Token: N/A, ExpiresAt: %s, MaxUses: %d, Uses: %d, Revoked: %t}",
+		i.CreatedBy, i.ExpiresAt.Format(time.DateTime), i.MaxUses, i.Uses, i.RevokedAt != nil)
+}
+
+func (i *Invite) IsUsable() bool {
+	return i.RevokedAt == nil && i.Uses < i.MaxUses && time.Now().Before(i.ExpiresAt)
+}
+
+func (i *Invite) Validate() error {
+	if i.MaxUses < 1 || i.MaxUses > MaxInviteUses {
+		return fmt.Errorf("invite max uses must be between 1 and %d, got %d", MaxInviteUses, i.MaxUses)
+	}
+	if !i.ExpiresAt.After(time.Now()) || i.ExpiresAt.After(time.Now().Add(MaxInviteDuration)) {
+		return fmt.Errorf("invite must expire within %s", MaxInviteDuration)
+	}
+	return nil
+}
+
+const (
+	MaxInviteUses     = 100
+	MaxInviteDuration = 30 * 24 * time.Hour
+)
+
+// Setting is a single key value pair of the site wide settings
+type Setting struct {
+	gorm.Model
+	Key   string `gorm:"uniqueIndex"`
+	Value string
+}
+
+func (s Setting) String() string {
+	return fmt.Sprintf("Setting{Key: %s, Value: %s}", s.Key, s.Value)
+}
+
+// SiteSettings are the admin editable settings for the whole instance
+type SiteSettings struct {
+	MaxUsers int
+	// AllowUserInvites lets non admin users create invites up to InvitesPerUser
+	AllowUserInvites bool
+	InvitesPerUser   int
+}
+
+func DefaultSiteSettings() SiteSettings {
+	return SiteSettings{
+		MaxUsers:         100,
+		AllowUserInvites: false,
+		InvitesPerUser:   3,
+	}
+}
+
+func (ss *SiteSettings) Validate() error {
+	if ss.MaxUsers < 1 {
+		return fmt.Errorf("max users must be at least 1, got %d", ss.MaxUsers)
+	}
+	if ss.InvitesPerUser < 0 {
+		return fmt.Errorf("invites per user cannot be negative, got %d", ss.InvitesPerUser)
+	}
+	return nil
+}
+
+// Content types that can be moderated
+const (
+	ContentTypePost        = "post"
+	ContentTypePaste       = "paste"
+	ContentTypeChatMessage = "chat"
+)
+
+// Moderation actions
+const (
+	ModerationDelete  = "delete"
+	ModerationRestore = "restore"
+	ModerationPurge   = "purge"
+)
+
+func IsValidContentType(contentType string) bool {
+	switch contentType {
+	case ContentTypePost, ContentTypePaste, ContentTypeChatMessage:
+		return true
+	}
+	return false
+}
+
+// ModerationLog records every moderation action an admin has taken
+type ModerationLog struct {
+	gorm.Model
+	Actor        string
+	Action       string
+	ContentType  string
+	ContentID    uint
+	ContentOwner string
+	Reason       string
 }
 
-func (a Auth) String() string {
-	return fmt.Sprintf("Auth{Username: %s, AuthId: %s}", a.Username, a.AuthId)
+func (ml ModerationLog) String() string {
+	return fmt.Sprintf("ModerationLog{Actor: %s, Action: %s, ContentType: %s, ContentID: %d, ContentOwner: %s, Reason: %q}",
+		ml.Actor, ml.Action, ml.ContentType, ml.ContentID, ml.ContentOwner, ml.Reason)
 }
 
 type Paste struct {
@@ -68,6 +478,11 @@ func (p Paste) String() string {
 	return fmt.Sprintf("Paste{Username: %s, Title: %s, Text: %q}", p.Username, p.Title, p.Text)
 }
 
+// TextHTML renders the paste text as Markdown
+func (p Paste) TextHTML() template.HTML {
+	return markup.Document(p.Text)
+}
+
 func (p *Paste) Validate() error {
 	if p.Username == "" {
 		return fmt.Errorf("paste username cannot be empty string")
@@ -81,10 +496,32 @@ func (p *Paste) Validate() error {
 	return nil
 }
 
+// PasteSearchResult is a paste matching a search, Title and Snippet contain
+// markers around the matched terms
+type PasteSearchResult struct {
+	ID      uint
+	Title   string
+	Snippet string
+}
+
+func (r PasteSearchResult) String() string {
+	return fmt.Sprintf("PasteSearchResult{ID: %d, Title: %q, Snippet: %q}", r.ID, r.Title, r.Snippet)
+}
+
+func (r PasteSearchResult) TitleHTML() template.HTML {
+	return markup.Highlight(r.Title)
+}
+
+func (r PasteSearchResult) SnippetHTML() template.HTML {
+	return markup.Highlight(r.Snippet)
+}
+
 type ChatMessage struct {
+	gorm.Model
+	Room      string          `gorm:"index"`
 	Username  string          `json:"username"`
 	Message   string          `json:"message"`
-	Headers   json.RawMessage `json:"HEADER"`
+	Headers   json.RawMessage `json:"HEADER" gorm:"-"`
 	Timestamp time.Time
 }
 
@@ -92,6 +529,364 @@ func (cm ChatMessage) String() string {
 	return fmt.Sprintf("ChatMessage{Username: %s, Message: %s, Timestamp: %s}", cm.Username, cm.Message, cm.Timestamp.Format(time.DateTime))
 }
 
-func (cm ChatMessage) ToTextMessage() []byte {
-	return []byte(fmt.Sprintf(`<div hx-swap-oob="beforeend:#chat_room"><p>%s - %s: %s</p></div>`, cm.Timestamp.Format(time.DateTime), cm.Username, cm.Message))
+// Limits on the length of a chat message
+const (
+	MinChatMessageLength = 3
+	MaxChatMessageLength = 255
+)
+
+// Validate trims the surrounding whitespace off the message and checks its
+// length
+func (cm *ChatMessage) Validate() error {
+	cm.Message = strings.TrimSpace(cm.Message)
+	n := len([]rune(cm.Message))
+	if n < MinChatMessageLength || n > MaxChatMessageLength {
+		return fmt.Errorf("message must be between %d and %d characters", MinChatMessageLength, MaxChatMessageLength)
+	}
+	return nil
+}
+
+var chatMessageTemplate = template.Must(template.New("chatMessage").Parse(
+	`<div hx-swap-oob="beforeend:#chat_room"><p id="chat_message_{{ .ID }}">{{ .Time }} - {{ .Username }}: {{ .Message }}</p></div>`))
+
+// ToTextMessage renders the htmx out of band swap sent to the chat room, the
+// timestamp is formatted with the preferences of viewer
+func (cm ChatMessage) ToTextMessage(viewer *User) []byte {
+	var buf bytes.Buffer
+	err := chatMessageTemplate.Execute(&buf, struct {
+		ID       uint
+		Time     string
+		Username string
+		Message  template.HTML
+	}{
+		ID:       cm.ID,
+		Time:     viewer.FormatTime(cm.Timestamp),
+		Username: cm.Username,
+		Message:  markup.Inline(cm.Message),
+	})
+	if err != nil {
+		log.Printf("ChatMessage::ToTextMessage error: %s", err.Error())
+		return nil
+	}
+	return buf.Bytes()
+}
+
+const (
+	DefaultChatRoomMaxAge      = 7 * 24 * time.Hour
+	DefaultChatRoomMaxMessages = 1000
+	DefaultChatRoomMaxBytes    = 256 * 1024
+	// ChatHistoryLength is the number of messages sent to someone joining a room
+	ChatHistoryLength = 50
+)
+
+// ChatRoom holds the retention policy for a room, messages are pruned once
+// they are older than MaxAge or once the room holds more than MaxMessages
+// messages or MaxBytes bytes of message text. A zero value disables that limit.
+type ChatRoom struct {
+	gorm.Model
+	Name        string `gorm:"uniqueIndex"`
+	MaxAge      time.Duration
+	MaxMessages int
+	MaxBytes    int
+}
+
+func NewChatRoom(name string) *ChatRoom {
+	return &ChatRoom{
+		Name:        name,
+		MaxAge:      DefaultChatRoomMaxAge,
+		MaxMessages: DefaultChatRoomMaxMessages,
+		MaxBytes:    DefaultChatRoomMaxBytes,
+	}
+}
+
+func (cr ChatRoom) String() string {
+	return fmt.Sprintf("ChatRoom{Name: %s, MaxAge: %s, MaxMessages: %d, MaxBytes: %d}", cr.Name, cr.MaxAge, cr.MaxMessages, cr.MaxBytes)
+}
+
+func (cr *ChatRoom) Validate() error {
+	if cr.MaxAge < 0 {
+		return fmt.Errorf("max age cannot be negative")
+	}
+	if cr.MaxMessages < 0 {
+		return fmt.Errorf("max messages cannot be negative")
+	}
+	if cr.MaxBytes < 0 {
+		return fmt.Errorf("max bytes cannot be negative")
+	}
+	return nil
+}
+
+// MaxAgeHours is used by the templates to display and edit MaxAge
+func (cr *ChatRoom) MaxAgeHours() int {
+	return int(cr.MaxAge / time.Hour)
+}
+
+// Kinds of notification
+const (
+	NotificationMention = "mention"
+	NotificationFollow  = "follow"
+	NotificationReply   = "reply"
+	// NotificationWebmention is a page on another site linking to a post
+	NotificationWebmention = "webmention"
+)
+
+// Notification tells Username that Actor interacted with them
+type Notification struct {
+	gorm.Model
+	Username string `gorm:"index"`
+	Actor    string
+	Kind     string
+	// Link is where the interaction happened, like a post or chat room
+	Link    string
+	Excerpt string
+	ReadAt  *time.Time
+}
+
+func (n Notification) String() string {
+	return fmt.Sprintf("Notification{Username: %s, Actor: %s, Kind: %s, Link: %s, Read: %t}",
+		n.Username, n.Actor, n.Kind, n.Link, n.IsRead())
+}
+
+func (n Notification) IsRead() bool {
+	return n.ReadAt != nil
+}
+
+// Text describes the notification for its recipient
+func (n Notification) Text() string {
+	switch n.Kind {
+	case NotificationMention:
+		return n.Actor + " mentioned you"
+	case NotificationFollow:
+		return n.Actor + " started following you"
+	case NotificationReply:
+		return n.Actor + " replied to your post"
+	case NotificationWebmention:
+		return n.Actor + " linked to your post"
+	}
+	return n.Actor + " interacted with you"
+}
+
+// notificationExcerptLength is how much of a message a notification keeps
+const notificationExcerptLength = 140
+
+// NewNotification creates a notification, trimming excerpt to a short preview
+func NewNotification(username, actor, kind, link, excerpt string) Notification {
+	if r := []rune(excerpt); len(r) > notificationExcerptLength {
+		excerpt = string(r[:notificationExcerptLength]) + "…"
+	}
+	return Notification{
+		Username: username,
+		Actor:    actor,
+		Kind:     kind,
+		Link:     link,
+		Excerpt:  excerpt,
+	}
+}
+
+// ReactionKind is one of the fixed reactions a post can get
+type ReactionKind struct {
+	Name  string
+	Emoji string
+}
+
+// ReactionKinds are the reactions users can pick from, in display order
+var ReactionKinds = []ReactionKind{
+	{"like", "❤️"},
+	{"laugh", "😂"},
+	{"wow", "😮"},
+	{"sad", "😢"},
+	{"party", "🎉"},
+}
+
+func IsValidReactionKind(name string) bool {
+	for _, rk := range ReactionKinds {
+		if rk.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ReactionEmoji returns the emoji shown for a reaction kind
+func ReactionEmoji(name string) string {
+	for _, rk := range ReactionKinds {
+		if rk.Name == name {
+			return rk.Emoji
+		}
+	}
+	return ""
+}
+
+// Reaction is Username reacting to a post, each user can use every kind once
+type Reaction struct {
+	ID        uint   `gorm:"primarykey"`
+	PostID    uint   `gorm:"uniqueIndex:idx_reaction"`
+	Username  string `gorm:"uniqueIndex:idx_reaction"`
+	Kind      string `gorm:"uniqueIndex:idx_reaction"`
+	CreatedAt time.Time
+}
+
+func (r Reaction) String() string {
+	return fmt.Sprintf("Reaction{PostID: %d, Username: %s, Kind: %s}", r.PostID, r.Username, r.Kind)
+}
+
+func (r Reaction) Emoji() string {
+	return ReactionEmoji(r.Kind)
+}
+
+// ReactionCount is how often a post got a kind of reaction and whether the
+// viewer is one of them
+type ReactionCount struct {
+	ReactionKind
+	Count int64
+	Mine  bool
+}
+
+func (rc ReactionCount) String() string {
+	return fmt.Sprintf("ReactionCount{Name: %s, Count: %d, Mine: %t}", rc.Name, rc.Count, rc.Mine)
+}
+
+// States of queued Webmentions
+const (
+	WebmentionPending  = "pending"
+	WebmentionVerified = "verified"
+	WebmentionSent     = "sent"
+	WebmentionFailed   = "failed"
+)
+
+// MaxWebmentionAttempts is how often a Webmention is verified or sent before
+// it is given up on
+const MaxWebmentionAttempts = 5
+
+// WebmentionRetryDelay is the wait before the next attempt, doubling each time
+func WebmentionRetryDelay(attempts int) time.Duration {
+	return time.Minute << attempts
+}
+
+// Webmention is a page elsewhere linking to one of our posts, it is only
+// shown once verified
+type Webmention struct {
+	gorm.Model
+	Source string `gorm:"uniqueIndex:idx_webmention_pair"`
+	Target string `gorm:"uniqueIndex:idx_webmention_pair"`
+	PostID uint   `gorm:"index"`
+	// Title of the source page, filled in when verified
+	Title         string
+	Status        string `gorm:"index"`
+	Attempts      int
+	NextAttemptAt time.Time
+	Error         string
+}
+
+func (w Webmention) String() string {
+	return fmt.Sprintf("Webmention{Source: %s, Target: %s, PostID: %d, Status: %s, Attempts: %d}",
+		w.Source, w.Target, w.PostID, w.Status, w.Attempts)
+}
+
+// Host is the site the mention came from
+func (w Webmention) Host() string {
+	u, err := url.Parse(w.Source)
+	if err != nil {
+		return w.Source
+	}
+	return u.Host
+}
+
+// WebmentionDelivery is a Webmention we send for a link in one of our posts
+type WebmentionDelivery struct {
+	gorm.Model
+	PostID        uint   `gorm:"index"`
+	Source        string `gorm:"uniqueIndex:idx_webmention_delivery_pair"`
+	Target        string `gorm:"uniqueIndex:idx_webmention_delivery_pair"`
+	Status        string `gorm:"index"`
+	Attempts      int
+	NextAttemptAt time.Time
+	Error         string
+}
+
+func (wd WebmentionDelivery) String() string {
+	return fmt.Sprintf("WebmentionDelivery{Source: %s, Target: %s, Status: %s, Attempts: %d}",
+		wd.Source, wd.Target, wd.Status, wd.Attempts)
+}
+
+// Scopes an access token can be given
+const (
+	ScopeRead   = "read"
+	ScopeCreate = "create"
+	ScopeUpdate = "update"
+	ScopeDelete = "delete"
+	ScopeFollow = "follow"
+	ScopePastes = "pastes"
+	ScopeChat   = "chat"
+	ScopeAdmin  = "admin"
+)
+
+// AccessTokenScopes are all the scopes, in the order they are shown
+var AccessTokenScopes = []string{ScopeRead, ScopeCreate, ScopeUpdate, ScopeDelete, ScopeFollow, ScopePastes, ScopeChat, ScopeAdmin}
+
+// ScopeDescriptions say what each scope allows
+var ScopeDescriptions = map[string]string{
+	ScopeRead:   "read timelines, posts, profiles and follows",
+	ScopeCreate: "create posts",
+	ScopeUpdate: "edit your posts",
+	ScopeDelete: "delete your posts",
+	ScopeFollow: "follow and unfollow people",
+	ScopePastes: "read and create your pastes",
+	ScopeChat:   "read and send chat messages",
+	ScopeAdmin:  "manage users, only for admins",
+}
+
+func IsValidScope(scope string) bool {
+	for _, s := range AccessTokenScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// AccessToken lets apps act for a user without their password, only a hash
+// of the token is stored
+type AccessToken struct {
+	gorm.Model
+	Username  string `gorm:"index"`
+	Name      string
+	TokenHash string `gorm:"uniqueIndex"`
+	// Scopes is a space separated list of AccessTokenScopes
+	Scopes     string
+	LastUsedAt *time.Time
+}
+
+func (t AccessToken) String() string {
+	return fmt.Sprintf("AccessToken{Username: %s, Name: %s, Token: N/A, Scopes: %s}", t.Username, t.Name, t.Scopes)
+}
+
+func (t AccessToken) ScopeList() []string {
+	return strings.Fields(t.Scopes)
+}
+
+func (t AccessToken) HasScope(scope string) bool {
+	for _, s := range t.ScopeList() {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *AccessToken) Validate() error {
+	n := len([]rune(t.Name))
+	if n < 1 || n > 64 {
+		return fmt.Errorf("token name must be between 1 and 64 characters")
+	}
+	scopes := t.ScopeList()
+	if len(scopes) == 0 {
+		return fmt.Errorf("token needs at least one scope")
+	}
+	for _, s := range scopes {
+		if !IsValidScope(s) {
+			return fmt.Errorf("unknown scope `%s`", s)
+		}
+	}
+	return nil
 }
@@ -0,0 +1,75 @@
+package models
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChatMessageToTextMessage(t *testing.T) {
+	viewer := &User{Timezone: "UTC", DateFormat: "iso"}
+	timestamp := time.Date(2024, 5, 1, 13, 4, 5, 0, time.UTC)
+	tests := []struct {
+		name string
+		msg  ChatMessage
+		want string
+	}{
+		{
+			name: "formatting",
+			msg:  ChatMessage{Username: "alice", Message: "**hi** @bob", Timestamp: timestamp},
+			want: `<div hx-swap-oob="beforeend:#chat_room"><p id="chat_message_7">2024-05-01 13:04:05 UTC - alice: <strong>hi</strong> <a href="/user/bob">@bob</a></p></div>`,
+		},
+		{
+			name: "script in the message",
+			msg:  ChatMessage{Username: "alice", Message: "<script>alert(1)</script>", Timestamp: timestamp},
+			want: `<div hx-swap-oob="beforeend:#chat_room"><p id="chat_message_7">2024-05-01 13:04:05 UTC - alice: &lt;script&gt;alert(1)&lt;/script&gt;</p></div>`,
+		},
+		{
+			name: "closing the frame early",
+			msg:  ChatMessage{Username: "alice", Message: `</p></div><div hx-swap-oob="innerHTML:body">`, Timestamp: timestamp},
+			want: `<div hx-swap-oob="beforeend:#chat_room"><p id="chat_message_7">2024-05-01 13:04:05 UTC - alice: &lt;/p&gt;&lt;/div&gt;&lt;div hx-swap-oob=&#34;innerHTML:body&#34;&gt;</p></div>`,
+		},
+		{
+			name: "html in the username",
+			msg:  ChatMessage{Username: "<b>alice</b>", Message: "hello", Timestamp: timestamp},
+			want: `<div hx-swap-oob="beforeend:#chat_room"><p id="chat_message_7">2024-05-01 13:04:05 UTC - &lt;b&gt;alice&lt;/b&gt;: hello</p></div>`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.msg.ID = 7
+			if got := string(tt.msg.ToTextMessage(viewer)); got != tt.want {
+				t.Errorf("ToTextMessage()\n got: %s\nwant: %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChatMessageValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		want    string
+		valid   bool
+	}{
+		{name: "short", message: "hi"},
+		{name: "shortest", message: "hey", want: "hey", valid: true},
+		{name: "padded with spaces", message: "  hi \n\t"},
+		{name: "trimmed", message: "  hello  ", want: "hello", valid: true},
+		{name: "counts runes", message: "日本語", want: "日本語", valid: true},
+		{name: "longest", message: strings.Repeat("ü", 255), want: strings.Repeat("ü", 255), valid: true},
+		{name: "too long", message: strings.Repeat("a", 256)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cm := ChatMessage{Message: tt.message}
+			err := cm.Validate()
+			if (err == nil) != tt.valid {
+				t.Fatalf("Validate(%q) error = %v, want valid %v", tt.message, err, tt.valid)
+			}
+			if tt.valid && cm.Message != tt.want {
+				t.Errorf("Validate(%q) left the message %q, want %q", tt.message, cm.Message, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+// Package outbound makes the http clients used to contact other servers.
+// Anyone can make us fetch a url, by sending a Webmention or signing an
+// activity with any key id, so the clients refuse to connect to loopback,
+// private and link-local addresses unless that is allowed for testing.
+package outbound
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// ErrPrivateAddress means a host resolved to an address that is not public
+var ErrPrivateAddress = errors.New("refusing to connect to a non-public address")
+
+var allowPrivate atomic.Bool
+
+// nonPublic are the special purpose ranges the netip methods don't cover
+var nonPublic = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.0.2.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("198.51.100.0/24"),
+	netip.MustParsePrefix("203.0.113.0/24"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("2001:db8::/32"),
+}
+
+// AllowPrivateAddresses lets the clients connect to any address, so local
+// instances can talk to each other during development
+func AllowPrivateAddresses(allow bool) {
+	allowPrivate.Store(allow)
+}
+
+// PrivateAddressesAllowed is true when AllowPrivateAddresses turned the
+// check off
+func PrivateAddressesAllowed() bool {
+	return allowPrivate.Load()
+}
+
+// IsPublic is true for addresses on the public internet
+func IsPublic(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return false
+	}
+	for _, p := range nonPublic {
+		if p.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// control runs after the host is resolved and before connecting, so a name
+// that resolves to an internal address is caught as well
+func control(network, address string, _ syscall.RawConn) error {
+	if allowPrivate.Load() {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	if !IsPublic(ip) {
+		return fmt.Errorf("%w %s", ErrPrivateAddress, ip)
+	}
+	return nil
+}
+
+// NewClient returns a client that only connects to public addresses. It
+// never uses a proxy, the proxy's address would be checked instead of the
+// server's.
+func NewClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{Timeout: timeout, Control: control}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			ForceAttemptHTTP2:   true,
+			MaxIdleConns:        100,
+			IdleConnTimeout:     90 * time.Second,
+			TLSHandshakeTimeout: timeout,
+		},
+	}
+}
@@ -0,0 +1,59 @@
+package outbound
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestIsPublic(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"100.64.0.1", false},
+		{"224.0.0.1", false},
+		{"255.255.255.255", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:169.254.169.254", false},
+	}
+	for _, tt := range tests {
+		if got := IsPublic(netip.MustParseAddr(tt.ip)); got != tt.want {
+			t.Errorf("IsPublic(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestClientRefusesLoopback(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	client := NewClient(time.Second)
+
+	_, err := client.Get(srv.URL)
+	if !errors.Is(err, ErrPrivateAddress) {
+		t.Fatalf("Get(%s) error = %v, want %v", srv.URL, err, ErrPrivateAddress)
+	}
+
+	AllowPrivateAddresses(true)
+	defer AllowPrivateAddresses(false)
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("Get(%s) with private addresses allowed: %v", srv.URL, err)
+	}
+	resp.Body.Close()
+}
@@ -0,0 +1,78 @@
+package pubsub
+
+import (
+	"beeline/models"
+	"sync"
+)
+
+// notificationBuffer is how many notifications a slow subscriber can fall
+// behind before new ones are dropped for it
+const notificationBuffer = 8
+
+// Notifier delivers new notifications to the open pages of their recipient
+type Notifier struct {
+	subscribers map[string]map[chan models.Notification]struct{} // map of username to its subscribers
+	closed      bool
+	mut         sync.Mutex
+}
+
+func NewNotifier() *Notifier {
+	return &Notifier{
+		subscribers: map[string]map[chan models.Notification]struct{}{},
+	}
+}
+
+// Subscribe returns a channel receiving the user's new notifications, it is
+// closed by Unsubscribe or Close
+func (n *Notifier) Subscribe(username string) chan models.Notification {
+	n.mut.Lock()
+	defer n.mut.Unlock()
+	ch := make(chan models.Notification, notificationBuffer)
+	if n.closed {
+		close(ch)
+		return ch
+	}
+	if n.subscribers[username] == nil {
+		n.subscribers[username] = map[chan models.Notification]struct{}{}
+	}
+	n.subscribers[username][ch] = struct{}{}
+	return ch
+}
+
+func (n *Notifier) Unsubscribe(username string, ch chan models.Notification) {
+	n.mut.Lock()
+	defer n.mut.Unlock()
+	if _, ok := n.subscribers[username][ch]; !ok {
+		return
+	}
+	delete(n.subscribers[username], ch)
+	if len(n.subscribers[username]) == 0 {
+		delete(n.subscribers, username)
+	}
+	close(ch)
+}
+
+// Publish sends the notification to every subscriber of its recipient
+func (n *Notifier) Publish(notification models.Notification) {
+	n.mut.Lock()
+	defer n.mut.Unlock()
+	for ch := range n.subscribers[notification.Username] {
+		select {
+		case ch <- notification:
+		default:
+		}
+	}
+}
+
+// Close ends every subscription so open streams finish, used on shutdown
+func (n *Notifier) Close() {
+	n.mut.Lock()
+	defer n.mut.Unlock()
+	n.closed = true
+	for username, chs := range n.subscribers {
+		for ch := range chs {
+			close(ch)
+		}
+		delete(n.subscribers, username)
+	}
+}
@@ -0,0 +1,95 @@
+package totp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the ASCII secret "12345678901234567890" of the RFC test vectors
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// TestHOTPVectors checks the HOTP values of RFC 4226 Appendix D
+func TestHOTPVectors(t *testing.T) {
+	want := []string{"755224", "287082", "359152", "969429", "338314", "254676", "287922", "162583", "399871", "520489"}
+	for count, w := range want {
+		got, err := CodeForStep(rfcSecret, int64(count))
+		if err != nil {
+			t.Fatalf("CodeForStep(%d): %v", count, err)
+		}
+		if got != w {
+			t.Errorf("CodeForStep(%d) = %s, want %s", count, got, w)
+		}
+	}
+}
+
+// TestTOTPVectors checks the SHA1 values of RFC 6238 Appendix B, which are
+// 8 digits long so only their last 6 are compared
+func TestTOTPVectors(t *testing.T) {
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+	for _, tt := range tests {
+		got, err := Code(rfcSecret, time.Unix(tt.unix, 0))
+		if err != nil {
+			t.Fatalf("Code(%d): %v", tt.unix, err)
+		}
+		if want := tt.want[len(tt.want)-Digits:]; got != want {
+			t.Errorf("Code(%d) = %s, want %s", tt.unix, got, want)
+		}
+	}
+}
+
+func TestValidateSkew(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	current := Step(now)
+	tests := []struct {
+		offset int64
+		ok     bool
+	}{
+		{-2, false},
+		{-1, true},
+		{0, true},
+		{1, true},
+		{2, false},
+	}
+	for _, tt := range tests {
+		code, err := CodeForStep(rfcSecret, current+tt.offset)
+		if err != nil {
+			t.Fatalf("CodeForStep: %v", err)
+		}
+		step, ok := Validate(rfcSecret, code, now)
+		if ok != tt.ok {
+			t.Errorf("Validate(code of step %+d) = %v, want %v", tt.offset, ok, tt.ok)
+		}
+		if ok && step != current+tt.offset {
+			t.Errorf("Validate(code of step %+d) matched step %d, want %d", tt.offset, step, current+tt.offset)
+		}
+	}
+}
+
+func TestValidateInput(t *testing.T) {
+	now := time.Unix(59, 0)
+	if _, ok := Validate(rfcSecret, " 287 082 ", now); !ok {
+		t.Errorf("Validate rejected a code with spaces")
+	}
+	if _, ok := Validate(strings.ToLower(rfcSecret), "287082", now); !ok {
+		t.Errorf("Validate rejected a lowercase secret")
+	}
+	for _, code := range []string{"", "28708", "2870820", "abcdef"} {
+		if _, ok := Validate(rfcSecret, code, now); ok {
+			t.Errorf("Validate accepted %q", code)
+		}
+	}
+	if _, ok := Validate("not base32!", "287082", now); ok {
+		t.Errorf("Validate accepted an invalid secret")
+	}
+}
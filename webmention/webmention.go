@@ -0,0 +1,222 @@
+// Package webmention discovers endpoints, sends Webmentions and verifies the
+// ones we receive, see https://www.w3.org/TR/webmention/
+package webmention
+
+import (
+	"beeline/outbound"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// maxPageSize limits how much of a fetched page is read
+const maxPageSize = 1 << 20
+
+var (
+	// ErrGone means the source was deleted, any mention from it should go too
+	ErrGone = errors.New("source is gone")
+	// ErrNoLink means the source does not link to the target
+	ErrNoLink = errors.New("source does not link to target")
+	// ErrNoEndpoint means the target does not accept Webmentions
+	ErrNoEndpoint = errors.New("target has no webmention endpoint")
+)
+
+// client only connects to public addresses, anyone can make us fetch a
+// source by sending a Webmention
+var client = newClient()
+
+func newClient() *http.Client {
+	c := outbound.NewClient(10 * time.Second)
+	c.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 5 {
+			return fmt.Errorf("too many redirects")
+		}
+		return checkURL(req.URL)
+	}
+	return c
+}
+
+var (
+	linkHeaderRe = regexp.MustCompile(`<([^>]*)>\s*((?:;\s*[^;,]*)*)`)
+	relRe        = regexp.MustCompile(`(?i)\brel\s*=\s*"?([^";]*)"?`)
+	tagRe        = regexp.MustCompile(`(?is)<(link|a)\b[^>]*>`)
+	attrRe       = regexp.MustCompile(`(?is)\b(href|rel)\s*=\s*("([^"]*)"|'([^']*)'|([^\s>]+))`)
+	titleRe      = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+	markupRe     = regexp.MustCompile(`(?s)<[^>]*>`)
+	commentRe    = regexp.MustCompile(`(?s)<!--.*?-->`)
+)
+
+// Source is what we learned about a verified source page
+type Source struct {
+	Title string
+}
+
+// ValidURL only accepts absolute http(s) urls
+func ValidURL(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	return err == nil && checkURL(u) == nil
+}
+
+func checkURL(u *url.URL) error {
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%s is not an http(s) url", u)
+	}
+	return nil
+}
+
+// Discover finds the webmention endpoint of target from its Link headers or
+// the first <link> or <a> with rel="webmention"
+func Discover(target string) (string, error) {
+	resp, err := get(target)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	base := resp.Request.URL
+	for _, h := range resp.Header.Values("Link") {
+		for _, m := range linkHeaderRe.FindAllStringSubmatch(h, -1) {
+			if rel := relRe.FindStringSubmatch(m[2]); rel != nil && hasRel(rel[1]) {
+				return resolve(base, m[1])
+			}
+		}
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", fmt.Errorf("fetching %s: %s", target, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxPageSize))
+	if err != nil {
+		return "", err
+	}
+	page := commentRe.ReplaceAllString(string(body), "")
+	for _, tag := range tagRe.FindAllString(page, -1) {
+		attrs := attributes(tag)
+		if href, ok := attrs["href"]; ok && hasRel(attrs["rel"]) {
+			return resolve(base, href)
+		}
+	}
+	return "", ErrNoEndpoint
+}
+
+// Send notifies endpoint that source links to target
+func Send(endpoint, source, target string) error {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return err
+	}
+	if err := checkURL(u); err != nil {
+		return err
+	}
+	form := url.Values{"source": {source}, "target": {target}}
+	resp, err := client.PostForm(endpoint, form)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxPageSize))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("sending to %s: %s", endpoint, resp.Status)
+	}
+	return nil
+}
+
+// Verify fetches source and makes sure it links to target
+func Verify(source, target string) (*Source, error) {
+	resp, err := get(source)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusGone {
+		return nil, ErrGone
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("fetching %s: %s", source, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxPageSize))
+	if err != nil {
+		return nil, err
+	}
+	page := commentRe.ReplaceAllString(string(body), "")
+	base := resp.Request.URL
+	for _, tag := range tagRe.FindAllString(page, -1) {
+		href, ok := attributes(tag)["href"]
+		if !ok {
+			continue
+		}
+		if resolved, err := resolve(base, href); err == nil && sameURL(resolved, target) {
+			return &Source{Title: title(page)}, nil
+		}
+	}
+	return nil, ErrNoLink
+}
+
+func get(rawURL string) (*http.Response, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkURL(u); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/html")
+	return client.Do(req)
+}
+
+func attributes(tag string) map[string]string {
+	attrs := map[string]string{}
+	for _, m := range attrRe.FindAllStringSubmatch(tag, -1) {
+		name := strings.ToLower(m[1])
+		if _, seen := attrs[name]; !seen {
+			attrs[name] = html.UnescapeString(m[3] + m[4] + m[5])
+		}
+	}
+	return attrs
+}
+
+func hasRel(rel string) bool {
+	for _, r := range strings.Fields(strings.ToLower(rel)) {
+		if r == "webmention" {
+			return true
+		}
+	}
+	return false
+}
+
+func resolve(base *url.URL, ref string) (string, error) {
+	u, err := base.Parse(strings.TrimSpace(ref))
+	if err != nil {
+		return "", err
+	}
+	if err := checkURL(u); err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
+// sameURL compares urls ignoring a trailing slash and the fragment
+func sameURL(a, b string) bool {
+	norm := func(s string) string {
+		s, _, _ = strings.Cut(s, "#")
+		return strings.TrimSuffix(s, "/")
+	}
+	return norm(a) == norm(b)
+}
+
+func title(page string) string {
+	m := titleRe.FindStringSubmatch(page)
+	if m == nil {
+		return ""
+	}
+	t := html.UnescapeString(markupRe.ReplaceAllString(m[1], ""))
+	return strings.Join(strings.Fields(t), " ")
+}
@@ -0,0 +1,286 @@
+package webmention
+
+import (
+	"beeline/outbound"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// errAny stands for any error in the tables
+var errAny = errors.New("any error")
+
+// allowLocal lets the client reach the httptest servers on loopback
+func allowLocal(t *testing.T) {
+	outbound.AllowPrivateAddresses(true)
+	t.Cleanup(func() { outbound.AllowPrivateAddresses(false) })
+}
+
+// servePage answers every request with page and the given Link header
+func servePage(t *testing.T, status int, link, page string) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if link != "" {
+			w.Header().Set("Link", link)
+		}
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(status)
+		fmt.Fprint(w, page)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestDiscover(t *testing.T) {
+	allowLocal(t)
+	tests := []struct {
+		name   string
+		status int
+		link   string
+		page   string
+		// want is the endpoint, relative to the server
+		want string
+		err  error
+	}{
+		{
+			name: "link header",
+			link: `</webmention>; rel="webmention"`,
+			want: "/webmention",
+		},
+		{
+			name: "link header with several rels",
+			link: `<https://example.com/other>; rel="me", </endpoint?a=1>; rel="webmention other"`,
+			want: "/endpoint?a=1",
+		},
+		{
+			name: "link header wins over the page",
+			link: `</from-header>; rel=webmention`,
+			page: `<link rel="webmention" href="/from-page">`,
+			want: "/from-header",
+		},
+		{
+			name: "link tag",
+			page: `<html><head><link rel="webmention" href="/wm"></head></html>`,
+			want: "/wm",
+		},
+		{
+			name: "anchor with rel first",
+			page: `<a href='endpoint' rel='webmention'>mentions</a>`,
+			want: "/post/endpoint",
+		},
+		{
+			name: "empty href is the page itself",
+			page: `<link rel="webmention" href="">`,
+			want: "/post/1",
+		},
+		{
+			name: "entities in href",
+			page: `<link rel="webmention" href="/wm?a=1&amp;b=2">`,
+			want: "/wm?a=1&b=2",
+		},
+		{
+			name: "commented out link is skipped",
+			page: `<!-- <link rel="webmention" href="/old"> --><link rel="webmention" href="/new">`,
+			want: "/new",
+		},
+		{
+			name: "other rels are not webmention",
+			page: `<link rel="nowebmention" href="/no"><a href="/x">x</a>`,
+			err:  ErrNoEndpoint,
+		},
+		{
+			name: "javascript endpoint",
+			page: `<link rel="webmention" href="javascript:alert(1)">`,
+			err:  errAny,
+		},
+		{
+			name:   "missing page",
+			status: http.StatusNotFound,
+			page:   `<link rel="webmention" href="/wm">`,
+			err:    errAny,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status := tt.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			srv := servePage(t, status, tt.link, tt.page)
+			got, err := Discover(srv.URL + "/post/1")
+			if tt.err != nil {
+				if err == nil || (tt.err != errAny && !errors.Is(err, tt.err)) {
+					t.Fatalf("Discover() = %q, %v, want error %v", got, err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Discover() error: %v", err)
+			}
+			if want := srv.URL + tt.want; got != want {
+				t.Errorf("Discover() = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestDiscoverFollowsRedirects(t *testing.T) {
+	allowLocal(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/old", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/new/page", http.StatusMovedPermanently)
+	})
+	mux.HandleFunc("/new/page", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<link rel="webmention" href="wm">`)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	got, err := Discover(srv.URL + "/old")
+	if err != nil {
+		t.Fatalf("Discover() error: %v", err)
+	}
+	if want := srv.URL + "/new/wm"; got != want {
+		t.Errorf("Discover() = %q, want the endpoint relative to the redirected page %q", got, want)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	allowLocal(t)
+	const target = "https://beeline.example/post/1"
+	tests := []struct {
+		name      string
+		status    int
+		page      string
+		wantTitle string
+		err       error
+	}{
+		{
+			name:      "links to target",
+			page:      `<html><head><title> A  &amp; B </title></head><body><a href="https://beeline.example/post/1">post</a></body></html>`,
+			wantTitle: "A & B",
+		},
+		{
+			name: "trailing slash and fragment",
+			page: `<a href="https://beeline.example/post/1/#reply">post</a>`,
+		},
+		{
+			name: "link to another post",
+			page: `<a href="https://beeline.example/post/12">post</a>`,
+			err:  ErrNoLink,
+		},
+		{
+			name: "link only in a comment",
+			page: `<!-- <a href="https://beeline.example/post/1">post</a> -->`,
+			err:  ErrNoLink,
+		},
+		{
+			name: "target only as text",
+			page: `<p>https://beeline.example/post/1</p>`,
+			err:  ErrNoLink,
+		},
+		{
+			name:   "gone",
+			status: http.StatusGone,
+			err:    ErrGone,
+		},
+		{
+			name:   "server error",
+			status: http.StatusInternalServerError,
+			page:   `<a href="https://beeline.example/post/1">post</a>`,
+			err:    errAny,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status := tt.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			srv := servePage(t, status, "", tt.page)
+			got, err := Verify(srv.URL+"/source", target)
+			if tt.err != nil {
+				if err == nil || (tt.err != errAny && !errors.Is(err, tt.err)) {
+					t.Fatalf("Verify() = %v, %v, want error %v", got, err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Verify() error: %v", err)
+			}
+			if got.Title != tt.wantTitle {
+				t.Errorf("Verify() title = %q, want %q", got.Title, tt.wantTitle)
+			}
+		})
+	}
+}
+
+func TestSend(t *testing.T) {
+	allowLocal(t)
+	var got url.Values
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/x-www-form-urlencoded" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		r.ParseForm()
+		got = r.PostForm
+		if got.Get("target") == "https://example.com/rejected" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	source := "https://beeline.example/post/1"
+	if err := Send(srv.URL+"/wm", source, "https://example.com/page"); err != nil {
+		t.Fatalf("Send() error: %v", err)
+	}
+	if got.Get("source") != source || got.Get("target") != "https://example.com/page" {
+		t.Errorf("Send() posted %v", got)
+	}
+	if err := Send(srv.URL+"/wm", source, "https://example.com/rejected"); err == nil {
+		t.Errorf("Send() to an endpoint answering 400 succeeded")
+	}
+	if err := Send("ftp://example.com/wm", source, "https://example.com/page"); err == nil {
+		t.Errorf("Send() to an ftp endpoint succeeded")
+	}
+}
+
+func TestRefusesPrivateAddresses(t *testing.T) {
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		fmt.Fprint(w, `<a href="https://beeline.example/post/1">post</a>`)
+	}))
+	defer srv.Close()
+
+	if _, err := Verify(srv.URL, "https://beeline.example/post/1"); !errors.Is(err, outbound.ErrPrivateAddress) {
+		t.Errorf("Verify() of a loopback source error = %v, want %v", err, outbound.ErrPrivateAddress)
+	}
+	if _, err := Discover(srv.URL); !errors.Is(err, outbound.ErrPrivateAddress) {
+		t.Errorf("Discover() on a loopback target error = %v, want %v", err, outbound.ErrPrivateAddress)
+	}
+	if err := Send(srv.URL, "https://beeline.example/post/1", "https://example.com"); !errors.Is(err, outbound.ErrPrivateAddress) {
+		t.Errorf("Send() to a loopback endpoint error = %v, want %v", err, outbound.ErrPrivateAddress)
+	}
+	if _, err := Verify("http://169.254.169.254/latest/meta-data/", "https://beeline.example/post/1"); !errors.Is(err, outbound.ErrPrivateAddress) {
+		t.Errorf("Verify() of the metadata address error = %v, want %v", err, outbound.ErrPrivateAddress)
+	}
+	if requests != 0 {
+		t.Errorf("the loopback server got %d requests", requests)
+	}
+}
+
+func TestRedirectToOtherScheme(t *testing.T) {
+	allowLocal(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "file:///etc/passwd", http.StatusFound)
+	}))
+	defer srv.Close()
+	if _, err := Verify(srv.URL, "https://beeline.example/post/1"); err == nil {
+		t.Errorf("Verify() followed a redirect to a file url")
+	}
+}